@@ -19,12 +19,36 @@ package cache
 
 import "sync"
 
+// Cacher is a cache of chunk contents. Its implementations are safe for
+// concurrent use by multiple goroutines.
 type Cacher interface {
 	Get(key interface{}) (value []byte, exists bool)
 	Set(key interface{}, value []byte)
 	Len() int
 }
 
+// New returns a new Cacher of the given capacity. A capacity of 0 disables
+// caching by returning a NopCache.
+func New(capacity int) Cacher {
+	if capacity <= 0 {
+		return NopCache{}
+	}
+	return NewFifoCache(capacity)
+}
+
+// NopCache is a Cacher that never stores anything, so that every Get misses.
+type NopCache struct{}
+
+func (NopCache) Get(key interface{}) (value []byte, exists bool) {
+	return nil, false
+}
+
+func (NopCache) Set(key interface{}, value []byte) {}
+
+func (NopCache) Len() int {
+	return 0
+}
+
 type FifoCache struct {
 	head, tail *fifoCacheEntry
 	data       map[interface{}][]byte
@@ -51,6 +75,10 @@ func (c *FifoCache) Get(key interface{}) (value []byte, exists bool) {
 func (c *FifoCache) Set(key interface{}, value []byte) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	if _, exists := c.data[key]; exists {
+		c.data[key] = value
+		return
+	}
 	if len(c.data) == c.capacity {
 		// Evict first entry
 		evicted := c.head
@@ -71,5 +99,7 @@ func (c *FifoCache) Set(key interface{}, value []byte) {
 }
 
 func (c *FifoCache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 	return len(c.data)
 }
@@ -19,6 +19,7 @@ package cache
 
 import (
 	"bytes"
+	"sync"
 	"testing"
 )
 
@@ -95,3 +96,56 @@ func TestFifoChunkCache(t *testing.T) {
 		t.Fatal("Value for k3 does not match")
 	}
 }
+
+func TestNopCache(t *testing.T) {
+	var cache Cacher = New(0)
+	cache.Set(0, []byte{'0'})
+	if cache.Len() != 0 {
+		t.Fatal("Cache should be of size 0")
+	}
+	if _, e := cache.Get(0); e {
+		t.Fatal("There should not be any value")
+	}
+	if _, isFifo := New(1).(*FifoCache); !isFifo {
+		t.Fatal("Cache of capacity 1 should be a FifoCache")
+	}
+}
+
+func TestFifoCacheSetExisting(t *testing.T) {
+	var cache Cacher = NewFifoCache(2)
+	cache.Set(0, []byte{'0'})
+	cache.Set(0, []byte{'1'})
+	cache.Set(1, []byte{'1'})
+	if cache.Len() != 2 {
+		t.Fatal("Cache should be of size 2")
+	}
+	v, e := cache.Get(0)
+	if !e || bytes.Compare(v, []byte{'1'}) != 0 {
+		t.Fatal("Value for 0 should have been replaced")
+	}
+}
+
+func TestFifoCacheConcurrent(t *testing.T) {
+	var cache Cacher = NewFifoCache(8)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := (g*1000 + i) % 16
+				cache.Set(key, []byte{byte(key)})
+				if v, e := cache.Get(key); e && bytes.Compare(v, []byte{byte(key)}) != 0 {
+					t.Errorf("Value for %d does not match", key)
+				}
+				if cache.Len() > 8 {
+					t.Errorf("Cache should not exceed its capacity")
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if cache.Len() != 8 {
+		t.Fatal("Cache should be full")
+	}
+}
@@ -18,9 +18,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/n-peugnet/dna-backup/dna"
 	"github.com/n-peugnet/dna-backup/logger"
@@ -37,6 +49,7 @@ type command struct {
 const (
 	name      = "dna-backup"
 	baseUsage = "<command> [<options>] [--] <args>"
+	envPrefix = "DNA_BACKUP_"
 )
 
 var (
@@ -46,6 +59,76 @@ var (
 	poolCount     int
 	trackSize     int
 	tracksPerPool int
+	verify        bool
+	version       int
+	featureSize   int
+	cacheSize     int
+	jsonErrors    bool
+	appendMode    bool
+	versionLabel  string
+	versionMsg    string
+	progressJson  string
+	prefetch      int
+	patchRatio    float64
+	maxDepth      int
+	rawThreshold  float64
+	coalesceSize  int
+	readWorkers   int
+	readAhead     int64
+	strict        bool
+	hashesFormat  string
+	hashesCodec   string
+	baseVersion   string
+	sampleFiles   int
+	caseCheck     string
+	minFreeSpace  int64
+	minShared     float64
+	resume        bool
+	dryRun        bool
+	storeWorkers  int
+	storeQueue    int
+	selfTestSeed  int64
+	keepTemp      bool
+	fileMap       bool
+	noSketch      bool
+	indexOnly     bool
+	verifyWrite   bool
+	repairRecipe  bool
+	plainTail     bool
+	splitFiles    bool
+	samplePercent float64
+	sampleSeed    int64
+	filesFrom     string
+	allVersions   bool
+	fileBounds    bool
+	merkleRoots   bool
+	compressDict  bool
+	maxVersions   int
+	readThreads   int
+	compression   string
+	checksumAlgo  string
+	retries       int
+	retryDelay    time.Duration
+	timeout       time.Duration
+	ctx           = context.Background()
+	dedupReport   int
+	debounce      time.Duration
+	xattrs        bool
+	specials      bool
+	fromVersion   int
+	toVersion     int
+	manifestPath  string
+	emitBounds    string
+	stage         bool
+	finalStaged   bool
+	fsyncWrites   bool
+	listFiles     bool
+	jsonOutput    bool
+	restoreAt     string
+	restoreModes  bool
+	remoteShell   string
+	dirMode       = modeFlag(0775)
+	fileMode      = modeFlag(0666)
 )
 
 var Commit = command{flag.NewFlagSet("commit", flag.ExitOnError), commitMain,
@@ -54,16 +137,116 @@ var Commit = command{flag.NewFlagSet("commit", flag.ExitOnError), commitMain,
 }
 var Restore = command{flag.NewFlagSet("restore", flag.ExitOnError), restoreMain,
 	"[<options>] [--] <source> <dest>",
-	"Restore the last version from repo <source> into folder <dest>",
+	"Restore a version, the last one by default, from repo <source> into folder <dest>",
 }
 var Export = command{flag.NewFlagSet("export", flag.ExitOnError), exportMain,
 	"[<options>] [--] <source> <dest>",
 	"Export versions from repo <source> into folder <dest>",
 }
+var Branch = command{flag.NewFlagSet("branch", flag.ExitOnError), branchMain,
+	"[<options>] [--] <source> <version> <dest>",
+	"Start the new repo <dest> from version <version> of repo <source>",
+}
+var Merge = command{flag.NewFlagSet("merge", flag.ExitOnError), mergeMain,
+	"[<options>] [--] <repo>... <dest>",
+	"Merge the versions of the repos <repo> into the new repo <dest>, ordered by commit time",
+}
+var Finalize = command{flag.NewFlagSet("finalize", flag.ExitOnError), finalizeMain,
+	"[<options>] [--] <repo>",
+	"Finalize the version of repo <repo> opened by commit -append, or its staged commits",
+}
+var Compact = command{flag.NewFlagSet("compact", flag.ExitOnError), compactMain,
+	"[<options>] [--] <repo>",
+	"Create a new version of repo <repo> without the costly delta chunks of the latest one",
+}
+var Verify = command{flag.NewFlagSet("verify", flag.ExitOnError), verifyMain,
+	"[<options>] [--] <repo>",
+	"Check the integrity of all the chunks stored in repo <repo>",
+}
+var Config = command{flag.NewFlagSet("config", flag.ExitOnError), configMain,
+	"[<options>] [--] <repo>",
+	"Print the parameters of repo <repo> and whether they come from its config",
+}
+var Watch = command{flag.NewFlagSet("watch", flag.ExitOnError), watchMain,
+	"[<options>] [--] <source> <dest>",
+	"Watch folder <source> and commit it into repo <dest> each time it changes",
+}
+var CompareVersions = command{flag.NewFlagSet("compare-versions", flag.ExitOnError), compareVersionsMain,
+	"[<options>] [--] <repo> <file>",
+	"Print the byte ranges of <file> that changed between two versions of repo <repo>",
+}
+var List = command{flag.NewFlagSet("list", flag.ExitOnError), listMain,
+	"[<options>] [--] <repo>",
+	"List the versions of repo <repo> or the files of one of them",
+}
+var Estimate = command{flag.NewFlagSet("estimate", flag.ExitOnError), estimateMain,
+	"[<options>] [--] <source> <repo>",
+	"Estimate what committing <source> into repo <repo> would store",
+}
+var Similar = command{flag.NewFlagSet("similar", flag.ExitOnError), similarMain,
+	"[<options>] [--] <repo>",
+	"Report the groups of near-duplicate files of the latest version of repo <repo>",
+}
+var SelfTest = command{flag.NewFlagSet("selftest", flag.ExitOnError), selfTestMain,
+	"[<options>]",
+	"Commit and restore a synthetic tree to check that the whole pipeline works",
+}
+var RestoreFile = command{flag.NewFlagSet("restore-file", flag.ExitOnError), restoreFileMain,
+	"[<options>] [--] <repo> <path> [<dest>]",
+	"Restore the file <path> of the latest version of repo <repo> into <dest> or stdout",
+}
+var Stats = command{flag.NewFlagSet("stats", flag.ExitOnError), statsMain,
+	"[<options>] [--] <repo>",
+	"Print the histogram of the chunk sizes of a version of repo <repo>",
+}
+var Refs = command{flag.NewFlagSet("refs", flag.ExitOnError), refsMain,
+	"[<options>] [--] <repo> <version>/<index>",
+	"List the entries of the recipes of repo <repo> that need the given chunk",
+}
+var Recompress = command{flag.NewFlagSet("recompress", flag.ExitOnError), recompressMain,
+	"[<options>] [--] <repo>",
+	"Rewrite all the chunks of repo <repo> with another compression codec",
+}
+var Versions = command{flag.NewFlagSet("versions", flag.ExitOnError), versionsMain,
+	"[<options>] [--] <repo>",
+	"Print a table of the versions of repo <repo> with their files, size and chunks",
+}
+var Sync = command{flag.NewFlagSet("sync", flag.ExitOnError), syncMain,
+	"[<options>] [--] <repo> <remote>",
+	"Copy repo <repo> into repo <remote>, only sending the chunks it does not have",
+}
+var SyncServe = command{flag.NewFlagSet("sync-serve", flag.ExitOnError), syncServeMain,
+	"[<options>] [--] <repo>",
+	"Receive into repo <repo> the copy sent by sync on the standard input",
+}
+var RebuildVersions = command{flag.NewFlagSet("rebuild-versions", flag.ExitOnError), rebuildVersionsMain,
+	"[<options>] [--] <repo>",
+	"Regenerate the versions index of repo <repo> from its version dirs",
+}
 var subcommands = map[string]command{
-	Commit.Flag.Name():  Commit,
-	Restore.Flag.Name(): Restore,
-	Export.Flag.Name():  Export,
+	Commit.Flag.Name():          Commit,
+	Restore.Flag.Name():         Restore,
+	Export.Flag.Name():          Export,
+	Verify.Flag.Name():          Verify,
+	Finalize.Flag.Name():        Finalize,
+	Branch.Flag.Name():          Branch,
+	Merge.Flag.Name():           Merge,
+	Compact.Flag.Name():         Compact,
+	Config.Flag.Name():          Config,
+	Watch.Flag.Name():           Watch,
+	CompareVersions.Flag.Name(): CompareVersions,
+	List.Flag.Name():            List,
+	Estimate.Flag.Name():        Estimate,
+	Similar.Flag.Name():         Similar,
+	SelfTest.Flag.Name():        SelfTest,
+	RestoreFile.Flag.Name():     RestoreFile,
+	Recompress.Flag.Name():      Recompress,
+	Stats.Flag.Name():           Stats,
+	Refs.Flag.Name():            Refs,
+	RebuildVersions.Flag.Name(): RebuildVersions,
+	Sync.Flag.Name():            Sync,
+	Versions.Flag.Name():        Versions,
+	SyncServe.Flag.Name():       SyncServe,
 }
 
 func init() {
@@ -73,19 +256,151 @@ func init() {
 		for _, s := range subcommands {
 			fmt.Printf("  %s	%s\n", s.Flag.Name(), s.Help)
 		}
+		fmt.Fprintf(flag.CommandLine.Output(), "\nThe default value of each option can be set with an environment variable\n"+
+			"named after it, for instance %s for -file-mode. The options\n"+
+			"given on the command line take precedence over these variables.\n", envName("file-mode"))
 		os.Exit(1)
 	}
 	// setup subcommands
 	for _, s := range subcommands {
-		s.Flag.IntVar(&logLevel, "v", 3, "log verbosity level (0-4)")
-		s.Flag.IntVar(&chunkSize, "c", 8<<10, "chunk size")
+		registerCommonFlags(s.Flag)
+	}
+	Commit.Flag.IntVar(&featureSize, "sketch-feature-size", 0, "size in bytes of the sketch features (0 derives it from the chunk size)")
+	Commit.Flag.Float64Var(&rawThreshold, "raw-threshold", 0, "store chunks uncompressed if compression does not shrink them below this ratio (0 disables it)")
+	Commit.Flag.IntVar(&coalesceSize, "coalesce-size", 0, "merge adjacent inline chunks of the recipe up to this size in bytes (0 disables it)")
+	Commit.Flag.IntVar(&readWorkers, "read-workers", 0, "number of files read in parallel ahead of their concatenation (0 reads them serially)")
+	Commit.Flag.Int64Var(&readAhead, "read-ahead", 64<<20, "maximum number of bytes of file content read in advance")
+	Commit.Flag.Int64Var(&minFreeSpace, "min-free-space", 0, "refuse to commit if less than this number of bytes would be left free (0 disables it)")
+	Commit.Flag.IntVar(&storeWorkers, "store-concurrency", 1, "number of chunks stored at the same time")
+	Commit.Flag.IntVar(&storeQueue, "store-queue", 0, "number of new chunks that can wait to be stored (0 queues 32 per stored chunk at the same time)")
+	Commit.Flag.StringVar(&filesFrom, "files-from", "", "only commit the files listed one per line in the given file (- for stdin), relative to <source>")
+	Commit.Flag.BoolVar(&splitFiles, "split-files", false, "store the file list split by top-level directory, so that single files are restored faster")
+	Commit.Flag.BoolVar(&fileMap, "file-map", false, "store the recipe entries of each file to restore single files faster")
+	Commit.Flag.IntVar(&maxVersions, "max-versions", 0, "prune the oldest versions once the commit is finalized so that at most this many remain (0 keeps all of them)")
+	Commit.Flag.BoolVar(&compressDict, "dictionary", false, "compress the chunks of a new repo with a zlib dictionary built from a sample of its first commit")
+	Commit.Flag.BoolVar(&merkleRoots, "merkle", false, "store in the file list the Merkle root of each file, over the checksums of its chunk-sized blocks")
+	Commit.Flag.BoolVar(&fileBounds, "file-boundaries", false, "restart the chunking at each file so that no chunk spans two files, at some dedup cost")
+	Commit.Flag.StringVar(&emitBounds, "emit-boundaries", "", "only chunk <source> and write the offset, size and kind of each chunk into the given file (- for stdout), storing nothing")
+	Commit.Flag.BoolVar(&plainTail, "plain-tail", false, "store the trailing partial chunk as is instead of trying to delta-encode it")
+	Commit.Flag.BoolVar(&noSketch, "no-sketch", false, "do not compute the resemblance sketches of the chunks, which disables delta encoding")
+	Commit.Flag.BoolVar(&indexOnly, "index-only", false, "store the file list, hashes and recipe of the version without the content of its chunks")
+	Verify.Flag.Float64Var(&samplePercent, "sample", 0, "only verify this percent of the chunks, chosen at random (0 verifies all of them)")
+	Verify.Flag.Int64Var(&sampleSeed, "sample-seed", 0, "seed selecting the sampled chunks (0 picks a random one)")
+	Verify.Flag.BoolVar(&repairRecipe, "repair-recipe", false, "rebuild the corrupt recipe of the latest version from its chunks instead of verifying them")
+	Commit.Flag.BoolVar(&verifyWrite, "verify-on-write", false, "read back each new chunk right after storing it and abort the commit if it does not match")
+	Commit.Flag.BoolVar(&strict, "strict", false, "fail without storing the version if any warning is reported while reading the source")
+	Commit.Flag.StringVar(&baseVersion, "base", "", "only deduplicate against the chunks of this version (negative counts from the latest)")
+	Commit.Flag.StringVar(&hashesFormat, "hashes-format", "", "encoding of the hashes files of a new repo (gob, binary)")
+	Commit.Flag.StringVar(&hashesCodec, "hashes-compression", "", "compression of the hashes files of a new repo (none, zlib)")
+	Commit.Flag.StringVar(&checksumAlgo, "checksum-algo", "", "integrity checksum algorithm of a new repo (sha256, sha512, crc64)")
+	Commit.Flag.IntVar(&dedupReport, "dedup-report", 0, "print a report with the given number of most reused chunks after the commit")
+	Commit.Flag.BoolVar(&stage, "stage", false, "commit into the staging area without locking the repo and print the name of the staged commit")
+	Finalize.Flag.BoolVar(&finalStaged, "staged", false, "turn the staged commits into new versions, in the order they were completed")
+	Commit.Flag.BoolVar(&appendMode, "append", false, "append to the latest version and leave it open for more appends")
+	Commit.Flag.StringVar(&versionLabel, "label", "", "label of the new version recorded in the versions index")
+	Commit.Flag.StringVar(&versionMsg, "message", "", "message describing the new version recorded in the versions index")
+	for _, s := range []command{Commit, Restore} {
+		s.Flag.StringVar(&progressJson, "progress-json", "", "write progress events as JSON lines into the given file (- for stdout)")
+	}
+	for _, s := range []command{Commit, Restore, Watch} {
+		s.Flag.BoolVar(&xattrs, "xattrs", false, "store and restore the extended attributes of the files")
+		s.Flag.BoolVar(&specials, "specials", false, "store and restore the named pipes and device nodes, without content")
+		s.Flag.StringVar(&caseCheck, "case-check", "ignore", "what to do with paths colliding on case-insensitive filesystems (ignore, warn, error)")
+	}
+	Restore.Flag.IntVar(&prefetch, "prefetch", 16, "number of recipe entries for which chunks are loaded in advance")
+	Sync.Flag.StringVar(&remoteShell, "e", "", "command reaching the host of <remote>, such as \"ssh host\", on which "+name+" sync-serve is run")
+	for _, s := range []command{Commit, Finalize, Compact, Branch, Merge, Sync, SyncServe} {
+		s.Flag.BoolVar(&fsyncWrites, "fsync", false, "flush each new chunk and metadata file to the drive before reporting success, so that it survives a power loss, at the cost of much slower writes")
 	}
-	Export.Flag.StringVar(&format, "format", "dir", "format of the export (dir, csv)")
+	for _, s := range []command{Restore, Verify} {
+		s.Flag.IntVar(&readThreads, "chunk-read-concurrency", 0, "maximum number of chunks read at the same time (0 reads them serially for verify and bounds them by the prefetch for restore)")
+	}
+	Restore.Flag.StringVar(&manifestPath, "output-manifest", "", "write a JSON manifest of the restored files into the given file (- for stdout)")
+	Restore.Flag.BoolVar(&resume, "resume", false, "skip the files already restored with the right size and checksum")
+	Restore.Flag.BoolVar(&verify, "verify", false, "verify the checksum of each restored file")
+	Restore.Flag.BoolVar(&restoreModes, "modes", true, "give the restored files back the permissions they were committed with instead of -file-mode")
+	Restore.Flag.IntVar(&version, "version", -1, "version to restore (negative counts from the latest)")
+	Restore.Flag.StringVar(&restoreAt, "at", "", "restore the latest version committed at or before this RFC 3339 time instead")
+	Restore.Flag.BoolVar(&dryRun, "dry-run", false, "list the files that would be restored, the conflicts and the space needed without writing anything")
+	Compact.Flag.Float64Var(&patchRatio, "max-patch-ratio", 1, "re-materialize delta chunks with a patch at least this ratio of their size")
+	Compact.Flag.IntVar(&maxDepth, "max-depth", 8, "re-materialize delta chunks carried over more versions than this since their source")
+	Watch.Flag.DurationVar(&debounce, "debounce", 2*time.Second, "duration without changes before committing")
+	CompareVersions.Flag.IntVar(&fromVersion, "from", -2, "version to compare from (negative counts from the latest)")
+	CompareVersions.Flag.IntVar(&toVersion, "to", -1, "version to compare to (negative counts from the latest)")
+	Estimate.Flag.IntVar(&sampleFiles, "sample", 100, "maximum number of files read to estimate the deduplication and compression")
+	Similar.Flag.Float64Var(&minShared, "min-shared", 0.5, "minimal ratio of sketch features of the smallest file shared with the other")
+	SelfTest.Flag.Int64Var(&selfTestSeed, "seed", 1, "seed of the generated synthetic tree")
+	SelfTest.Flag.BoolVar(&keepTemp, "keep", false, "keep the temporary directory holding the tree, the repo and the restore")
+	Recompress.Flag.StringVar(&compression, "compression", "zlib", "new compression codec of the chunks (zlib, none)")
+	List.Flag.BoolVar(&listFiles, "files", false, "list the files of a version instead of the versions")
+	List.Flag.IntVar(&version, "version", -1, "version of which to list the files (negative counts from the latest)")
+	List.Flag.BoolVar(&jsonOutput, "json", false, "print the list as JSON")
+	Versions.Flag.BoolVar(&jsonOutput, "json", false, "print the versions as JSON")
+	Verify.Flag.BoolVar(&jsonOutput, "json", false, "print the status of each verified chunk and a summary as JSON")
+	Export.Flag.StringVar(&format, "format", "dir", "format of the export (dir, csv, repo)")
+	Stats.Flag.IntVar(&version, "version", -1, "version of which to count the chunks (negative counts from the latest)")
+	Stats.Flag.BoolVar(&allVersions, "all", false, "count the chunks of all the versions")
+	Export.Flag.IntVar(&version, "version", -1, "version to export with the repo format (negative counts from the latest)")
 	Export.Flag.IntVar(&poolCount, "pools", 96, "number of pools")
 	Export.Flag.IntVar(&trackSize, "track", 1020, "size of a DNA track")
 	Export.Flag.IntVar(&tracksPerPool, "tracks-per-pool", 10000, "number of tracks per pool")
 }
 
+// envName returns the name of the environment variable setting the default
+// value of the given flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// applyEnv sets the flags of f from the environment variables named after them
+// and found by lookup. It must be called before parsing the arguments, so that
+// they override the environment.
+func applyEnv(f *flag.FlagSet, lookup func(string) (string, bool)) (err error) {
+	f.VisitAll(func(fl *flag.Flag) {
+		value, found := lookup(envName(fl.Name))
+		if !found || err != nil {
+			return
+		}
+		if serr := fl.Value.Set(value); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, envName(fl.Name), serr)
+		}
+	})
+	return
+}
+
+// registerCommonFlags adds to the given flag set the flags shared by all the
+// subcommands.
+func registerCommonFlags(f *flag.FlagSet) {
+	f.IntVar(&logLevel, "v", 3, "log verbosity level (0-4)")
+	f.IntVar(&chunkSize, "c", 8<<10, "chunk size")
+	f.IntVar(&cacheSize, "cache", 10000, "number of chunks kept in cache (0 disables it)")
+	f.IntVar(&retries, "retries", 1, "maximum number of attempts of a chunk IO operation")
+	f.DurationVar(&retryDelay, "retry-delay", 100*time.Millisecond, "delay before retrying a chunk IO operation, doubled each time")
+	f.BoolVar(&jsonErrors, "json-errors", false, "print errors as a single JSON line")
+	f.DurationVar(&timeout, "timeout", 0, "abort the commit or restore if it takes longer than this duration (0 disables it)")
+	f.Var(&dirMode, "dir-mode", "permissions in octal of the created directories, before the umask")
+	f.Var(&fileMode, "file-mode", "permissions in octal of the created files, before the umask")
+}
+
+// modeFlag is a permissions flag given in octal.
+type modeFlag fs.FileMode
+
+func (m *modeFlag) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *modeFlag) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return err
+	}
+	if fs.FileMode(mode)&^fs.ModePerm != 0 {
+		return fmt.Errorf("%s is not a permissions mode", value)
+	}
+	*m = modeFlag(mode)
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -103,22 +418,245 @@ func main() {
 		cmd.Flag.PrintDefaults()
 		os.Exit(1)
 	}
+	if err := applyEnv(cmd.Flag, os.LookupEnv); err != nil {
+		fmt.Fprintf(cmd.Flag.Output(), "error: %s\n\n", err)
+		cmd.Flag.Usage()
+	}
 	cmd.Flag.Parse(args[1:])
 	logger.Init(logLevel)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	if err := cmd.Run(cmd.Flag.Args()); err != nil {
+		if jsonErrors {
+			printJsonError(os.Stderr, err)
+			os.Exit(1)
+		}
 		fmt.Fprintf(cmd.Flag.Output(), "error: %s\n\n", err)
 		cmd.Flag.Usage()
 	}
 }
 
+type jsonError struct {
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	Path    string        `json:"path,omitempty"`
+	ChunkId *repo.ChunkId `json:"chunkId,omitempty"`
+}
+
+// printJsonError prints the given error in w as a single JSON line, extracting
+// the structured information it wraps.
+func printJsonError(w io.Writer, err error) {
+	e := jsonError{Code: "error", Message: err.Error()}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		e.Code = "io"
+		e.Path = pathErr.Path
+	}
+	var chunkErr *repo.ChunkError
+	if errors.As(err, &chunkErr) {
+		e.Code = "chunk"
+		e.ChunkId = chunkErr.Id
+	}
+	switch {
+	case errors.Is(err, repo.ErrCorruptChunk), errors.Is(err, repo.ErrCorruptList):
+		e.Code = "corrupt"
+	case errors.Is(err, repo.ErrRepoLocked):
+		e.Code = "locked"
+	case errors.Is(err, repo.ErrIncompatibleFormat), errors.Is(err, repo.ErrIncompatibleChunkSize):
+		e.Code = "incompatible"
+	case errors.Is(err, context.DeadlineExceeded):
+		e.Code = "timeout"
+	}
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		logger.Error(err)
+	}
+}
+
+// createRepo returns a repo configured with the common options, which is
+// created if the path does not already hold one.
+func createRepo(path string) (*repo.Repo, error) {
+	return configureRepo(repo.CreateRepo(path, chunkSize, true))
+}
+
+// newRepo returns an existing repo configured with the common options.
+func newRepo(path string) (*repo.Repo, error) {
+	return configureRepo(repo.OpenRepo(path, chunkSize))
+}
+
+// openRepo returns an existing read-only repo configured with the common
+// options.
+func openRepo(path string) (*repo.Repo, error) {
+	return configureRepo(repo.OpenReadOnlyRepo(path, chunkSize))
+}
+
+// configureRepo sets the common options of the given repo, unless err is set.
+func configureRepo(r *repo.Repo, err error) (*repo.Repo, error) {
+	if err != nil {
+		return nil, err
+	}
+	r.SetCacheSize(cacheSize)
+	r.SetRetry(retries, retryDelay)
+	r.SetDirMode(fs.FileMode(dirMode))
+	r.SetFileMode(fs.FileMode(fileMode))
+	r.SetContext(ctx)
+	r.SetFsync(fsyncWrites)
+	return r, nil
+}
+
+// readFilesFrom reads the newline-delimited paths of the given file, or of the
+// standard input if it is "-", ignoring the empty lines.
+func readFilesFrom(path string) ([]string, error) {
+	in := os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+	paths := []string{}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if line := strings.TrimSuffix(scanner.Text(), "\r"); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// setProgress configures the progress reporting of the repo given the value of
+// the progress-json flag. The returned function closes the progress file.
+func setProgress(r *repo.Repo) (func(), error) {
+	switch progressJson {
+	case "":
+		return func() {}, nil
+	case "-":
+		r.SetProgress(repo.JsonProgress(os.Stdout))
+		return func() {}, nil
+	}
+	f, err := os.Create(progressJson)
+	if err != nil {
+		return nil, err
+	}
+	r.SetProgress(repo.JsonProgress(f))
+	return func() {
+		r.SetProgress(nil)
+		if err := f.Close(); err != nil {
+			logger.Error("progress ", err)
+		}
+	}, nil
+}
+
 func commitMain(args []string) error {
 	if len(args) != 2 {
 		return fmt.Errorf("wrong number of args")
 	}
 	source := args[0]
 	dest := args[1]
-	r := repo.NewRepo(dest, chunkSize)
-	r.Commit(source)
+	r, err := createRepo(dest)
+	if err != nil {
+		return err
+	}
+	if featureSize != 0 {
+		if err := r.SetSketchFeatureSize(featureSize); err != nil {
+			return err
+		}
+	}
+	r.SetRawThreshold(rawThreshold)
+	r.SetCoalesceSize(coalesceSize)
+	r.SetReadAhead(readWorkers, readAhead)
+	r.SetStrict(strict)
+	r.SetMinFreeSpace(minFreeSpace)
+	r.SetStoreConcurrency(storeWorkers)
+	r.SetStoreQueueSize(storeQueue)
+	r.SetPlainTail(plainTail)
+	r.SetFileBoundaries(fileBounds)
+	r.SetMerkleRoots(merkleRoots)
+	r.SetCompressionDictionary(compressDict)
+	if maxVersions < 0 {
+		return fmt.Errorf("-max-versions must not be negative")
+	}
+	r.SetMaxVersions(maxVersions)
+	r.SetFileMap(fileMap)
+	r.SetSplitFiles(splitFiles)
+	if filesFrom != "" {
+		paths, err := readFilesFrom(filesFrom)
+		if err != nil {
+			return err
+		}
+		r.SetSourceFiles(paths)
+	}
+	if noSketch {
+		r.SetSketches(false)
+	}
+	r.SetIndexOnly(indexOnly)
+	r.SetVersionLabel(versionLabel)
+	r.SetVersionMessage(versionMsg)
+	r.SetVerifyOnWrite(verifyWrite)
+	r.SetXattrs(xattrs)
+	r.SetSpecials(specials)
+	if err := r.SetCaseCheck(caseCheck); err != nil {
+		return err
+	}
+	if checksumAlgo != "" {
+		if err := r.SetChecksumAlgo(checksumAlgo); err != nil {
+			return err
+		}
+	}
+	if hashesCodec != "" {
+		if err := r.SetHashesCompression(hashesCodec); err != nil {
+			return err
+		}
+	}
+	if baseVersion != "" {
+		base, err := strconv.Atoi(baseVersion)
+		if err != nil {
+			return fmt.Errorf("invalid base version: %w", err)
+		}
+		r.SetBase(base)
+	}
+	if hashesFormat != "" {
+		if err := r.SetHashesFormat(hashesFormat); err != nil {
+			return err
+		}
+	}
+	closeProgress, err := setProgress(r)
+	if err != nil {
+		return err
+	}
+	defer closeProgress()
+	if emitBounds != "" {
+		return emitBoundaries(r, source)
+	}
+	if stage {
+		name, err := r.Stage(source)
+		if err != nil {
+			return err
+		}
+		fmt.Println(name)
+		return nil
+	}
+	if appendMode {
+		err = r.Append(source)
+	} else {
+		err = r.Commit(source)
+	}
+	if err != nil || dedupReport <= 0 {
+		return err
+	}
+	readOnly, err := openRepo(dest)
+	if err != nil {
+		return err
+	}
+	report, err := readOnly.DedupReport(dedupReport)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
 	return nil
 }
 
@@ -128,8 +666,95 @@ func restoreMain(args []string) error {
 	}
 	source := args[0]
 	dest := args[1]
-	r := repo.NewRepo(source, chunkSize)
-	r.Restore(dest)
+	r, err := openRepo(source)
+	if err != nil {
+		return err
+	}
+	r.SetRestoreVerify(verify)
+	r.SetRestoreResume(resume)
+	r.SetRestoreModes(restoreModes)
+	r.SetXattrs(xattrs)
+	r.SetSpecials(specials)
+	if err := r.SetCaseCheck(caseCheck); err != nil {
+		return err
+	}
+	r.SetPrefetch(prefetch)
+	r.SetChunkReadConcurrency(readThreads)
+	v := version
+	if restoreAt != "" {
+		t, err := time.Parse(time.RFC3339, restoreAt)
+		if err != nil {
+			return fmt.Errorf("invalid restore time: %w", err)
+		}
+		if v, err = r.VersionAt(t); err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		r.SetRestoreVersion(v)
+		return printRestorePlan(r, dest)
+	}
+	closeProgress, err := setProgress(r)
+	if err != nil {
+		return err
+	}
+	defer closeProgress()
+	switch manifestPath {
+	case "":
+	case "-":
+		r.SetRestoreManifest(os.Stdout)
+	default:
+		f, err := os.Create(manifestPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r.SetRestoreManifest(f)
+	}
+	return r.RestoreVersion(dest, v)
+}
+
+// emitBoundaries writes the chunk boundaries of source against r into the
+// file given by the emit-boundaries option.
+func emitBoundaries(r *repo.Repo, source string) error {
+	out := os.Stdout
+	if emitBounds != "-" {
+		f, err := os.Create(emitBounds)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	if err := r.EmitBoundaries(source, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// printRestorePlan prints what restoring the selected version of r into dest
+// would write.
+func printRestorePlan(r *repo.Repo, dest string) error {
+	plan, err := r.PlanRestore(dest)
+	if err != nil {
+		return err
+	}
+	for _, f := range plan.Files {
+		fmt.Printf("%d\t%s\n", f.Size, f.Path)
+	}
+	for _, c := range plan.Conflicts {
+		fmt.Printf("conflict: %s already exists\n", c)
+	}
+	fmt.Printf("%d files, %d bytes, %d conflicts\n", len(plan.Files), plan.Size, len(plan.Conflicts))
+	switch {
+	case !plan.FreeKnown:
+		fmt.Println("free space: unknown")
+	case plan.Fits():
+		fmt.Printf("free space: %d bytes, enough\n", plan.Free)
+	default:
+		fmt.Printf("free space: %d bytes, not enough\n", plan.Free)
+	}
 	return nil
 }
 
@@ -139,15 +764,490 @@ func exportMain(args []string) error {
 	}
 	source := args[0]
 	dest := args[1]
-	r := repo.NewRepo(source, chunkSize)
+	r, err := openRepo(source)
+	if err != nil {
+		return err
+	}
 	switch format {
 	case "dir":
 		exporter := dna.New(dest, poolCount, trackSize, tracksPerPool)
-		r.Export(exporter)
+		return r.Export(exporter)
 	case "csv":
 		fmt.Println("not yet implemented")
+	case "repo":
+		return r.ExportRepo(version, dest)
 	default:
 		logger.Errorf("unknown format %s", format)
 	}
 	return nil
 }
+
+func branchMain(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number args")
+	}
+	v, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid version %q", args[1])
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	return r.ExportRepo(v, args[2])
+}
+
+func mergeMain(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("wrong number args")
+	}
+	var repos []*repo.Repo
+	for _, path := range args[:len(args)-1] {
+		r, err := openRepo(path)
+		if err != nil {
+			return err
+		}
+		repos = append(repos, r)
+	}
+	return repo.MergeRepos(args[len(args)-1], repos...)
+}
+
+func verifyMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	if repairRecipe {
+		r, err := newRepo(args[0])
+		if err != nil {
+			return err
+		}
+		return r.RepairRecipe()
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	r.SetVerifySample(samplePercent, sampleSeed)
+	r.SetChunkReadConcurrency(readThreads)
+	if !jsonOutput {
+		return r.Verify()
+	}
+	report, err := r.VerifyChunks()
+	if jerr := json.NewEncoder(os.Stdout).Encode(report); err == nil {
+		err = jerr
+	}
+	return err
+}
+
+func finalizeMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := newRepo(args[0])
+	if err != nil {
+		return err
+	}
+	if !finalStaged {
+		return r.Finalize()
+	}
+	staged, err := r.StagedCommits()
+	if err != nil {
+		return err
+	}
+	for _, name := range staged {
+		v, err := r.FinalizeStaged(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %05d\n", name, v)
+	}
+	return nil
+}
+
+func compactMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := newRepo(args[0])
+	if err != nil {
+		return err
+	}
+	before, after, err := r.Compact(patchRatio, maxDepth)
+	if err != nil {
+		return err
+	}
+	fmt.Println("before:", before)
+	fmt.Println("after: ", after)
+	return nil
+}
+
+func configMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	params, err := r.ConfigParams()
+	if err != nil {
+		return err
+	}
+	for _, p := range params {
+		source := "default"
+		if p.FromConfig {
+			source = "config"
+		}
+		fmt.Printf("%s = %s (%s)\n", p.Name, p.Value, source)
+	}
+	return nil
+}
+
+func watchMain(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number args")
+	}
+	source := args[0]
+	dest := args[1]
+	r, err := createRepo(dest)
+	if err != nil {
+		return err
+	}
+	r.SetXattrs(xattrs)
+	r.SetSpecials(specials)
+	if err := r.SetCaseCheck(caseCheck); err != nil {
+		return err
+	}
+	defer r.Close()
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+	return r.Watch(source, debounce, stop)
+}
+
+func compareVersionsMain(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	ranges, err := r.CompareVersions(args[1], fromVersion, toVersion)
+	if err != nil {
+		return err
+	}
+	for _, c := range ranges {
+		fmt.Printf("%d-%d changed", c.Start, c.End)
+		for i, chunk := range c.Chunks {
+			sep := ", "
+			if i == 0 {
+				sep = " in "
+			}
+			fmt.Print(sep, repo.DescribeChunk(chunk))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func listMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	if listFiles {
+		files, err := r.VersionFiles(version)
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			return json.NewEncoder(os.Stdout).Encode(files)
+		}
+		for _, f := range files {
+			if f.Link != "" {
+				fmt.Printf("%s -> %s\n", f.Path, f.Link)
+			} else if f.Special != "" {
+				fmt.Printf("%s %s\n", f.Path, f.Special)
+			} else if f.Merkle != nil {
+				fmt.Printf("%s %d %x\n", f.Path, f.Size, f.Merkle)
+			} else {
+				fmt.Printf("%s %d\n", f.Path, f.Size)
+			}
+		}
+		return nil
+	}
+	entries, err := r.VersionEntries()
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(entries)
+	}
+	for _, e := range entries {
+		fmt.Printf("%05d %s %d files %d bytes %s", e.Version, e.Time.Local().Format(time.RFC3339), e.Files, e.Size, e.Digest)
+		if e.Label != "" {
+			fmt.Printf(" (%s)", e.Label)
+		}
+		if e.Message != "" {
+			fmt.Printf(" %s", e.Message)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func syncMain(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	if remoteShell == "" {
+		dest, err := createRepo(args[1])
+		if err != nil {
+			return err
+		}
+		return repo.SyncRepos(r, dest)
+	}
+	shell := strings.Fields(remoteShell)
+	cmd := exec.Command(shell[0], append(shell[1:], name, SyncServe.Flag.Name(), args[1])...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = r.Sync(repo.NewSyncClient(in, out))
+	out.Close()
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func syncServeMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := createRepo(args[0])
+	if err != nil {
+		return err
+	}
+	return repo.ServeSync(r, os.Stdin, os.Stdout)
+}
+
+func versionsMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	infos, err := r.ListVersions()
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(infos)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "VERSION\tTIME\tFILES\tSIZE\tCHUNKS\tLABEL\t")
+	for _, v := range infos {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%s\t\n", v.Version, v.Time.Local().Format(time.RFC3339), v.Files, v.Size, v.Chunks, v.Label)
+	}
+	return w.Flush()
+}
+
+func rebuildVersionsMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := newRepo(args[0])
+	if err != nil {
+		return err
+	}
+	return r.RebuildVersionsIndex()
+}
+
+func estimateMain(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := openRepo(args[1])
+	if err != nil {
+		return err
+	}
+	e, err := r.Estimate(args[0], sampleFiles)
+	if err != nil {
+		return err
+	}
+	fmt.Print(e)
+	return nil
+}
+
+func similarMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	groups, err := r.SimilarFiles(minShared)
+	if err != nil {
+		return err
+	}
+	for i, g := range groups {
+		if i > 0 {
+			fmt.Println()
+		}
+		for _, p := range g {
+			fmt.Println(p)
+		}
+	}
+	return nil
+}
+
+func statsMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	if version < 0 {
+		version += r.Versions()
+	}
+	versions := []int{version}
+	if allVersions {
+		versions = nil
+		for v := 0; v < r.Versions(); v++ {
+			versions = append(versions, v)
+		}
+	}
+	var total repo.SizeHistogram
+	for i, v := range versions {
+		h, err := r.ChunkSizes(v)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			total = h
+		} else {
+			total.Merge(h)
+		}
+	}
+	if allVersions {
+		fmt.Printf("chunk sizes of %d versions:\n", len(versions))
+	} else {
+		fmt.Printf("chunk sizes of version %d:\n", version)
+	}
+	fmt.Print(total)
+	return nil
+}
+
+func refsMain(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number args")
+	}
+	version, index, err := repo.ParseChunkRef(args[1])
+	if err != nil {
+		return err
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	refs, err := r.ChunkRefs(version, index)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		as := "stored"
+		if ref.Delta {
+			as = "delta source"
+		}
+		fmt.Printf("version %d position %d: %s\n", ref.Version, ref.Position, as)
+	}
+	fmt.Printf("chunk %s is referenced %d times\n", args[1], len(refs))
+	return nil
+}
+
+func selfTestMain(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("wrong number args")
+	}
+	dir, err := os.MkdirTemp("", "dna-backup-selftest")
+	if err != nil {
+		return err
+	}
+	if keepTemp {
+		fmt.Println("temporary directory:", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	report, err := repo.SelfTest(dir, chunkSize, selfTestSeed)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	fmt.Println("self-test passed")
+	return nil
+}
+
+func restoreFileMain(args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := openRepo(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		return r.RestoreFile(args[1], os.Stdout)
+	}
+	// an existing file is only replaced once the restore has succeeded
+	dest := args[2]
+	f, err := os.OpenFile(dest+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.FileMode(fileMode))
+	if err != nil {
+		return err
+	}
+	err = r.RestoreFile(args[1], f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest + ".tmp")
+		return err
+	}
+	return os.Rename(dest+".tmp", dest)
+}
+
+func recompressMain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number args")
+	}
+	r, err := newRepo(args[0])
+	if err != nil {
+		return err
+	}
+	return r.Recompress(compression)
+}
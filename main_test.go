@@ -1 +1,182 @@
 package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/n-peugnet/dna-backup/repo"
+	"github.com/n-peugnet/dna-backup/testutils"
+)
+
+func TestPrintJsonError(t *testing.T) {
+	var buff bytes.Buffer
+	id := &repo.ChunkId{Ver: 1, Idx: 2}
+	pathErr := &fs.PathError{Op: "open", Path: "some/path", Err: fs.ErrNotExist}
+	err := fmt.Errorf("verify: %w", &repo.ChunkError{Id: id, Err: pathErr})
+	printJsonError(&buff, err)
+	testutils.AssertSame(t, byte('\n'), buff.Bytes()[buff.Len()-1], "Last byte")
+	var actual jsonError
+	if err := json.Unmarshal(buff.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := jsonError{Code: "chunk", Message: err.Error(), Path: "some/path", ChunkId: id}
+	testutils.AssertSame(t, expected, actual, "Json error")
+}
+
+func TestPrintJsonErrorCodes(t *testing.T) {
+	id := &repo.ChunkId{Ver: 1, Idx: 2}
+	for code, err := range map[string]error{
+		"corrupt":      &repo.ChunkError{Id: id, Err: fmt.Errorf("%w: fingerprint mismatch", repo.ErrCorruptChunk)},
+		"locked":       fmt.Errorf("%w: remove the lock", repo.ErrRepoLocked),
+		"incompatible": fmt.Errorf("version 00001 recipe: %w", repo.ErrIncompatibleFormat),
+		"error":        errors.New("other"),
+	} {
+		var buff bytes.Buffer
+		printJsonError(&buff, err)
+		var actual jsonError
+		if err := json.Unmarshal(buff.Bytes(), &actual); err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertSame(t, code, actual.Code, "Code of "+err.Error())
+	}
+}
+
+func TestCommonFlags(t *testing.T) {
+	common := flag.NewFlagSet("common", flag.ContinueOnError)
+	registerCommonFlags(common)
+	for name, cmd := range subcommands {
+		common.VisitAll(func(f *flag.Flag) {
+			if cmd.Flag.Lookup(f.Name) == nil {
+				t.Errorf("subcommand %s is missing the common flag -%s", name, f.Name)
+			}
+		})
+	}
+}
+
+func TestModeFlag(t *testing.T) {
+	var mode modeFlag
+	if err := mode.Set("750"); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, modeFlag(0750), mode, "Mode")
+	testutils.AssertSame(t, "0750", mode.String(), "Mode string")
+	for _, wrong := range []string{"9", "17777", "rwx"} {
+		if err := mode.Set(wrong); err == nil {
+			t.Errorf("%s should be rejected", wrong)
+		}
+	}
+}
+
+func TestReadFilesFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list")
+	os.WriteFile(path, []byte("a\n\nb/c\r\n/d\n"), 0664)
+	paths, err := readFilesFrom(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, []string{"a", "b/c", "/d"}, paths, "Paths")
+}
+
+func TestApplyEnv(t *testing.T) {
+	f := flag.NewFlagSet("env", flag.ContinueOnError)
+	size := f.Int("chunk-size", 8192, "")
+	mode := f.String("file-mode", "0644", "")
+	other := f.Bool("other", false, "")
+	env := map[string]string{
+		"DNA_BACKUP_CHUNK_SIZE": "4096",
+		"DNA_BACKUP_FILE_MODE":  "0600",
+	}
+	lookup := func(key string) (value string, found bool) {
+		value, found = env[key]
+		return
+	}
+	if err := applyEnv(f, lookup); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Parse([]string{"-file-mode", "0640"}); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 4096, *size, "Chunk size from the environment")
+	testutils.AssertSame(t, "0640", *mode, "File mode from the flag")
+	testutils.AssertSame(t, false, *other, "Default value")
+
+	env["DNA_BACKUP_OTHER"] = "maybe"
+	if err := applyEnv(f, lookup); err == nil {
+		t.Error("An invalid value should be rejected")
+	}
+}
+
+func TestRebuildVersionsMain(t *testing.T) {
+	registerCommonFlags(flag.NewFlagSet("common", flag.ContinueOnError))
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("a"), 0664)
+	r := repo.NewRepo(temp, chunkSize)
+	r.SetVersionLabel("v1.0")
+	if err := r.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	index := filepath.Join(temp, "versions")
+	os.Remove(index)
+	if err := rebuildVersionsMain([]string{temp}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(index); err != nil {
+		t.Fatal("the versions index should be rebuilt:", err)
+	}
+	r, err := openRepo(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := r.VersionEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 1, entries, "Rebuilt entries")
+	testutils.AssertSame(t, "v1.0", entries[0].Label, "Rebuilt label")
+}
+
+func TestRestoreFileMainMissingChunk(t *testing.T) {
+	registerCommonFlags(flag.NewFlagSet("common", flag.ContinueOnError))
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 3*chunkSize)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	if err := repo.NewRepo(temp, chunkSize).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "a")
+	if err := restoreFileMain([]string{temp, "a", dest}); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSameFile(t, filepath.Join(source, "a"), dest, "Restored file")
+
+	os.Remove(filepath.Join(temp, "00000", "chunks", "000000000000001"))
+	os.WriteFile(dest, []byte("existing"), 0664)
+	err := restoreFileMain([]string{temp, "a", dest})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("restoring a missing chunk should fail with fs.ErrNotExist, got: ", err)
+	}
+	existing, _ := os.ReadFile(dest)
+	testutils.AssertSame(t, []byte("existing"), existing, "Existing file after failed restore")
+	if _, err := os.Stat(dest + ".tmp"); err == nil {
+		t.Error("the temporary file should be removed")
+	}
+	var buff bytes.Buffer
+	printJsonError(&buff, err)
+	var actual jsonError
+	if err := json.Unmarshal(buff.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, "chunk", actual.Code, "Code")
+	testutils.AssertSame(t, repo.ChunkId{Ver: 0, Idx: 1}, *actual.ChunkId, "Chunk id")
+}
@@ -0,0 +1,79 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SetBase restricts the deduplication of the next commit to the chunks of the
+// given version, negative numbers counting from the latest one. The committed
+// version then only depends on this base, which is recorded as its parent.
+func (r *Repo) SetBase(version int) {
+	r.base = version
+	r.hasBase = true
+}
+
+// resolveBase sets the versions whose hashes are used as deduplication sources
+// when a base has been set, and returns the index of the base or -1. The
+// version that is appended to, if any, stays a source as it is the one being
+// committed.
+func (r *Repo) resolveBase(partial int) (int, error) {
+	r.hashSources = nil
+	if !r.hasBase {
+		return -1, nil
+	}
+	idx, err := r.versionIndex(r.base)
+	if err != nil {
+		return -1, err
+	}
+	if idx >= partial {
+		return -1, fmt.Errorf("base version %d is not finalized", idx)
+	}
+	r.hashSources = map[int]bool{idx: true, partial: true}
+	return idx, nil
+}
+
+// isHashSource returns true if the hashes of the version at the given index
+// must be loaded for the deduplication.
+func (r *Repo) isHashSource(i int) bool {
+	return r.hashSources == nil || r.hashSources[i]
+}
+
+// storeParent records the base of the given version in its directory.
+func (r *Repo) storeParent(version int, parent int) error {
+	path := filepath.Join(r.versionDir(version), parentName)
+	return os.WriteFile(path, []byte(fmt.Sprintf(versionFmt+"\n", parent)), r.metaFileMode())
+}
+
+// readParent returns the base recorded for the given version directory, if any.
+func readParent(version string) (parent int, ok bool, err error) {
+	raw, err := os.ReadFile(filepath.Join(version, parentName))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	parent, err = strconv.Atoi(strings.TrimSpace(string(raw)))
+	return parent, err == nil, err
+}
@@ -0,0 +1,92 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import "io"
+
+// SetFileBoundaries makes the commits restart the chunking at the start of each
+// file, so that no chunk holds the content of two files. An inserted file then
+// does not shift the chunks of the next ones and each file only needs its own
+// chunks to be restored, at the cost of a partial chunk at the end of each file.
+func (r *Repo) SetFileBoundaries(enabled bool) {
+	r.fileBoundaries = enabled
+}
+
+// fileEnder is implemented by the streams that need to know where each file of
+// the concatenation ends.
+type fileEnder interface {
+	EndFile()
+}
+
+// endFile tells stream that the current file has been entirely written, if it
+// needs to know it.
+func endFile(stream io.Writer) {
+	if e, ok := stream.(fileEnder); ok {
+		e.EndFile()
+	}
+}
+
+// fileStream is a stream that sends the content of each file written into it
+// as a separate reader.
+type fileStream struct {
+	files   chan *io.PipeReader
+	current *io.PipeWriter
+}
+
+func newFileStream() *fileStream {
+	return &fileStream{files: make(chan *io.PipeReader)}
+}
+
+func (s *fileStream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if s.current == nil {
+		reader, writer := io.Pipe()
+		s.files <- reader
+		s.current = writer
+	}
+	return s.current.Write(p)
+}
+
+func (s *fileStream) EndFile() {
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+}
+
+func (s *fileStream) Close() error {
+	s.EndFile()
+	close(s.files)
+	return nil
+}
+
+// CloseWithError closes the stream, making the reader of the current file, or
+// of a new one if there is none, fail with err.
+func (s *fileStream) CloseWithError(err error) error {
+	if s.current == nil {
+		reader, writer := io.Pipe()
+		s.files <- reader
+		s.current = writer
+	}
+	s.current.CloseWithError(err)
+	s.current = nil
+	close(s.files)
+	return nil
+}
@@ -20,13 +20,24 @@ package repo
 import (
 	"bytes"
 	"fmt"
+	"hash"
 	"io"
 	"path/filepath"
+
+	"github.com/n-peugnet/dna-backup/logger"
 )
 
+// Chunk is a part of the content of a version.
+//
+// Reader can be called any number of times and returns each time a new reader
+// positioned at the beginning of the content, independent from the previously
+// returned ones. It returns an error if the content cannot be loaded, which
+// wraps the ChunkError of the stored chunk at fault. The chunks that are a
+// RepoChunk must have their repo set before their content is read.
 type Chunk interface {
-	Reader() io.ReadSeeker
+	Reader() (io.ReadSeeker, error)
 	Len() int
+	Checksum(newHash func() hash.Hash) []byte
 }
 
 type IdentifiedChunk interface {
@@ -70,15 +81,22 @@ func (c *StoredChunk) SetRepo(r *Repo) {
 	c.repo = r
 }
 
-func (c *StoredChunk) Reader() io.ReadSeeker {
-	// log.Printf("Chunk %d: Reading from file\n", c.id)
-	return c.repo.LoadChunkContent(c.Id)
+func (c *StoredChunk) Reader() (io.ReadSeeker, error) {
+	content, err := c.repo.LoadChunkContent(c.Id)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
 }
 
 func (c *StoredChunk) Len() int {
 	return c.repo.chunkSize
 }
 
+func (c *StoredChunk) Checksum(newHash func() hash.Hash) []byte {
+	return checksum(c, newHash)
+}
+
 func NewTempChunk(value []byte) *TempChunk {
 	return &TempChunk{Value: value}
 }
@@ -87,8 +105,8 @@ type TempChunk struct {
 	Value []byte
 }
 
-func (c *TempChunk) Reader() io.ReadSeeker {
-	return bytes.NewReader(c.Value)
+func (c *TempChunk) Reader() (io.ReadSeeker, error) {
+	return bytes.NewReader(c.Value), nil
 }
 
 func (c *TempChunk) Len() int {
@@ -99,6 +117,10 @@ func (c *TempChunk) Bytes() []byte {
 	return c.Value
 }
 
+func (c *TempChunk) Checksum(newHash func() hash.Hash) []byte {
+	return checksum(c, newHash)
+}
+
 func (c *TempChunk) AppendFrom(r io.Reader) {
 	buff, err := io.ReadAll(r)
 	if err != nil {
@@ -118,13 +140,45 @@ func (c *DeltaChunk) SetRepo(r *Repo) {
 	c.repo = r
 }
 
-func (c *DeltaChunk) Reader() io.ReadSeeker {
+// Reader applies the patch against the content of the source, loaded from the
+// current repo of the chunk at each call. Nothing is kept in the chunk, so that
+// it returns the content of the source of the repo it is restored from. If the
+// patch cannot be applied, or does not give the size of the chunk, the source is
+// reported as corrupt.
+func (c *DeltaChunk) Reader() (io.ReadSeeker, error) {
+	source, err := c.repo.LoadChunkContent(c.Source)
+	if err != nil {
+		return nil, err
+	}
 	var buff bytes.Buffer
-	c.repo.Patcher().Patch(c.repo.LoadChunkContent(c.Source), &buff, bytes.NewReader(c.Patch))
-	return bytes.NewReader(buff.Bytes())
+	if err := c.repo.Patcher().Patch(source, &buff, bytes.NewReader(c.Patch)); err != nil {
+		return nil, &ChunkError{c.Source, &corruptError{fmt.Errorf("delta patch: %w", err)}}
+	}
+	if buff.Len() != c.Size {
+		return nil, &ChunkError{c.Source, &corruptError{fmt.Errorf("delta patch gave %d bytes instead of %d", buff.Len(), c.Size)}}
+	}
+	return bytes.NewReader(buff.Bytes()), nil
 }
 
 // TODO: Maybe return the size of the patch instead ?
 func (c *DeltaChunk) Len() int {
 	return c.Size
 }
+
+func (c *DeltaChunk) Checksum(newHash func() hash.Hash) []byte {
+	return checksum(c, newHash)
+}
+
+// checksum materializes the content of the given chunk and returns its
+// integrity checksum computed by newHash, whatever its kind.
+func checksum(c Chunk, newHash func() hash.Hash) []byte {
+	hasher := newHash()
+	reader, err := c.Reader()
+	if err == nil {
+		_, err = io.Copy(hasher, reader)
+	}
+	if err != nil {
+		logger.Error("chunk checksum ", err)
+	}
+	return hasher.Sum(nil)
+}
@@ -0,0 +1,82 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// caseChecks are the possible behaviours of a commit or a restore when paths
+// that only differ by their case are found: they are either ignored (the
+// default), reported as warnings or make the operation fail.
+var caseChecks = map[string]bool{
+	"ignore": true,
+	"warn":   true,
+	"error":  true,
+}
+
+// SetCaseCheck sets what to do when files whose paths collide once case-folded
+// are committed or restored, as only one of them would survive a restore on a
+// case-insensitive filesystem. It must be one of ignore, warn or error.
+func (r *Repo) SetCaseCheck(check string) error {
+	if !caseChecks[check] {
+		return fmt.Errorf("unknown case check: %s", check)
+	}
+	r.caseCheck = check
+	return nil
+}
+
+// caseCollisions returns the groups of paths of files that are equal once
+// case-folded, sorted by their first path.
+func caseCollisions(files []File) (collisions [][]string) {
+	folded := make(map[string][]string)
+	for _, f := range files {
+		key := strings.ToLower(f.Path)
+		folded[key] = append(folded[key], f.Path)
+	}
+	for _, paths := range folded {
+		if len(paths) > 1 {
+			collisions = append(collisions, paths)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i][0] < collisions[j][0]
+	})
+	return
+}
+
+// checkCaseCollisions reports the case collisions of the given files according
+// to the case check of the repo.
+func (r *Repo) checkCaseCollisions(files []File) error {
+	if r.caseCheck == "ignore" {
+		return nil
+	}
+	collisions := caseCollisions(files)
+	if len(collisions) == 0 {
+		return nil
+	}
+	if r.caseCheck == "error" {
+		return fmt.Errorf("%w: %s", ErrCaseCollision, strings.Join(collisions[0], ", "))
+	}
+	for _, paths := range collisions {
+		r.warn("case collision: ", strings.Join(paths, ", "))
+	}
+	return nil
+}
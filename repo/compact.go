@@ -0,0 +1,198 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// CompactStats summarizes the composition of a recipe and the size of the
+// repo that stores it.
+type CompactStats struct {
+	Chunks     int
+	Deltas     int
+	PatchBytes int
+	MaxDepth   int
+	RepoBytes  int64
+}
+
+func (s CompactStats) String() string {
+	return fmt.Sprintf("%d chunks, %d deltas, %d patch bytes, max chain depth %d, %d bytes on disk",
+		s.Chunks, s.Deltas, s.PatchBytes, s.MaxDepth, s.RepoBytes)
+}
+
+// compactStats returns the stats of the given recipe of the last of versions.
+func (r *Repo) compactStats(recipe []Chunk, versions []string) (s CompactStats, err error) {
+	s.Chunks = len(recipe)
+	for _, c := range recipe {
+		if d, isDelta := c.(*DeltaChunk); isDelta {
+			s.Deltas++
+			s.PatchBytes += len(d.Patch)
+		}
+		if depth := chainDepth(c, versions); depth > s.MaxDepth {
+			s.MaxDepth = depth
+		}
+	}
+	s.RepoBytes, err = dirSize(r.path)
+	return
+}
+
+// chainDepth returns the number of versions, among the given ones and up to
+// the last of them, over which the content of c has been carried as a patch of
+// the same source chunk, counting the version that stores this source. It is 0
+// for the other chunks.
+func chainDepth(c Chunk, versions []string) int {
+	d, isDelta := c.(*DeltaChunk)
+	if !isDelta {
+		return 0
+	}
+	depth := 1
+	for _, v := range versions {
+		if versionNumber(v) > d.Source.Ver {
+			depth++
+		}
+	}
+	return depth
+}
+
+// dirSize returns the total size of the regular files under path.
+func dirSize(path string) (size int64, err error) {
+	err = filepath.Walk(path, func(p string, i fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if i.Mode().IsRegular() {
+			size += i.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// Compact creates a new version with the same content as the latest one, in
+// which the delta chunks that are not worth it anymore are re-materialized.
+// A delta chunk is re-materialized if its patch is at least maxPatchRatio times
+// as large as its content, or if its chain depth is greater than maxDepth.
+// Full-sized contents are stored as new chunks, smaller ones are kept inline.
+//
+// It returns the stats of the latest recipe and of the repo before and after
+// the compaction. If no delta chunk needs to be re-materialized, no version is
+// created.
+func (r *Repo) Compact(maxPatchRatio float64, maxDepth int) (before CompactStats, after CompactStats, err error) {
+	unlock, err := r.lock()
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if err = r.Init(); err != nil {
+		return
+	}
+	if len(r.versions) == 0 {
+		return before, after, fmt.Errorf("repo is empty")
+	}
+	if err = r.checkContent(len(r.versions) - 1); err != nil {
+		return
+	}
+	if r.partialVersion() < len(r.versions) {
+		return before, after, fmt.Errorf("latest version is not finalized")
+	}
+	if before, err = r.compactStats(r.recipe, r.versions); err != nil {
+		return
+	}
+	mustCompact := func(c Chunk) bool {
+		d, isDelta := c.(*DeltaChunk)
+		return isDelta && (float64(len(d.Patch)) >= maxPatchRatio*float64(d.Size) || chainDepth(d, r.versions) > maxDepth)
+	}
+	var count int
+	for _, c := range r.recipe {
+		if mustCompact(c) {
+			count++
+		}
+	}
+	if count == 0 {
+		logger.Info("nothing to compact")
+		return before, before, nil
+	}
+	newVersion := r.versionNumberAt(len(r.versions))
+	logger.Infof("compact %d delta chunks into version %d", count, newVersion)
+	r.createVersionDir(newVersion)
+	r.setRawLoaded(newVersion)
+	storeQueue := make(chan chunkData, r.storeQueueDepth())
+	storeEnd := make(chan bool)
+	go r.storageWorker(newVersion, storeQueue, storeEnd)
+	var last uint64
+	var readErr error
+	recipe := make([]Chunk, 0, len(r.recipe))
+	for _, c := range r.recipe {
+		if !mustCompact(c) {
+			recipe = append(recipe, c)
+			continue
+		}
+		var reader io.Reader
+		if reader, readErr = c.Reader(); readErr != nil {
+			break
+		}
+		content, _ := io.ReadAll(reader)
+		temp := NewTempChunk(content)
+		if temp.Len() != r.chunkSize {
+			recipe = append(recipe, temp)
+			continue
+		}
+		recipe = append(recipe, r.storeNewChunk(temp, r.sketchChunk(temp), newVersion, &last, storeQueue))
+	}
+	close(storeQueue)
+	<-storeEnd
+	if readErr != nil {
+		os.RemoveAll(r.versionDir(newVersion))
+		return before, after, readErr
+	}
+	if err = r.writeError(); err != nil {
+		os.RemoveAll(r.versionDir(newVersion))
+		return
+	}
+	r.storeFileList(newVersion, r.files)
+	r.storeRecipe(newVersion, recipe)
+	if err := r.storeDigest(newVersion, r.files); err != nil {
+		logger.Warning("digest ", err)
+	}
+	if err = r.storeNote(newVersion); err != nil {
+		return
+	}
+	if err := r.storeVersionEntry(newVersion, r.files, time.Now()); err != nil {
+		logger.Warning("versions index ", err)
+	}
+	if r.fileMap {
+		r.storeFileMap(newVersion, fileLocations(r.files, recipe))
+	}
+	versions := append(r.versions[:len(r.versions):len(r.versions)], r.versionDir(newVersion))
+	if err := r.storeHashIndex(versions); err != nil {
+		logger.Warning("hash index ", err)
+	}
+	if err = r.syncVersion(newVersion); err != nil {
+		return
+	}
+	after, err = r.compactStats(recipe, versions)
+	return
+}
@@ -0,0 +1,192 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// FileRange is a byte range of a file, along with the recipe chunks that hold
+// it.
+type FileRange struct {
+	Start  int64
+	End    int64
+	Chunks []Chunk
+}
+
+// fileSegment is the part of a file held by a single chunk.
+type fileSegment struct {
+	start  int64 // offset in the file
+	end    int64
+	chunk  Chunk
+	offset int64 // offset of start in the chunk
+}
+
+// CompareVersions returns the byte ranges of the file at path that differ
+// between the versions from and to, along with the chunks of version to that
+// hold them. Ranges beyond the end of the file in version to have no chunks.
+// Negative versions count from the latest one.
+func (r *Repo) CompareVersions(path string, from int, to int) ([]FileRange, error) {
+	r.loadVersions()
+	path = filepath.Join(string(filepath.Separator), path)
+	var segments [2][]fileSegment
+	var found bool
+	for i, version := range []int{from, to} {
+		idx, err := r.versionIndex(version)
+		if err != nil {
+			return nil, err
+		}
+		var files []File
+		var recipe []Chunk
+		if _, err := loadDeltas(&files, r.versions[:idx+1], r.meta(), r.patcher, r.chunkReadWrapper, filesName); err != nil {
+			return nil, err
+		}
+		if _, err := loadDeltas(&recipe, r.versions[:idx+1], r.meta(), r.patcher, r.chunkReadWrapper, recipeName); err != nil {
+			return nil, err
+		}
+		r.setRecipeRepo(recipe)
+		var offset int64
+		for _, f := range files {
+			if !f.isRegular() {
+				continue
+			}
+			if f.Path == path {
+				segments[i] = fileSegments(recipe, offset, offset+f.Size)
+				found = true
+				break
+			}
+			offset += f.Size
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("file %s not found in versions %d and %d", path, from, to)
+	}
+	return compareSegments(segments[0], segments[1]), nil
+}
+
+// fileSegments splits the range [start, end) of the stream of the recipe
+// between the chunks that hold it.
+func fileSegments(recipe []Chunk, start int64, end int64) (segments []fileSegment) {
+	var pos int64
+	for _, c := range recipe {
+		if pos >= end {
+			break
+		}
+		cEnd := pos + int64(c.Len())
+		if cEnd > start {
+			s, e := pos, cEnd
+			if s < start {
+				s = start
+			}
+			if e > end {
+				e = end
+			}
+			segments = append(segments, fileSegment{s - start, e - start, c, s - pos})
+		}
+		pos = cEnd
+	}
+	return
+}
+
+// compareSegments returns the ranges where the content of the segments of b
+// differs from the ones of a.
+func compareSegments(a []fileSegment, b []fileSegment) (ranges []FileRange) {
+	changed := func(start, end int64, c Chunk) {
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].End == start {
+			ranges[last].End = end
+		} else {
+			ranges = append(ranges, FileRange{Start: start, End: end})
+			last++
+		}
+		chunks := ranges[last].Chunks
+		if c != nil && (len(chunks) == 0 || chunks[len(chunks)-1] != c) {
+			ranges[last].Chunks = append(chunks, c)
+		}
+	}
+	var i, j int
+	for i < len(a) && j < len(b) {
+		lo, hi := a[i].start, a[i].end
+		if b[j].start > lo {
+			lo = b[j].start
+		}
+		if b[j].end < hi {
+			hi = b[j].end
+		}
+		if !sameContent(a[i], b[j], lo, hi) {
+			changed(lo, hi, b[j].chunk)
+		}
+		if a[i].end == hi {
+			i++
+		}
+		if b[j].end == hi {
+			j++
+		}
+	}
+	for ; j < len(b); j++ {
+		changed(b[j].start, b[j].end, b[j].chunk)
+	}
+	for ; i < len(a); i++ {
+		changed(a[i].start, a[i].end, nil)
+	}
+	return
+}
+
+// sameContent tells if segments a and b hold the same content in the range
+// [lo, hi) of the file. It only reads the chunks if they are not the same
+// stored chunk at the same offsets.
+func sameContent(a fileSegment, b fileSegment, lo int64, hi int64) bool {
+	aOffset := a.offset + lo - a.start
+	bOffset := b.offset + lo - b.start
+	sa, aStored := a.chunk.(*StoredChunk)
+	sb, bStored := b.chunk.(*StoredChunk)
+	if aStored && bStored && *sa.Id == *sb.Id && aOffset == bOffset {
+		return true
+	}
+	aContent, aErr := readSegment(a.chunk, aOffset, hi-lo)
+	bContent, bErr := readSegment(b.chunk, bOffset, hi-lo)
+	return aErr == nil && bErr == nil && bytes.Equal(aContent, bContent)
+}
+
+func readSegment(c Chunk, offset int64, size int64) ([]byte, error) {
+	reader, err := c.Reader()
+	if err != nil {
+		return nil, err
+	}
+	buff := make([]byte, size)
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(reader, buff)
+	return buff, err
+}
+
+// DescribeChunk returns a short human readable description of a chunk.
+func DescribeChunk(c Chunk) string {
+	switch c := c.(type) {
+	case *StoredChunk:
+		return fmt.Sprintf(versionFmt+"/"+chunkIdFmt, c.Id.Ver, c.Id.Idx)
+	case *DeltaChunk:
+		return fmt.Sprintf("delta of "+versionFmt+"/"+chunkIdFmt, c.Source.Ver, c.Source.Idx)
+	default:
+		return fmt.Sprintf("inline (%d bytes)", c.Len())
+	}
+}
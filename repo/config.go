@@ -0,0 +1,343 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/chmduquesne/rollinghash/rabinkarp64"
+	"github.com/n-peugnet/dna-backup/delta"
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/sketch"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+// Config holds the parameters that must stay the same across all the versions
+// of a repo. It is stored at the root of the repo when its first version is
+// created.
+type Config struct {
+	ChunkSize     int    `json:"chunkSize"`
+	SketchWSize   int    `json:"sketchWindowSize"`
+	SketchFSize   int    `json:"sketchFeatureSize"`
+	SketchSfCount int    `json:"sketchSuperFeatures"`
+	SketchFCount  int    `json:"sketchFeatures"`
+	Seed          int64  `json:"seed"`
+	Delta         string `json:"delta"`
+	Compression   string `json:"compression"`
+	Checksum      string `json:"checksum"`
+	Hashes        string `json:"hashes"`
+	Sketches      bool   `json:"sketches"`
+	HashesCodec   string `json:"hashesCompression"`
+	Dictionary    string `json:"dictionary"` // sha256 of the compression dictionary
+}
+
+// ConfigParam is a parameter of the config of a repo, along with whether it
+// has been read from its config file or left to its default.
+type ConfigParam struct {
+	Name       string
+	Value      string
+	FromConfig bool
+}
+
+type deltaCodec struct {
+	differ  delta.Differ
+	patcher delta.Patcher
+}
+
+type compressionCodec struct {
+	reader utils.ReadWrapper
+	writer utils.WriteWrapper
+}
+
+var deltaCodecs = map[string]deltaCodec{
+	"fdelta": {delta.Fdelta{}, delta.Fdelta{}},
+	"bsdiff": {delta.Bsdiff{}, delta.Bsdiff{}},
+}
+
+var compressionCodecs = map[string]compressionCodec{
+	"zlib": {utils.ZlibReader, utils.ZlibWriter},
+	"none": {utils.NopReadWrapper, utils.NopWriteWrapper},
+}
+
+var checksumAlgos = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"crc64":  func() hash.Hash { return crc64.New(crc64.MakeTable(crc64.ECMA)) },
+}
+
+// defaultChecksumAlgo is the algorithm used by the repos created before it
+// became configurable.
+const defaultChecksumAlgo = "sha256"
+
+// SetChecksumAlgo sets the algorithm used to compute the integrity checksums
+// of chunks and files. It must be one of sha256 (the default), sha512 or crc64.
+// It cannot change once the first version of the repo has been committed.
+func (r *Repo) SetChecksumAlgo(name string) error {
+	if _, ok := checksumAlgos[name]; !ok {
+		return fmt.Errorf("unknown checksum algorithm: %s", name)
+	}
+	r.checksumAlgo = name
+	return nil
+}
+
+// newChecksum returns a new hash.Hash computing the integrity checksum used for
+// both chunks and files.
+func (r *Repo) newChecksum() hash.Hash {
+	return checksumAlgos[r.checksumAlgo]()
+}
+
+// checkChecksumAlgo returns an error if the checksum algorithm of the repo is
+// not the one its existing versions have been committed with.
+func (r *Repo) checkChecksumAlgo() error {
+	if len(r.versions) == 0 {
+		return nil
+	}
+	c, found, err := r.readConfig()
+	if err != nil {
+		return err
+	}
+	if !found["checksum"] {
+		c.Checksum = defaultChecksumAlgo
+	}
+	if c.Checksum != r.checksumAlgo {
+		return fmt.Errorf("repo uses the %s checksum algorithm, cannot mix it with %s", c.Checksum, r.checksumAlgo)
+	}
+	return nil
+}
+
+// config returns the current parameters of the repo.
+func (r *Repo) config() Config {
+	c := Config{
+		ChunkSize:     r.chunkSize,
+		SketchWSize:   r.sketchWSize,
+		SketchFSize:   r.featureSize(),
+		SketchSfCount: r.sketchSfCount,
+		SketchFCount:  r.sketchFCount,
+		Seed:          r.seed,
+		Delta:         fmt.Sprintf("%T", r.differ),
+		Compression:   "custom",
+		Checksum:      r.checksumAlgo,
+		Hashes:        r.hashesFormat,
+		Sketches:      !r.noSketch,
+		HashesCodec:   r.hashesCompression,
+	}
+	for name, codec := range deltaCodecs {
+		if codec.differ == r.differ {
+			c.Delta = name
+		}
+	}
+	writer := reflect.ValueOf(r.chunkWriteWrapper).Pointer()
+	for name, codec := range compressionCodecs {
+		if reflect.ValueOf(codec.writer).Pointer() == writer {
+			c.Compression = name
+		}
+	}
+	if r.dictionary != nil {
+		c.Compression = "zlib"
+		c.Dictionary = r.dictionaryDigest()
+	}
+	return c
+}
+
+// applyConfig sets the parameters of the repo from the given config. The codecs
+// that have no registered name are kept if the repo currently has the same
+// ones, as they can only have been given as options.
+func (r *Repo) applyConfig(c Config) error {
+	current := r.config()
+	d, ok := deltaCodecs[c.Delta]
+	if !ok && c.Delta == current.Delta {
+		d, ok = deltaCodec{r.differ, r.patcher}, true
+	}
+	if !ok {
+		return fmt.Errorf("unknown delta algorithm: %s", c.Delta)
+	}
+	w, ok := compressionCodecs[c.Compression]
+	if !ok && c.Compression == current.Compression {
+		w, ok = compressionCodec{r.chunkReadWrapper, r.chunkWriteWrapper}, true
+	}
+	if !ok {
+		return fmt.Errorf("unknown compression: %s", c.Compression)
+	}
+	if _, ok := checksumAlgos[c.Checksum]; !ok {
+		return fmt.Errorf("unknown checksum algorithm: %s", c.Checksum)
+	}
+	if _, ok := hashesFormats[c.Hashes]; !ok {
+		return fmt.Errorf("unknown hashes format: %s", c.Hashes)
+	}
+	if _, ok := hashesCompressionMagics[c.HashesCodec]; !ok && c.HashesCodec != "none" {
+		return fmt.Errorf("unknown hashes compression: %s", c.HashesCodec)
+	}
+	if c.SketchFSize != sketch.FeatureSize(c.ChunkSize, c.SketchSfCount, c.SketchFCount) {
+		if err := checkFeatureSize(c.SketchFSize, c.SketchWSize, c.SketchFCount, c.ChunkSize); err != nil {
+			return err
+		}
+	}
+	pol, err := rabinkarp64.RandomPolynomial(c.Seed)
+	if err != nil {
+		return fmt.Errorf("polynomial of seed %d: %w", c.Seed, err)
+	}
+	r.chunkSize = c.ChunkSize
+	r.sketchWSize = c.SketchWSize
+	r.sketchFSize = c.SketchFSize
+	r.sketchSfCount = c.SketchSfCount
+	r.sketchFCount = c.SketchFCount
+	r.seed = c.Seed
+	r.pol = pol
+	r.differ, r.patcher = d.differ, d.patcher
+	r.chunkReadWrapper, r.chunkWriteWrapper = w.reader, w.writer
+	r.dictionary = nil
+	if c.Dictionary != "" {
+		if c.Compression != "zlib" {
+			return fmt.Errorf("compression dictionaries are only supported with zlib, not %s", c.Compression)
+		}
+		if err := r.loadDictionary(c.Dictionary); err != nil {
+			return err
+		}
+	}
+	r.checksumAlgo = c.Checksum
+	r.hashesFormat = c.Hashes
+	r.noSketch = !c.Sketches
+	r.hashesCompression = c.HashesCodec
+	return nil
+}
+
+// readConfig reads the config file of the repo. The parameters missing from it
+// keep the current values of the repo. It also returns the set of parameters
+// that were found in the file, which is empty if the file does not exist.
+func (r *Repo) readConfig() (c Config, found map[string]bool, err error) {
+	c = r.config()
+	found = make(map[string]bool)
+	data, err := os.ReadFile(filepath.Join(r.path, configName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, found, nil
+	}
+	if err != nil {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return c, found, fmt.Errorf("config: %w", err)
+	}
+	for name := range fields {
+		found[name] = true
+	}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return c, found, fmt.Errorf("config: %w", err)
+	}
+	return
+}
+
+// loadConfig applies the config file of the repo if it exists.
+func (r *Repo) loadConfig() error {
+	chunkSize, fSize := r.chunkSize, r.sketchFSize
+	c, found, err := r.readConfig()
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return r.checkChunkSize()
+	}
+	if err := r.applyConfig(c); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if chunkSize != r.chunkSize {
+		logger.Warningf("using chunk size %d of the repo config instead of %d", r.chunkSize, chunkSize)
+	}
+	if fSize != 0 && fSize != r.featureSize() {
+		logger.Warningf("using sketch feature size %d of the repo config instead of %d", r.featureSize(), fSize)
+	}
+	return nil
+}
+
+// checkChunkSize makes sure that the first chunk of a repo that has no config,
+// if any, has the chunk size of the repo, as it cannot be read otherwise.
+func (r *Repo) checkChunkSize() error {
+	id := &ChunkId{Ver: 0, Idx: 0}
+	if _, err := os.Stat(id.Path(r.path)); err != nil {
+		return nil
+	}
+	content, err := r.readChunkContent(id)
+	if err != nil {
+		logger.Warning("chunk size check ", err)
+		return nil
+	}
+	if len(content) != r.chunkSize {
+		return fmt.Errorf("%w: stored %d, given %d", ErrIncompatibleChunkSize, len(content), r.chunkSize)
+	}
+	return nil
+}
+
+// storeConfig writes the current parameters of the repo in its config file,
+// if it does not exist yet.
+func (r *Repo) storeConfig() {
+	path := filepath.Join(r.path, configName)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	if err := r.writeConfig(); err != nil {
+		logger.Panic(err)
+	}
+}
+
+// writeConfig writes the current parameters of the repo in its config file,
+// replacing it if it exists.
+func (r *Repo) writeConfig() error {
+	data, err := json.MarshalIndent(r.config(), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := r.storeDictionary(); err != nil {
+		return err
+	}
+	path := filepath.Join(r.path, configName)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), r.metaFileMode()); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ConfigParams returns all the parameters of the config of the repo, in a
+// stable order, telling for each if it was read from the config file.
+func (r *Repo) ConfigParams() ([]ConfigParam, error) {
+	c, found, err := r.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(c)
+	t := v.Type()
+	params := make([]ConfigParam, t.NumField())
+	for i := range params {
+		name := t.Field(i).Tag.Get("json")
+		params[i] = ConfigParam{
+			Name:       name,
+			Value:      fmt.Sprint(v.Field(i).Interface()),
+			FromConfig: found[name],
+		}
+	}
+	return params, nil
+}
@@ -1,10 +1,25 @@
 package repo
 
 const (
-	chunksName = "chunks"
-	chunkIdFmt = "%015d"
-	versionFmt = "%05d"
-	filesName  = "files"
-	hashesName = "hashes"
-	recipeName = "recipe"
+	chunksName    = "chunks"
+	chunkIdFmt    = "%015d"
+	versionFmt    = "%05d"
+	filesName     = "files"
+	filesDirName  = "files.d"
+	hashesName    = "hashes"
+	recipeName    = "recipe"
+	partialName   = "partial"
+	configName    = "config"
+	indexName     = "index"
+	lockName      = "lock"
+	fileMapName   = "filemap"
+	parentName    = "parent"
+	digestName    = "digest"
+	indexOnlyName = "index-only"
+	prunedName    = "pruned"
+	versionsName  = "versions"
+	stagingName   = "staging"
+	dictName      = "dictionary"
+	labelName     = "label"
+	messageName   = "message"
 )
@@ -0,0 +1,42 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"context"
+	"fmt"
+)
+
+// SetContext sets the context whose cancellation, or deadline, stops the next
+// commits and restores. A commit stopped this way does not create its version
+// and a restore leaves the files restored so far. Both return an error wrapping
+// the error of the context.
+func (r *Repo) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// canceled returns the error of the context of the repo, if it is done.
+func (r *Repo) canceled() error {
+	if r.ctx == nil {
+		return nil
+	}
+	if err := r.ctx.Err(); err != nil {
+		return fmt.Errorf("canceled: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+// maxDictSize is the size of the window of deflate, beyond which the start of a
+// preset dictionary cannot be referenced.
+const maxDictSize = 32 << 10
+
+// dictSamples is the maximum number of files sampled to build a dictionary.
+const dictSamples = 32
+
+// SetCompressionDictionary makes the first commit of the repo build a preset
+// dictionary from a sample of its files and compress all the chunks and lists
+// with it, which captures the redundancy between many small similar chunks.
+// The dictionary is stored in the repo and recorded in its config. It only
+// applies to the zlib compression and has no effect once the repo has a
+// version.
+func (r *Repo) SetCompressionDictionary(enabled bool) {
+	r.trainDict = enabled
+}
+
+// trainDictionary builds a dictionary from the start of files evenly spread
+// over the given list, each contributing the same share, and starts using it.
+func (r *Repo) trainDictionary(files []File) {
+	if r.config().Compression != "zlib" {
+		logger.Warning("compression dictionaries are only supported with zlib")
+		return
+	}
+	var regular []File
+	for _, f := range files {
+		if f.isRegular() && f.Size > 0 {
+			regular = append(regular, f)
+		}
+	}
+	if len(regular) == 0 {
+		return
+	}
+	samples := dictSamples
+	if samples > len(regular) {
+		samples = len(regular)
+	}
+	share := maxDictSize / samples
+	var dict []byte
+	for i := 0; i < samples; i++ {
+		f := regular[i*len(regular)/samples]
+		file, err := os.Open(f.Path)
+		if err != nil {
+			logger.Warning("dictionary ", err)
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(file, int64(share)))
+		file.Close()
+		if err != nil {
+			logger.Warning("dictionary ", err)
+			continue
+		}
+		dict = append(dict, data...)
+	}
+	if len(dict) == 0 {
+		return
+	}
+	logger.Infof("compress with a dictionary of %d bytes", len(dict))
+	r.useDictionary(dict)
+}
+
+// useDictionary makes the chunks and lists compressed with zlib and the given
+// preset dictionary.
+func (r *Repo) useDictionary(dict []byte) {
+	r.dictionary = dict
+	r.chunkReadWrapper = utils.ZlibDictReader(dict)
+	r.chunkWriteWrapper = utils.ZlibDictWriter(dict)
+}
+
+// dictionaryDigest returns the hex encoded sha256 of the dictionary of the
+// repo, or an empty string if it has none.
+func (r *Repo) dictionaryDigest() string {
+	if r.dictionary == nil {
+		return ""
+	}
+	sum := sha256.Sum256(r.dictionary)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadDictionary reads the dictionary of the repo and checks that it has the
+// given digest before using it.
+func (r *Repo) loadDictionary(digest string) error {
+	dict, err := os.ReadFile(filepath.Join(r.path, dictName))
+	if err != nil {
+		return fmt.Errorf("dictionary: %w", err)
+	}
+	sum := sha256.Sum256(dict)
+	if hex.EncodeToString(sum[:]) != digest {
+		return fmt.Errorf("dictionary does not match the digest of the config: %s", digest)
+	}
+	r.useDictionary(dict)
+	return nil
+}
+
+// storeDictionary writes the dictionary of the repo, if it has one.
+func (r *Repo) storeDictionary() error {
+	if r.dictionary == nil {
+		return nil
+	}
+	return writeFileAtomic(filepath.Join(r.path, dictName), r.dictionary, r.metaFileMode(), r.fsync)
+}
@@ -0,0 +1,80 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// versionDigest computes the digest of a version from its ordered file list.
+// As the checksums of the files cover their content, two versions with the
+// same digest hold the same files, whatever the repos they are stored in and
+// the way they have been chunked, provided they use the same checksum algo.
+func versionDigest(algo string, files []File) []byte {
+	hasher := sha256.New()
+	field := func(b []byte) {
+		var size [binary.MaxVarintLen64]byte
+		hasher.Write(size[:binary.PutUvarint(size[:], uint64(len(b)))])
+		hasher.Write(b)
+	}
+	field([]byte(algo))
+	for _, f := range files {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(f.Size))
+		field([]byte(f.Path))
+		field([]byte(f.Link))
+		field(size[:])
+		field(f.Sum)
+	}
+	return hasher.Sum(nil)
+}
+
+// storeDigest stores the digest of the given file list in the version dir.
+func (r *Repo) storeDigest(version int, files []File) error {
+	path := filepath.Join(r.versionDir(version), digestName)
+	digest := hex.EncodeToString(versionDigest(r.checksumAlgo, files))
+	return os.WriteFile(path, []byte(digest+"\n"), r.metaFileMode())
+}
+
+// VersionDigest returns the digest of the given version, negative versions
+// counting from the latest one. It is computed from the file list of the
+// versions that were committed before digests were stored.
+func (r *Repo) VersionDigest(version int) ([]byte, error) {
+	r.loadVersions()
+	idx, err := r.versionIndex(version)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(filepath.Join(r.versions[idx], digestName))
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(raw)))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	files, err := r.VersionFiles(idx)
+	if err != nil {
+		return nil, err
+	}
+	return versionDigest(r.checksumAlgo, files), nil
+}
@@ -0,0 +1,88 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// RestorePlan describes what restoring the latest version would write.
+type RestorePlan struct {
+	Files     []File
+	Size      int64    // total size of the regular files
+	Conflicts []string // destination paths of the files that already exist
+	Free      int64    // free space of the destination, if FreeKnown
+	FreeKnown bool
+}
+
+// Fits returns false if the free space of the destination is known to be too
+// small for the files of the plan.
+func (p RestorePlan) Fits() bool {
+	return !p.FreeKnown || p.Free >= p.Size
+}
+
+// PlanRestore runs the checks of Restore and reports what it would write into
+// the destination directory, without writing anything. Only the file lists are
+// loaded. With resume enabled, the files already restored are not counted.
+func (r *Repo) PlanRestore(destination string) (plan RestorePlan, err error) {
+	r.loadVersions()
+	idx, err := r.versionIndex(r.selectedVersion())
+	if err != nil {
+		return
+	}
+	if err = r.checkContent(idx); err != nil {
+		return
+	}
+	if err = r.loadFileLists(r.versions[:idx+1]); err != nil {
+		return
+	}
+	if err = r.checkCaseCollisions(r.files); err != nil {
+		return
+	}
+	if err = r.checkDestination(destination, r.files); err != nil {
+		return
+	}
+	for _, file := range r.files {
+		filePath := filepath.Join(destination, file.Path)
+		if file.isRegular() && r.resume && r.alreadyRestored(filePath, file) {
+			continue
+		}
+		plan.Files = append(plan.Files, file)
+		if file.isRegular() {
+			plan.Size += file.Size
+		}
+		if _, err := os.Lstat(filePath); err == nil {
+			plan.Conflicts = append(plan.Conflicts, filePath)
+		}
+	}
+	// the destination may not exist yet
+	dir := destination
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	plan.Free, plan.FreeKnown, err = freeSpace(dir)
+	return
+}
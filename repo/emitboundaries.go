@@ -0,0 +1,85 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+// chunkKind returns the name of the kind of the given chunk of the recipe of
+// version.
+func chunkKind(c Chunk, version int) string {
+	switch c := c.(type) {
+	case *StoredChunk:
+		if c.Id.Ver == version {
+			return "new"
+		}
+		return "stored"
+	case *DeltaChunk:
+		return "delta"
+	default:
+		return "partial"
+	}
+}
+
+// EmitBoundaries chunks source as a commit would, without storing anything,
+// and writes into w a line for each chunk with its offset in the
+// concatenation of the files, its size and its kind: "stored" for a chunk
+// already in the repo, "new" for a new full chunk, "delta" for a chunk encoded
+// against a similar one and "partial" for the others. The new chunks are kept
+// in memory as they may be the source of the next delta chunks, so the repo
+// must not be used to commit afterwards.
+func (r *Repo) EmitBoundaries(source string, w io.Writer) error {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	files, err := r.listSource(source)
+	if err != nil {
+		return err
+	}
+	r.loadVersions()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	r.loadHashes(r.versions, &wg)
+	version := r.versionNumberAt(len(r.versions))
+	// the new chunks are dropped instead of being stored
+	storeQueue := make(chan chunkData, r.storeQueueDepth())
+	go func() {
+		for range storeQueue {
+		}
+	}()
+	recipe := r.matchPasses(version, 0, storeQueue, func(stream io.WriteCloser) {
+		r.concatFiles(&files, stream)
+	})
+	close(storeQueue)
+	if err := r.matchError(); err != nil {
+		return err
+	}
+	var offset int64
+	for _, c := range recipe {
+		if _, err := fmt.Fprintf(w, "%d %d %s\n", offset, c.Len(), chunkKind(c, version)); err != nil {
+			return err
+		}
+		offset += int64(c.Len())
+	}
+	return r.canceled()
+}
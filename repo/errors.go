@@ -0,0 +1,127 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrReadOnly is returned when trying to write into a repo opened read-only.
+var ErrReadOnly = errors.New("repo opened read-only")
+
+// ErrNotRepo is returned when opening a path that does not hold a repo.
+var ErrNotRepo = errors.New("not a repo")
+
+// ErrRepoExists is returned when creating a repo at a path that already holds
+// one.
+var ErrRepoExists = errors.New("repo already exists")
+
+// ErrRepoLocked is returned when trying to write into a repo that is already
+// being written into.
+var ErrRepoLocked = errors.New("repo locked")
+
+// ErrIncompatibleFormat is returned when the repo has been written by a
+// version of dna-backup that stores its lists in an unsupported format.
+var ErrIncompatibleFormat = errors.New("repo written by incompatible version")
+
+// ErrIncompatibleChunkSize is returned when opening a repo that has no config
+// with a chunk size different from the one of its stored chunks.
+var ErrIncompatibleChunkSize = errors.New("repo written with another chunk size")
+
+// ErrCorruptChunk is wrapped by the ChunkError of a chunk whose content cannot
+// be decoded or does not match its recorded hashes.
+var ErrCorruptChunk = errors.New("corrupt content")
+
+// ErrCorruptList is matched by the ListError of a list that cannot be decoded,
+// unless it has been written in an incompatible format.
+var ErrCorruptList = errors.New("corrupt list")
+
+// ErrStrictWarnings is returned by a strict commit when warnings have been
+// reported while reading its source.
+var ErrStrictWarnings = errors.New("warnings during strict commit")
+
+// ErrCaseCollision is returned when files whose paths only differ by their
+// case are found and the case check is set to error.
+var ErrCaseCollision = errors.New("paths collide on case-insensitive filesystems")
+
+// ErrNoSpace is returned when a commit would not leave the minimal free space
+// on the filesystem of the repo.
+var ErrNoSpace = errors.New("not enough free space")
+
+// ErrIndexOnly is returned when trying to read the content of a version that
+// has been committed without it.
+var ErrIndexOnly = errors.New("version committed as index-only has no content")
+
+// ErrIncompleteVersion is returned when the chunks stored in a version do not
+// match its hashes, as left by a commit that crashed.
+var ErrIncompleteVersion = errors.New("incomplete version")
+
+// ChunkError records an error and the chunk that caused it.
+type ChunkError struct {
+	Id  *ChunkId
+	Err error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d: %s", *e.Id, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// corruptError records the error that prevented the content of a chunk from
+// being decoded. It matches both ErrCorruptChunk and this error.
+type corruptError struct {
+	err error
+}
+
+func (e *corruptError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrCorruptChunk, e.err)
+}
+
+func (e *corruptError) Unwrap() error {
+	return e.err
+}
+
+func (e *corruptError) Is(target error) bool {
+	return target == ErrCorruptChunk
+}
+
+// ListError records an error and the list of the version that caused it.
+type ListError struct {
+	Version string
+	List    string
+	Err     error
+}
+
+func (e *ListError) Error() string {
+	if errors.Is(e.Err, ErrIncompatibleFormat) {
+		return fmt.Sprintf("version %s %s: %s", e.Version, e.List, e.Err)
+	}
+	return fmt.Sprintf("version %s %s is corrupt: %s", e.Version, e.List, e.Err)
+}
+
+func (e *ListError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ListError) Is(target error) bool {
+	return target == ErrCorruptList && !errors.Is(e.Err, ErrIncompatibleFormat)
+}
@@ -0,0 +1,195 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chmduquesne/rollinghash/rabinkarp64"
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+// sampleFileLimit is the maximum number of bytes read from a sampled file.
+const sampleFileLimit = 16 << 20
+
+// freeSpaceSample is the number of files sampled to estimate the space
+// required by a commit.
+const freeSpaceSample = 10
+
+// Estimate is a projection of what committing a source would store.
+type Estimate struct {
+	Files            int
+	Size             int64 // total size of the source files
+	SampledFiles     int
+	SampledSize      int64
+	DedupRatio       float64 // part of the sampled content already in the repo
+	CompressionRatio float64 // compressed size of the sampled content over its size
+	NewSize          int64   // projected number of bytes to store
+	Duration         time.Duration
+}
+
+func (e Estimate) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "source:  %d files, %d bytes\n", e.Files, e.Size)
+	fmt.Fprintf(&b, "sampled: %d files, %d bytes\n", e.SampledFiles, e.SampledSize)
+	fmt.Fprintf(&b, "dedup:   %.1f%% already stored\n", e.DedupRatio*100)
+	fmt.Fprintf(&b, "compression ratio: %.2f\n", e.CompressionRatio)
+	fmt.Fprintf(&b, "projected: %d new bytes in about %s\n", e.NewSize, e.Duration.Round(time.Second))
+	return b.String()
+}
+
+// Estimate walks source and reads up to sample of its files, spread over the
+// whole list, to project how much would be stored by committing it and how
+// long it would take. The deduplication is estimated by looking for the
+// fingerprints of the repo in the sampled content. Nothing is written.
+func (r *Repo) Estimate(source string, sample int) (Estimate, error) {
+	files := listFiles(source)
+	r.loadVersions()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	r.loadHashes(r.versions, &wg)
+	return r.estimateFiles(files, sample)
+}
+
+// estimateFiles estimates the commit of the given files against the hashes
+// currently loaded in the repo.
+func (r *Repo) estimateFiles(files []File, sample int) (e Estimate, err error) {
+	for _, f := range files {
+		if f.isRegular() {
+			e.Files++
+			e.Size += f.Size
+		}
+	}
+	if e.Files == 0 {
+		return
+	}
+	step := 1
+	if sample > 0 && e.Files > sample {
+		step = (e.Files + sample - 1) / sample
+	}
+	var matched int64
+	compressed := utils.NewWriteCounter(io.Discard)
+	wrapper := r.chunkWriteWrapper(compressed)
+	start := time.Now()
+	n := 0
+	for _, f := range files {
+		if !f.isRegular() {
+			continue
+		}
+		n++
+		if (n-1)%step != 0 {
+			continue
+		}
+		data, err := readSample(f.Path)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		e.SampledFiles++
+		e.SampledSize += int64(len(data))
+		matched += r.matchedBytes(data)
+		wrapper.Write(data)
+	}
+	if err = wrapper.Close(); err != nil {
+		return
+	}
+	if e.SampledSize == 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	e.DedupRatio = float64(matched) / float64(e.SampledSize)
+	e.CompressionRatio = float64(compressed.Count()) / float64(e.SampledSize)
+	e.NewSize = int64(float64(e.Size) * (1 - e.DedupRatio) * e.CompressionRatio)
+	e.Duration = time.Duration(float64(elapsed) * float64(e.Size) / float64(e.SampledSize))
+	return
+}
+
+func readSample(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, sampleFileLimit))
+}
+
+// matchedBytes returns how many bytes of data are covered by chunks whose
+// fingerprint is already known, looking for them the same way the matcher does.
+func (r *Repo) matchedBytes(data []byte) (matched int64) {
+	size := r.chunkSize
+	if len(data) < size {
+		return
+	}
+	hasher := rabinkarp64.NewFromPol(r.pol)
+	hasher.Write(data[:size])
+	for i := 0; ; {
+		if _, exists := r.fingerprints[hasher.Sum64()]; exists {
+			matched += int64(size)
+			i += size
+			if i+size > len(data) {
+				return
+			}
+			hasher.Reset()
+			hasher.Write(data[i : i+size])
+			continue
+		}
+		if i+size >= len(data) {
+			return
+		}
+		hasher.Roll(data[i+size])
+		i++
+	}
+}
+
+// SetMinFreeSpace makes a commit refuse to start if the free space left on the
+// filesystem of the repo once its estimated content is stored would be below
+// margin bytes. A margin of 0 (the default) disables the check.
+func (r *Repo) SetMinFreeSpace(margin int64) {
+	r.minFreeSpace = margin
+}
+
+// checkFreeSpace returns an error if the minimal free space would not be left
+// after committing the given files. It must be called once the hashes of the
+// repo have been loaded, so that the deduplication can be taken into account.
+func (r *Repo) checkFreeSpace(files []File) error {
+	if r.minFreeSpace <= 0 {
+		return nil
+	}
+	free, known, err := freeSpace(r.path)
+	if err != nil {
+		return err
+	}
+	if !known {
+		logger.Warning("free space check not supported on this platform")
+		return nil
+	}
+	e, err := r.estimateFiles(files, freeSpaceSample)
+	if err != nil {
+		return err
+	}
+	if free-e.NewSize < r.minFreeSpace {
+		return fmt.Errorf("%w: %d bytes free, about %d required, %d of margin", ErrNoSpace, free, e.NewSize, r.minFreeSpace)
+	}
+	return nil
+}
@@ -18,22 +18,34 @@
 package repo
 
 import (
+	"fmt"
 	"io"
+	"os"
+	"time"
 
 	"github.com/n-peugnet/dna-backup/export"
 	"github.com/n-peugnet/dna-backup/logger"
 	"github.com/n-peugnet/dna-backup/utils"
 )
 
-func (r *Repo) Export(exporter export.Exporter) {
-	r.Init()
+// Export writes the chunks and the stored lists of each version of the repo
+// into the given exporter.
+func (r *Repo) Export(exporter export.Exporter) error {
+	if err := r.Init(); err != nil {
+		return err
+	}
 	chunks := r.loadChunks(r.versions)
+	for i := range r.versions {
+		if hasSplitFiles(r.versions[i]) {
+			return fmt.Errorf("version %d has a split file list, which cannot be exported", i)
+		}
+	}
 	for i := range r.versions {
 		var err error
 		end := make(chan bool)
 		input := exporter.ExportVersion(end)
 		go exportChunks(chunks[i], r.chunkWriteWrapper, input.Chunks)
-		readDelta(r.versions[i], recipeName, utils.NopReadWrapper, func(rc io.ReadCloser) {
+		err = readDelta(r.meta(), r.versions[i], recipeName, utils.NopReadWrapper, func(rc io.ReadCloser) {
 			_, err = io.Copy(input.Recipe, rc)
 			if err != nil {
 				logger.Error("load recipe ", err)
@@ -42,7 +54,10 @@ func (r *Repo) Export(exporter export.Exporter) {
 				logger.Error("export recipe ", err)
 			}
 		})
-		readDelta(r.versions[i], filesName, utils.NopReadWrapper, func(rc io.ReadCloser) {
+		if err != nil {
+			return err
+		}
+		err = readDelta(r.meta(), r.versions[i], filesName, utils.NopReadWrapper, func(rc io.ReadCloser) {
 			_, err = io.Copy(input.Files, rc)
 			if err != nil {
 				logger.Error("load files ", err)
@@ -51,15 +66,22 @@ func (r *Repo) Export(exporter export.Exporter) {
 				logger.Error("export files ", err)
 			}
 		})
+		if err != nil {
+			return err
+		}
 		<-end
 	}
+	return nil
 }
 
 func exportChunks(chunks []IdentifiedChunk, wrapper utils.WriteWrapper, input io.WriteCloser) {
 	if len(chunks) > 0 {
 		compressed := wrapper(input)
 		for _, c := range chunks {
-			_, err := io.Copy(compressed, c.Reader())
+			reader, err := c.Reader()
+			if err == nil {
+				_, err = io.Copy(compressed, reader)
+			}
 			if err != nil {
 				logger.Error(err)
 			}
@@ -68,3 +90,105 @@ func exportChunks(chunks []IdentifiedChunk, wrapper utils.WriteWrapper, input io
 	}
 	input.Close()
 }
+
+// ExportRepo exports the given version of the repo as a new standalone repo in
+// the destination directory, which is created if needed and must not contain
+// any version yet.
+//
+// The content of the version is restored and then committed as the first
+// version of the new repo, so that all of its delta chunks are resolved and it
+// does not depend on the rest of the history anymore. The new repo keeps the
+// parameters of this one and can receive its own commits, as a branch of it.
+func (r *Repo) ExportRepo(version int, destination string) error {
+	r.loadVersions()
+	idx, err := r.versionIndex(version)
+	if err != nil {
+		return err
+	}
+	if err := r.checkContent(idx); err != nil {
+		return err
+	}
+	out, err := r.newDerivedRepo(destination)
+	if err != nil {
+		return err
+	}
+	unlock, err := out.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	logger.Infof("export version %d as a standalone repo", idx)
+	return out.importVersion(r, idx, time.Now())
+}
+
+// newDerivedRepo returns a new empty repo in the destination directory, which
+// is created if needed, with the same parameters as this one.
+func (r *Repo) newDerivedRepo(destination string) (*Repo, error) {
+	if err := os.MkdirAll(destination, r.dirMode); err != nil {
+		return nil, err
+	}
+	out, err := newRepo(destination, RepoOptions{ChunkSize: r.chunkSize})
+	if err != nil {
+		return nil, err
+	}
+	out.differ = r.differ
+	out.patcher = r.patcher
+	out.chunkReadWrapper = r.chunkReadWrapper
+	out.chunkWriteWrapper = r.chunkWriteWrapper
+	out.dictionary = r.dictionary
+	out.rawThreshold = r.rawThreshold
+	out.checksumAlgo = r.checksumAlgo
+	// the new repo continues with the same parameters
+	out.seed, out.pol = r.seed, r.pol
+	out.sketchWSize, out.sketchFSize = r.sketchWSize, r.sketchFSize
+	out.sketchSfCount, out.sketchFCount = r.sketchSfCount, r.sketchFCount
+	out.noSketch = r.noSketch
+	out.fsync = r.fsync
+	out.ctx = r.ctx
+	out.hashesFormat, out.hashesCompression = r.hashesFormat, r.hashesCompression
+	if err := out.Init(); err != nil {
+		return nil, err
+	}
+	if len(out.versions) > 0 {
+		return nil, fmt.Errorf("destination repo %s is not empty", destination)
+	}
+	return out, nil
+}
+
+// importVersion restores the version idx of src, which must have its content,
+// and commits it as a new version of this repo, recorded as committed at time
+// t. Its content is deduplicated against the versions already in this repo.
+func (r *Repo) importVersion(src *Repo, idx int, t time.Time) error {
+	// the raw flags of the chunks of src are loaded as they are read
+	if err := src.loadLists(src.versions[:idx+1], false); err != nil {
+		return err
+	}
+	r.loadVersions()
+	if err := r.loadLists(r.versions, true); err != nil {
+		return err
+	}
+	newVersion, recipe := r.commitStream(r.versionNumberAt(len(r.versions)), 0, func(stream io.WriteCloser) {
+		src.restoreStream(stream, collapseRecipeRuns(src.recipe))
+	})
+	err := r.matchError()
+	if err == nil {
+		err = r.writeError()
+	}
+	if err != nil {
+		os.RemoveAll(r.versionDir(newVersion))
+		return err
+	}
+	r.storeFileList(newVersion, src.files)
+	r.storeRecipe(newVersion, recipe)
+	if err := r.storeDigest(newVersion, src.files); err != nil {
+		logger.Warning("digest ", err)
+	}
+	if err := r.storeVersionEntry(newVersion, src.files, t); err != nil {
+		logger.Warning("versions index ", err)
+	}
+	versions := append(r.versions, r.versionDir(newVersion))
+	if err := r.storeHashIndex(versions); err != nil {
+		logger.Warning("hash index ", err)
+	}
+	return r.syncVersion(newVersion)
+}
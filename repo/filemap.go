@@ -0,0 +1,176 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// fileLocation tells which entries of the recipe of a version hold the content
+// of one of its files: the ones from First to Last included, the file starting
+// at Offset in the first one. A file without content has a Last below First.
+type fileLocation struct {
+	Path   string
+	First  int
+	Last   int
+	Offset int64
+}
+
+// SetFileMap enables or disables storing, along with each committed version,
+// the map of the recipe entries that hold each of its files. It allows to
+// restore a single file without going through the whole recipe.
+func (r *Repo) SetFileMap(enabled bool) {
+	r.fileMap = enabled
+}
+
+// fileLocations returns the location of each regular file in the recipe.
+func fileLocations(files []File, recipe []Chunk) (locations []fileLocation) {
+	var offset, pos int64
+	var i int
+	for _, f := range files {
+		if !f.isRegular() {
+			continue
+		}
+		start, end := offset, offset+f.Size
+		offset = end
+		for i < len(recipe) && pos+int64(recipe[i].Len()) <= start {
+			pos += int64(recipe[i].Len())
+			i++
+		}
+		loc := fileLocation{Path: f.Path, First: i, Last: i - 1, Offset: start - pos}
+		for j, p := i, pos; j < len(recipe) && p < end && f.Size > 0; j++ {
+			loc.Last = j
+			p += int64(recipe[j].Len())
+		}
+		locations = append(locations, loc)
+	}
+	return
+}
+
+func (r *Repo) storeFileMap(version int, locations []fileLocation) {
+	logger.Info("store file map")
+	path := filepath.Join(r.versionDir(version), fileMapName)
+	file, err := r.createFile(path)
+	if err != nil {
+		logger.Panic(err)
+	}
+	out := r.chunkWriteWrapper(file)
+	if err = gob.NewEncoder(out).Encode(locations); err != nil {
+		logger.Panic(err)
+	}
+	if err = out.Close(); err != nil {
+		logger.Panic(err)
+	}
+	if err = file.Close(); err != nil {
+		logger.Panic(err)
+	}
+}
+
+func (r *Repo) loadFileMap(version string) (locations []fileLocation, err error) {
+	file, err := os.Open(filepath.Join(version, fileMapName))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	in, err := r.chunkReadWrapper(file)
+	if err != nil {
+		return
+	}
+	err = gob.NewDecoder(in).Decode(&locations)
+	return
+}
+
+// RestoreFile writes the content of the file at path in the latest version of
+// the repo into dest. If the version has a file map, only the chunks of the
+// file are read, else the recipe is scanned to find them.
+func (r *Repo) RestoreFile(path string, dest io.Writer) error {
+	r.loadVersions()
+	if len(r.versions) == 0 {
+		return fmt.Errorf("repo is empty")
+	}
+	latest := r.versions[len(r.versions)-1]
+	if err := r.checkContent(len(r.versions) - 1); err != nil {
+		return err
+	}
+	if err := r.loadRecipes(r.versions); err != nil {
+		return err
+	}
+	path = filepath.Join(string(filepath.Separator), path)
+	locations, err := r.loadFileMap(latest)
+	var files []File
+	if err == nil && hasSplitFiles(latest) {
+		// only the part of the list holding the file is needed
+		files, err = loadFilesPart(r.meta(), latest, topLevelName(path), r.patcher, r.chunkReadWrapper)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("file %s not found", path)
+		} else if err != nil {
+			return corruptListError(latest, filesName, err)
+		}
+	} else {
+		if err != nil {
+			logger.Info("no file map, scanning the recipe: ", err)
+		}
+		if err := r.loadFileLists(r.versions); err != nil {
+			return err
+		}
+		files = r.files
+		if locations == nil {
+			locations = fileLocations(files, r.recipe)
+		}
+	}
+	var size int64 = -1
+	for _, f := range files {
+		if f.Path == path && f.isRegular() {
+			size = f.Size
+		}
+	}
+	if size < 0 {
+		return fmt.Errorf("file %s not found", path)
+	}
+	for _, loc := range locations {
+		if loc.Path != path {
+			continue
+		}
+		if size == 0 {
+			return nil
+		}
+		var readers []io.Reader
+		for i := loc.First; i <= loc.Last; i++ {
+			reader, err := r.recipe[i].Reader()
+			if err != nil {
+				return err
+			}
+			readers = append(readers, reader)
+		}
+		content := io.MultiReader(readers...)
+		if _, err := io.CopyN(io.Discard, content, loc.Offset); err != nil {
+			return err
+		}
+		_, err := io.CopyN(dest, content, size)
+		return err
+	}
+	return fmt.Errorf("file %s not found in the file map", path)
+}
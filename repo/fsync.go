@@ -0,0 +1,99 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// SetFsync makes the operations creating a version flush to the drive each new
+// chunk, the metadata files of the version and the dirs holding them before
+// returning, so that a version reported as stored survives a power loss. It
+// is disabled by default as syncing each chunk makes commits much slower,
+// especially on rotating drives. Without it, a crash of the system can lose
+// the latest versions, but a crash of the process never leaves a partially
+// written chunk.
+func (r *Repo) SetFsync(enabled bool) {
+	r.fsync = enabled
+}
+
+// writeFileAtomic writes data into a temporary file, synced to the drive if
+// sync is set, before renaming it to path, so that a crash cannot leave a
+// partially written file at path.
+func writeFileAtomic(path string, data []byte, mode fs.FileMode, sync bool) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && sync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// syncPath flushes the file or dir at path to the drive.
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncVersion flushes to the drive the files of the given version but its
+// chunks, which are synced as they are stored, its dirs and the root of the
+// repo along with its files, if fsync is enabled.
+func (r *Repo) syncVersion(version int) error {
+	if !r.fsync {
+		return nil
+	}
+	chunks := filepath.Join(r.versionDir(version), chunksName)
+	err := filepath.WalkDir(r.versionDir(version), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && filepath.Dir(path) == chunks {
+			return nil
+		}
+		return syncPath(path)
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{configName, indexName, versionsName} {
+		if err := syncPath(filepath.Join(r.path, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return syncPath(r.path)
+}
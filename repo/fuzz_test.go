@@ -0,0 +1,115 @@
+// +build go1.18
+
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/n-peugnet/dna-backup/cache"
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+// addLogsCorpus adds to the seed corpus of f the files of testdata/logs, along
+// with an empty and a uniform input.
+func addLogsCorpus(f *testing.F) {
+	logs, _ := filepath.Glob(filepath.Join("testdata", "logs", "*", "*"))
+	for _, path := range logs {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add(bytes.Repeat([]byte{'a'}, 5<<10))
+}
+
+// FuzzCommitRestore commits the given data as a single file, then with a byte
+// inserted in its middle so that the second version is built from deltas
+// against the first one, and checks that both versions restore identically.
+func FuzzCommitRestore(f *testing.F) {
+	addLogsCorpus(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		logger.SetLevel(1)
+		defer logger.SetLevel(4)
+		repo := t.TempDir()
+		edited := append(append(append([]byte{}, data[:len(data)/2]...), 'X'), data[len(data)/2:]...)
+		for version, content := range [][]byte{data, edited} {
+			source := t.TempDir()
+			os.WriteFile(filepath.Join(source, "file"), content, 0664)
+			if err := NewRepo(repo, 1<<10).Commit(source); err != nil {
+				t.Fatal(err)
+			}
+			dest := t.TempDir()
+			r := NewReadOnlyRepo(repo, 1<<10)
+			r.SetRestoreVersion(version)
+			if err := r.Restore(dest); err != nil {
+				t.Fatal(err)
+			}
+			restored, err := os.ReadFile(filepath.Join(dest, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, restored) {
+				t.Fatalf("version %d of %d bytes restored as %d different bytes", version, len(content), len(restored))
+			}
+		}
+	})
+}
+
+// FuzzMatchRestore is like FuzzCommitRestore, but only goes through matchStream
+// and restoreStream. The chunks are kept in memory, nothing is stored in the
+// repo, which makes it much faster to run for long.
+func FuzzMatchRestore(f *testing.F) {
+	addLogsCorpus(f)
+	// deriving the polynomial of a repo is too slow to be done for each input
+	repo := NewRepo(f.TempDir(), 1<<10)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		logger.SetLevel(1)
+		defer logger.SetLevel(4)
+		repo.fingerprints = make(FingerprintMap)
+		repo.sketches = make(SketchMap)
+		repo.chunkCache = cache.New(0)
+		repo.pendingChunks.Range(func(id, _ interface{}) bool {
+			repo.pendingChunks.Delete(id)
+			return true
+		})
+		storeQueue := make(chan chunkData, 16)
+		go func() {
+			// the new chunks remain pending, so they are read from memory
+			for range storeQueue {
+			}
+		}()
+		defer close(storeQueue)
+		edited := append(append(append([]byte{}, data[:len(data)/2]...), 'X'), data[len(data)/2:]...)
+		for version, content := range [][]byte{data, edited} {
+			recipe, _ := repo.matchStream(bytes.NewReader(content), storeQueue, version, 0)
+			var restored bytes.Buffer
+			repo.restoreStream(utils.NopCloser(&restored), collapseRecipeRuns(recipe))
+			if !bytes.Equal(content, restored.Bytes()) {
+				t.Fatalf("version %d of %d bytes restored as %d different bytes", version, len(content), restored.Len())
+			}
+		}
+	})
+}
@@ -0,0 +1,179 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+// binaryHashesMagic is the first byte of a hashes file in the binary format.
+// It cannot start a gob stream, as gob never writes an empty message.
+const binaryHashesMagic = 0
+
+// hashesCompressionMagics are the first bytes of the hashes files compressed
+// with each of the supported codecs. They can start neither a gob stream, whose
+// first message is a type definition longer than a byte, nor a binary one.
+var hashesCompressionMagics = map[string]byte{
+	"zlib": 1,
+}
+
+// hashesFormats are the supported encodings of the hashes files, the gob one
+// being the default.
+var hashesFormats = map[string]func(io.Writer) (func(chunkHashes) error, error){
+	"gob":    newGobHashesEncoder,
+	"binary": newBinaryHashesEncoder,
+}
+
+// SetHashesFormat sets the encoding of the hashes files written by the next
+// commits. It must be either gob (the default) or binary, which is smaller and
+// faster to load. Both can be read, whatever the format of the repo is.
+func (r *Repo) SetHashesFormat(name string) error {
+	if _, ok := hashesFormats[name]; !ok {
+		return fmt.Errorf("unknown hashes format: %s", name)
+	}
+	r.hashesFormat = name
+	return nil
+}
+
+// SetHashesCompression sets the compression codec of the hashes files written
+// by the next commits. It must be either none (the default) or zlib. Compressed
+// and uncompressed hashes files can both be read.
+func (r *Repo) SetHashesCompression(name string) error {
+	if _, ok := hashesCompressionMagics[name]; !ok && name != "none" {
+		return fmt.Errorf("unknown hashes compression: %s", name)
+	}
+	r.hashesCompression = name
+	return nil
+}
+
+// hashesWriter returns the writer through which the hashes are written in w,
+// after it has written the magic byte of the hashes compression if any.
+func (r *Repo) hashesWriter(w io.Writer) (io.WriteCloser, error) {
+	magic, ok := hashesCompressionMagics[r.hashesCompression]
+	if !ok {
+		return utils.NopWriteWrapper(w), nil
+	}
+	if _, err := w.Write([]byte{magic}); err != nil {
+		return nil, err
+	}
+	return compressionCodecs[r.hashesCompression].writer(w), nil
+}
+
+func newGobHashesEncoder(w io.Writer) (func(chunkHashes) error, error) {
+	encoder := gob.NewEncoder(w)
+	return func(h chunkHashes) error { return encoder.Encode(h) }, nil
+}
+
+// newBinaryHashesEncoder writes the magic byte and returns an encoder writing
+// each record as the fingerprint, the raw flag, the number of sketch features
+// and the features, followed by the length of the checksum and the checksum.
+func newBinaryHashesEncoder(w io.Writer) (func(chunkHashes) error, error) {
+	if _, err := w.Write([]byte{binaryHashesMagic}); err != nil {
+		return nil, err
+	}
+	return func(h chunkHashes) error {
+		buff := make([]byte, 9+binary.MaxVarintLen64*2+8*len(h.Sk)+len(h.Sum))
+		binary.LittleEndian.PutUint64(buff, h.Fp)
+		if h.Raw {
+			buff[8] = 1
+		}
+		n := 9
+		n += binary.PutUvarint(buff[n:], uint64(len(h.Sk)))
+		for _, f := range h.Sk {
+			binary.LittleEndian.PutUint64(buff[n:], f)
+			n += 8
+		}
+		n += binary.PutUvarint(buff[n:], uint64(len(h.Sum)))
+		n += copy(buff[n:], h.Sum)
+		_, err := w.Write(buff[:n])
+		return err
+	}, nil
+}
+
+// newHashesDecoder returns a decoder of the records of a hashes file, whose
+// compression and format are detected from its first bytes. The decoder returns io.EOF once all
+// the records have been read.
+func newHashesDecoder(r io.Reader) func(*chunkHashes) error {
+	reader := bufio.NewReader(r)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return func(*chunkHashes) error { return err }
+	}
+	for name, magic := range hashesCompressionMagics {
+		if first[0] == magic {
+			reader.ReadByte()
+			in, err := compressionCodecs[name].reader(reader)
+			if err != nil {
+				return func(*chunkHashes) error { return err }
+			}
+			return newHashesDecoder(in)
+		}
+	}
+	if first[0] != binaryHashesMagic {
+		decoder := gob.NewDecoder(reader)
+		return func(h *chunkHashes) error { return decoder.Decode(h) }
+	}
+	reader.ReadByte()
+	return func(h *chunkHashes) error {
+		return decodeBinaryHashes(reader, h)
+	}
+}
+
+func decodeBinaryHashes(reader *bufio.Reader, h *chunkHashes) error {
+	var fixed [9]byte
+	if _, err := io.ReadFull(reader, fixed[:]); err != nil {
+		return err
+	}
+	h.Fp = binary.LittleEndian.Uint64(fixed[:8])
+	h.Raw = fixed[8] != 0
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	features := make([]byte, 8*count)
+	if _, err := io.ReadFull(reader, features); err != nil {
+		return unexpectedEOF(err)
+	}
+	h.Sk = make([]uint64, count)
+	for i := range h.Sk {
+		h.Sk[i] = binary.LittleEndian.Uint64(features[8*i:])
+	}
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	h.Sum = make([]byte, size)
+	if _, err := io.ReadFull(reader, h.Sum); err != nil {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+// unexpectedEOF reports an io.EOF in the middle of a record as such.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
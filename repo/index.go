@@ -0,0 +1,149 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// hashIndex is a consolidation of the hashes of the first versions of a repo.
+// It allows to load them at once instead of going through each hashes file.
+type hashIndex struct {
+	Sizes []int64 // size of the hashes file of each indexed version
+	Data  []byte  // gob encoded hashIndexData
+	Sum   []byte  // checksum of Data
+}
+
+type hashIndexData struct {
+	Fingerprints FingerprintMap
+	Sketches     SketchMap
+	Raw          []ChunkId
+}
+
+// hashesSizes returns the size of the hashes file of each of the given versions.
+func hashesSizes(versions []string) ([]int64, error) {
+	sizes := make([]int64, len(versions))
+	for i, v := range versions {
+		info, err := os.Stat(filepath.Join(v, hashesName))
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = info.Size()
+	}
+	return sizes, nil
+}
+
+// storeHashIndex writes the current content of the repo maps into the hash
+// index of the given versions.
+func (r *Repo) storeHashIndex(versions []string) error {
+	data := hashIndexData{
+		Fingerprints: r.fingerprints,
+		Sketches:     r.sketches,
+	}
+	r.rawChunks.Range(func(key, value interface{}) bool {
+		data.Raw = append(data.Raw, key.(ChunkId))
+		return true
+	})
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(data); err != nil {
+		return err
+	}
+	sizes, err := hashesSizes(versions)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buff.Bytes())
+	index := hashIndex{Sizes: sizes, Data: buff.Bytes(), Sum: sum[:]}
+	path := filepath.Join(r.path, indexName)
+	file, err := r.createFile(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(file).Encode(index); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadHashIndex loads the hash index into the repo maps if it is consistent
+// with the given versions. It returns the number of versions it covered, the
+// hashes of the following ones still have to be loaded.
+func (r *Repo) loadHashIndex(versions []string) int {
+	index, data, err := r.readHashIndex(versions)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warning("hash index ignored: ", err)
+		}
+		return 0
+	}
+	for fp, id := range data.Fingerprints {
+		r.fingerprints[fp] = id
+	}
+	for sk, ids := range data.Sketches {
+		r.sketches[sk] = append(r.sketches[sk], ids...)
+	}
+	for _, id := range data.Raw {
+		r.rawChunks.Store(id, true)
+	}
+	logger.Infof("loaded hashes of %d versions from index", len(index.Sizes))
+	return len(index.Sizes)
+}
+
+// readHashIndex decodes the hash index and checks that it is still up to date
+// with the given versions.
+func (r *Repo) readHashIndex(versions []string) (index hashIndex, data hashIndexData, err error) {
+	file, err := os.Open(filepath.Join(r.path, indexName))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if err = gob.NewDecoder(file).Decode(&index); err != nil {
+		return
+	}
+	if len(index.Sizes) > len(versions) {
+		err = fmt.Errorf("%d versions indexed, only %d loaded", len(index.Sizes), len(versions))
+		return
+	}
+	sizes, err := hashesSizes(versions[:len(index.Sizes)])
+	if err != nil {
+		return
+	}
+	for i, size := range sizes {
+		if size != index.Sizes[i] {
+			err = fmt.Errorf("hashes of version %d changed", i)
+			return
+		}
+	}
+	if sum := sha256.Sum256(index.Data); !bytes.Equal(sum[:], index.Sum) {
+		err = fmt.Errorf("checksum mismatch")
+		return
+	}
+	err = gob.NewDecoder(bytes.NewReader(index.Data)).Decode(&data)
+	return
+}
@@ -0,0 +1,55 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SetIndexOnly enables or disables index-only commits, which store the file
+// list, the hashes and the recipe of the new version but not the content of
+// its new chunks. Such versions can be listed and compared, but not restored,
+// and the next commits do not deduplicate against them.
+func (r *Repo) SetIndexOnly(enabled bool) {
+	r.indexOnly = enabled
+}
+
+// markIndexOnly records that the given version has been committed without the
+// content of its chunks.
+func (r *Repo) markIndexOnly(version int) error {
+	path := filepath.Join(r.versionDir(version), indexOnlyName)
+	return os.WriteFile(path, nil, r.metaFileMode())
+}
+
+// isIndexOnly returns true if the version at the given path has been committed
+// without the content of its chunks.
+func isIndexOnly(version string) bool {
+	_, err := os.Stat(filepath.Join(version, indexOnlyName))
+	return err == nil
+}
+
+// checkContent returns ErrIndexOnly if the version at the given index has been
+// committed without the content of its chunks.
+func (r *Repo) checkContent(idx int) error {
+	if idx >= 0 && idx < len(r.versions) && isIndexOnly(r.versions[idx]) {
+		return fmt.Errorf("%w: version %d", ErrIndexOnly, idx)
+	}
+	return nil
+}
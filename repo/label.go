@@ -0,0 +1,62 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SetVersionLabel sets the label recorded in the versions index for the next
+// commit, such as a release name.
+func (r *Repo) SetVersionLabel(label string) {
+	r.versionLabel = label
+}
+
+// SetVersionMessage sets the message recorded in the versions index for the
+// next commit, describing its changes.
+func (r *Repo) SetVersionMessage(message string) {
+	r.versionMessage = message
+}
+
+// storeNote records the label and the message of the given version in its
+// directory, so that the versions index can be rebuilt with them. When
+// appending to a version, those that are not set are left as is.
+func (r *Repo) storeNote(version int) error {
+	for name, value := range map[string]string{labelName: r.versionLabel, messageName: r.versionMessage} {
+		if value == "" {
+			continue
+		}
+		path := filepath.Join(r.versionDir(version), name)
+		if err := os.WriteFile(path, []byte(value+"\n"), r.metaFileMode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readNote returns the label and the message recorded in the given version
+// directory, if any.
+func readNote(version string) (label string, message string) {
+	read := func(name string) string {
+		raw, _ := os.ReadFile(filepath.Join(version, name))
+		return strings.TrimSuffix(string(raw), "\n")
+	}
+	return read(labelName), read(messageName)
+}
@@ -0,0 +1,57 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// lock acquires the lock of the repo for writing, failing with ErrRepoLocked if
+// it is already held, by another process or by a concurrent operation.
+// The returned function releases it.
+func (r *Repo) lock() (unlock func(), err error) {
+	if r.readOnly {
+		return nil, ErrReadOnly
+	}
+	if err := os.MkdirAll(r.path, r.dirMode); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(r.path, lockName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, r.metaFileMode())
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("%w: remove %s if no other process is using it", ErrRepoLocked, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(file, os.Getpid())
+	if err := file.Close(); err != nil {
+		logger.Warning("lock ", err)
+	}
+	return func() {
+		if err := os.Remove(path); err != nil {
+			logger.Error("unlock ", err)
+		}
+	}, nil
+}
@@ -0,0 +1,57 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+// ManifestEntry describes a file written by a restore.
+type ManifestEntry struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+	Link     string `json:"link,omitempty"`
+}
+
+// SetRestoreManifest makes restores write into w a JSON manifest listing every
+// restored file with the size and checksum of what has actually been written.
+// A nil writer (the default) disables the manifest.
+func (r *Repo) SetRestoreManifest(w io.Writer) {
+	r.manifest = w
+}
+
+func newManifestEntry(file File, written int64, sum []byte) ManifestEntry {
+	return ManifestEntry{
+		Path:     file.Path,
+		Size:     written,
+		Checksum: hex.EncodeToString(sum),
+		Link:     file.Link,
+	}
+}
+
+func writeManifest(w io.Writer, entries []ManifestEntry) error {
+	data, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,81 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// MergeRepos creates in the destination directory a repo holding the versions
+// of all the given repos, ordered by the time they were committed, the versions
+// of the first repos coming first when committed at the same time. Like for
+// ExportRepo, the content of each version is restored and committed again, so
+// that the chunks shared by the repos are only stored once. The new repo has
+// the parameters of the first repo, and all of them must use the same checksum
+// algorithm, as the file lists cannot be checked otherwise.
+func MergeRepos(destination string, repos ...*Repo) error {
+	if len(repos) == 0 {
+		return fmt.Errorf("no repo to merge")
+	}
+	type mergedVersion struct {
+		repo    *Repo
+		repoIdx int
+		idx     int
+		time    time.Time
+	}
+	var versions []mergedVersion
+	for i, r := range repos {
+		if r.checksumAlgo != repos[0].checksumAlgo {
+			return fmt.Errorf("repo %d uses the %s checksum algorithm instead of %s", i, r.checksumAlgo, repos[0].checksumAlgo)
+		}
+		entries, err := r.VersionEntries()
+		if err != nil {
+			return err
+		}
+		for idx, e := range entries {
+			if err := r.checkContent(idx); err != nil {
+				return fmt.Errorf("repo %d: %w", i, err)
+			}
+			versions = append(versions, mergedVersion{r, i, idx, e.Time})
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].time.Before(versions[j].time) })
+	out, err := repos[0].newDerivedRepo(destination)
+	if err != nil {
+		return err
+	}
+	unlock, err := out.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for i, v := range versions {
+		logger.Infof("merge version %d of repo %d as version %d", v.idx, v.repoIdx, i)
+		if err := out.importVersion(v.repo, v.idx, v.time); err != nil {
+			return err
+		}
+		if err := out.canceled(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"hash"
+)
+
+// SetMerkleRoots enables or disables computing, for each file of the next
+// commits, the root of a Merkle tree over the checksums of its content cut in
+// blocks of the chunk size. It is stored in the file list as File.Merkle.
+func (r *Repo) SetMerkleRoots(enabled bool) {
+	r.merkleRoots = enabled
+}
+
+// merkleHasher computes the Merkle root of the content written into it. The
+// leaves are the checksums of each block of blockSize bytes, prefixed by 0,
+// and the nodes the checksums of their two children, prefixed by 1. An odd
+// node is promoted to the next level as is. No content gives a single empty
+// leaf.
+type merkleHasher struct {
+	newHash   func() hash.Hash
+	blockSize int
+	block     hash.Hash
+	written   int
+	leaves    [][]byte
+}
+
+func newMerkleHasher(newHash func() hash.Hash, blockSize int) *merkleHasher {
+	return &merkleHasher{newHash: newHash, blockSize: blockSize}
+}
+
+func (m *merkleHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if m.block == nil {
+			m.block = m.newHash()
+			m.block.Write([]byte{0})
+		}
+		size := m.blockSize - m.written
+		if size > len(p) {
+			size = len(p)
+		}
+		m.block.Write(p[:size])
+		m.written += size
+		p = p[size:]
+		if m.written == m.blockSize {
+			m.endBlock()
+		}
+	}
+	return n, nil
+}
+
+func (m *merkleHasher) endBlock() {
+	m.leaves = append(m.leaves, m.block.Sum(nil))
+	m.block = nil
+	m.written = 0
+}
+
+// Sum returns the Merkle root of the content written so far.
+func (m *merkleHasher) Sum() []byte {
+	if m.block != nil || len(m.leaves) == 0 {
+		if m.block == nil {
+			m.block = m.newHash()
+			m.block.Write([]byte{0})
+		}
+		m.endBlock()
+	}
+	level := m.leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := m.newHash()
+			node.Write([]byte{1})
+			node.Write(level[i])
+			node.Write(level[i+1])
+			next = append(next, node.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
@@ -0,0 +1,72 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// MetaStore reads and writes the metadata of the versions of a repo: their
+// file lists, recipes and hashes. The version is given as the path of its dir,
+// which identifies it, and name is the name of the metadata within it. The
+// chunks are always stored in the version dirs.
+type MetaStore interface {
+	ReadMeta(version string, name string) (io.ReadCloser, error)
+	WriteMeta(version string, name string) (io.WriteCloser, error)
+}
+
+// FileMetaStore is the default MetaStore, storing each metadata as a file of
+// its version dir, created with the given mode.
+type FileMetaStore struct {
+	Mode fs.FileMode
+}
+
+func (s FileMetaStore) ReadMeta(version string, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(version, name))
+}
+
+func (s FileMetaStore) WriteMeta(version string, name string) (io.WriteCloser, error) {
+	return os.OpenFile(filepath.Join(version, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, s.Mode)
+}
+
+// SetMetaStore sets the store of the metadata of the versions. By default they
+// are stored as files of the version dirs.
+func (r *Repo) SetMetaStore(store MetaStore) {
+	r.metaStore = store
+}
+
+// meta returns the store of the metadata of the versions.
+func (r *Repo) meta() MetaStore {
+	if r.metaStore == nil {
+		return FileMetaStore{r.fileMode}
+	}
+	return r.metaStore
+}
+
+// hasMeta returns true if the given metadata of the given version exists.
+func hasMeta(store MetaStore, version string, name string) bool {
+	in, err := store.ReadMeta(version, name)
+	if err != nil {
+		return false
+	}
+	in.Close()
+	return true
+}
@@ -21,6 +21,8 @@ package repo
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -46,10 +48,119 @@ func TestNotReadable(t *testing.T) {
 	var buff bytes.Buffer
 	files := listFiles(tmpDir)
 	testutils.AssertLen(t, 1, files, "Files")
-	concatFiles(&files, utils.NopCloser(&buff))
+	NewRepo(t.TempDir(), 8<<10).concatFiles(&files, utils.NopCloser(&buff))
 	testutils.AssertLen(t, 0, files, "Files")
 	testutils.AssertLen(t, 0, buff.Bytes(), "Buffer")
 	if !strings.Contains(output.String(), "notreadable") {
 		t.Errorf("log should contain a warning for notreadable, actual %q", &output)
 	}
 }
+
+func TestStrictCommit(t *testing.T) {
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "file"), []byte("content"), 0664)
+	if err := os.Symlink("/etc/passwd", filepath.Join(source, "external")); err != nil {
+		t.Fatal(err)
+	}
+	temp := t.TempDir()
+	repo := NewRepo(temp, 8<<10)
+	repo.SetStrict(true)
+	if err := repo.Commit(source); !errors.Is(err, ErrStrictWarnings) {
+		t.Fatal("strict commit should fail with warnings, actual:", err)
+	}
+	repo.loadVersions()
+	testutils.AssertLen(t, 0, repo.versions, "Versions after strict commit")
+
+	repo = NewRepo(temp, 8<<10)
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	repo.loadVersions()
+	testutils.AssertLen(t, 1, repo.versions, "Versions after commit")
+}
+
+func TestDirFileModes(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := filepath.Join(t.TempDir(), "repo")
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	repo := NewRepo(temp, 8<<10)
+	repo.SetDirMode(0700)
+	repo.SetFileMode(0600)
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	repo = NewReadOnlyRepo(temp, 8<<10)
+	repo.SetDirMode(0700)
+	repo.SetFileMode(0600)
+	repo.SetRestoreModes(false)
+	repo.Restore(dest)
+	for _, root := range []string{temp, dest} {
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || p == dest {
+				return err
+			}
+			expected := os.FileMode(0600)
+			if info.IsDir() {
+				expected = 0700
+			}
+			testutils.AssertSame(t, expected, info.Mode().Perm(), "Mode of "+p)
+			return nil
+		})
+	}
+}
+
+func TestRestoreModes(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	modes := map[string]os.FileMode{"script.sh": 0755, "secret": 0600, "shared": 0664}
+	for name, mode := range modes {
+		path := filepath.Join(source, name)
+		os.WriteFile(path, []byte("#!/bin/sh\necho "+name+"\n"), mode)
+		os.Chmod(path, mode)
+	}
+	temp := t.TempDir()
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range modes {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertSame(t, mode, info.Mode().Perm(), "Mode of "+name)
+	}
+}
+
+func TestModTimesJSON(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "file"), []byte("file"), 0644)
+	os.Symlink("file", filepath.Join(source, "link"))
+	temp := t.TempDir()
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	files, err := NewReadOnlyRepo(temp, 8<<10).VersionFiles(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 2, files, "Files")
+	for _, f := range files {
+		data, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasTime := strings.Contains(string(data), `"mtime"`)
+		testutils.AssertSame(t, f.isRegular(), hasTime, "Modification time in JSON of "+f.Path)
+	}
+}
@@ -0,0 +1,133 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+
+	"github.com/chmduquesne/rollinghash/rabinkarp64"
+	"github.com/n-peugnet/dna-backup/cache"
+	"github.com/n-peugnet/dna-backup/delta"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+// RepoOptions holds the parameters of a repo that can be given to
+// NewRepoWithOptions. The zero value of a field keeps the default of the
+// parameter. The parameters stored in the config of an existing repo take
+// precedence over the given ones, except for the chunk cache. The codecs that
+// are not known by name, like custom wrappers, are stored as such in the config,
+// so they must be given again each time the repo is opened. ChunkSize must be
+// set, unless the repo already has a config.
+type RepoOptions struct {
+	ChunkSize     int
+	SketchWSize   int   // size of the window of the sketch features
+	SketchFSize   int   // size of the sketch features, derived from ChunkSize if 0
+	SketchSfCount int   // number of super-features of a sketch
+	SketchFCount  int   // number of features of a super-feature
+	Seed          int64 // seed of the polynomial of the rolling hash
+	Differ        delta.Differ
+	Patcher       delta.Patcher
+	ChunkCache    cache.Cacher
+	ReadWrapper   utils.ReadWrapper  // decompression of the chunks
+	WriteWrapper  utils.WriteWrapper // compression of the chunks
+	MetaStore     MetaStore          // store of the lists and hashes
+	ReadOnly      bool
+}
+
+// NewRepoWithOptions opens the repo at the given path with the given options.
+// Like NewRepo, its directory is created if needed by the first operation
+// writing into it, unless it is read-only. It returns an error if the repo
+// cannot be initialized.
+func NewRepoWithOptions(path string, opts RepoOptions) (*Repo, error) {
+	r, err := newRepo(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	if r.chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size: %d", r.chunkSize)
+	}
+	if err := checkFeatureSize(r.sketchFSize, r.sketchWSize, r.sketchFCount, r.chunkSize); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// applyOptions sets the non-zero parameters of opts.
+func (r *Repo) applyOptions(opts RepoOptions) error {
+	if opts.ChunkSize != 0 {
+		r.chunkSize = opts.ChunkSize
+	}
+	if opts.SketchWSize != 0 {
+		r.sketchWSize = opts.SketchWSize
+	}
+	if opts.SketchFSize != 0 {
+		r.sketchFSize = opts.SketchFSize
+	}
+	if opts.SketchSfCount != 0 {
+		r.sketchSfCount = opts.SketchSfCount
+	}
+	if opts.SketchFCount != 0 {
+		r.sketchFCount = opts.SketchFCount
+	}
+	if opts.Seed != 0 {
+		pol, err := rabinkarp64.RandomPolynomial(opts.Seed)
+		if err != nil {
+			return fmt.Errorf("polynomial of seed %d: %w", opts.Seed, err)
+		}
+		r.seed, r.pol = opts.Seed, pol
+	}
+	if opts.Differ != nil {
+		r.differ = opts.Differ
+	}
+	if opts.Patcher != nil {
+		r.patcher = opts.Patcher
+	}
+	if opts.ChunkCache != nil {
+		r.chunkCache = opts.ChunkCache
+	}
+	if opts.ReadWrapper != nil {
+		r.chunkReadWrapper = opts.ReadWrapper
+	}
+	if opts.WriteWrapper != nil {
+		r.chunkWriteWrapper = opts.WriteWrapper
+	}
+	if opts.MetaStore != nil {
+		r.metaStore = opts.MetaStore
+	}
+	return nil
+}
+
+// Options returns the parameters of the repo, as read from its config if it
+// has one.
+func (r *Repo) Options() RepoOptions {
+	return RepoOptions{
+		ChunkSize:     r.chunkSize,
+		SketchWSize:   r.sketchWSize,
+		SketchFSize:   r.featureSize(),
+		SketchSfCount: r.sketchSfCount,
+		SketchFCount:  r.sketchFCount,
+		Seed:          r.seed,
+		Differ:        r.differ,
+		Patcher:       r.patcher,
+		ChunkCache:    r.chunkCache,
+		ReadWrapper:   r.chunkReadWrapper,
+		WriteWrapper:  r.chunkWriteWrapper,
+		MetaStore:     r.meta(),
+		ReadOnly:      r.readOnly,
+	}
+}
@@ -0,0 +1,107 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// Progress describes the advancement of a commit or a restore.
+// During a commit, it is reset at each pass of the matcher.
+type Progress struct {
+	Phase      string `json:"phase"`
+	FilesDone  int    `json:"filesDone"`
+	FilesTotal int    `json:"filesTotal"`
+	BytesDone  int64  `json:"bytesDone"`
+	BytesTotal int64  `json:"bytesTotal"`
+}
+
+// ProgressFunc is called each time a file has been processed.
+type ProgressFunc func(Progress)
+
+// JsonProgress returns a ProgressFunc writing each Progress event into w as a
+// line of JSON.
+func JsonProgress(w io.Writer) ProgressFunc {
+	encoder := json.NewEncoder(w)
+	return func(p Progress) {
+		if err := encoder.Encode(p); err != nil {
+			logger.Warning("progress ", err)
+		}
+	}
+}
+
+// SetProgress sets the function called to report the progress of commits and
+// restores. A nil function disables progress reporting.
+func (r *Repo) SetProgress(f ProgressFunc) {
+	r.progress = f
+}
+
+func newProgress(phase string, files []File) Progress {
+	p := Progress{Phase: phase, FilesTotal: len(files)}
+	for _, f := range files {
+		p.BytesTotal += f.Size
+	}
+	return p
+}
+
+// progressWriter reports the progress of the concatenation of the given files
+// based on the number of bytes written to the stream.
+type progressWriter struct {
+	io.WriteCloser
+	files  []File
+	report ProgressFunc
+	p      Progress
+	end    int64
+}
+
+func newProgressWriter(w io.WriteCloser, phase string, files []File, report ProgressFunc) *progressWriter {
+	return &progressWriter{
+		WriteCloser: w,
+		files:       files,
+		report:      report,
+		p:           newProgress(phase, files),
+	}
+}
+
+func (w *progressWriter) Write(b []byte) (n int, err error) {
+	n, err = w.WriteCloser.Write(b)
+	w.p.BytesDone += int64(n)
+	w.advance()
+	return
+}
+
+func (w *progressWriter) EndFile() {
+	endFile(w.WriteCloser)
+}
+
+func (w *progressWriter) Close() error {
+	w.advance()
+	return w.WriteCloser.Close()
+}
+
+// advance reports every file that has been completely written.
+func (w *progressWriter) advance() {
+	for w.p.FilesDone < len(w.files) && w.end+w.files[w.p.FilesDone].Size <= w.p.BytesDone {
+		w.end += w.files[w.p.FilesDone].Size
+		w.p.FilesDone++
+		w.report(w.p)
+	}
+}
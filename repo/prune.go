@@ -0,0 +1,162 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// SetMaxVersions sets the maximum number of versions kept by the repo. Once a
+// commit has been finalized, the oldest versions are pruned so that at most
+// max remain. 0 (the default) keeps all of them.
+func (r *Repo) SetMaxVersions(max int) {
+	r.maxVersions = max
+}
+
+// isPruned returns true if the version at the given path has been pruned and
+// only holds the chunks still needed by the next versions.
+func isPruned(version string) bool {
+	_, err := os.Stat(filepath.Join(version, prunedName))
+	return err == nil
+}
+
+// Prune removes the oldest versions of the repo so that only the keep latest
+// ones remain.
+func (r *Repo) Prune(keep int) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	r.loadVersions()
+	return r.prune(keep)
+}
+
+// prune removes the versions older than the keep latest loaded ones. The lists
+// of the oldest kept version are stored again as deltas against empty lists.
+// A pruned version whose chunks are still used by the recipes of the kept
+// versions is not removed but emptied of its lists and of its other chunks.
+func (r *Repo) prune(keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("at least one version must be kept, not %d", keep)
+	}
+	if len(r.versions) <= keep {
+		return nil
+	}
+	if r.partialVersion() < len(r.versions) {
+		return fmt.Errorf("the latest version must be finalized before pruning")
+	}
+	// the staged commits can use the chunks of any version
+	if dirs, _, err := r.stagedDirs(); err != nil {
+		return err
+	} else if len(dirs) > 0 {
+		return fmt.Errorf("%d commits are staged in %s, finalize or remove them before pruning", len(dirs), filepath.Join(r.path, stagingName))
+	}
+	first := len(r.versions) - keep
+	used := make(map[ChunkId]bool)
+	var files []File
+	var recipe []Chunk
+	// the recipe of the oldest kept version is the last one loaded
+	for i := len(r.versions) - 1; i >= first; i-- {
+		recipe = nil
+		if _, err := loadDeltas(&recipe, r.versions[:i+1], r.meta(), r.patcher, r.chunkReadWrapper, recipeName); err != nil {
+			return err
+		}
+		for _, c := range recipe {
+			switch c := c.(type) {
+			case *StoredChunk:
+				used[*c.Id] = true
+			case *DeltaChunk:
+				used[*c.Source] = true
+			}
+		}
+	}
+	if _, err := loadDeltas(&files, r.versions[:first+1], r.meta(), r.patcher, r.chunkReadWrapper, filesName); err != nil {
+		return err
+	}
+	logger.Infof("prune %d versions, keep %d", first, keep)
+	// the oldest kept version must not depend on the pruned lists anymore
+	number := versionNumber(r.versions[first])
+	r.filesRaw = nil
+	r.recipeRaw = nil
+	r.storeFileList(number, files)
+	r.storeRecipe(number, recipe)
+	for _, v := range r.versions[:first] {
+		if err := r.pruneVersion(v, used); err != nil {
+			return err
+		}
+	}
+	// the hash index covers the pruned versions
+	if err := os.Remove(filepath.Join(r.path, indexName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if entries, err := r.readVersionsIndex(); err == nil {
+		for _, v := range r.versions[:first] {
+			delete(entries, versionNumber(v))
+		}
+		if err := r.writeVersionsIndex(entries); err != nil {
+			logger.Warning("versions index ", err)
+		}
+	}
+	r.loadVersions()
+	return nil
+}
+
+// pruneVersion removes the version dir at the given path, or only its lists
+// and its chunks that are not used if some of them are. Its hashes are kept as
+// they tell which chunks are stored raw.
+func (r *Repo) pruneVersion(version string, used map[ChunkId]bool) error {
+	number := versionNumber(version)
+	chunksDir := filepath.Join(version, chunksName)
+	entries, err := os.ReadDir(chunksDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	var kept int
+	for _, e := range entries {
+		idx, err := strconv.ParseUint(e.Name(), 10, 64)
+		if err == nil && used[ChunkId{Ver: number, Idx: idx}] {
+			kept++
+			continue
+		}
+		if err := os.Remove(filepath.Join(chunksDir, e.Name())); err != nil {
+			return err
+		}
+	}
+	if kept == 0 {
+		logger.Infof("remove version %d", number)
+		return os.RemoveAll(version)
+	}
+	logger.Infof("keep %d chunks of pruned version %d", kept, number)
+	if err := os.WriteFile(filepath.Join(version, prunedName), nil, r.metaFileMode()); err != nil {
+		return err
+	}
+	for _, name := range []string{filesName, filesDirName, recipeName, fileMapName, digestName, parentName, labelName, messageName} {
+		if err := os.RemoveAll(filepath.Join(version, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
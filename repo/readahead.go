@@ -0,0 +1,140 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// SetReadAhead makes the files of a commit be read by the given number of
+// workers into memory in advance of their concatenation, without holding more
+// than limit bytes of their content at once. Files bigger than limit are read
+// directly when their turn comes. A number of 0 workers (the default) reads
+// the files one after the other.
+func (r *Repo) SetReadAhead(workers int, limit int64) {
+	r.readWorkers = workers
+	r.readAheadLimit = limit
+}
+
+// readAheadFile is the content of a file read in advance. If openErr is set,
+// the file could not be opened, else data holds what has been read until err.
+type readAheadFile struct {
+	data    []byte
+	openErr error
+	err     error
+}
+
+// byteBudget limits the total number of bytes held by the read-ahead workers.
+type byteBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	avail int64
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	b := &byteBudget{avail: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes are available and takes them. It returns false
+// without taking them if done is closed first.
+func (b *byteBudget) acquire(n int64, done <-chan struct{}) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.avail < n {
+		select {
+		case <-done:
+			return false
+		default:
+		}
+		b.cond.Wait()
+	}
+	b.avail -= n
+	return true
+}
+
+// wakeOn wakes up the waiting acquire calls once done is closed, so that they
+// can give up.
+func (b *byteBudget) wakeOn(done <-chan struct{}) {
+	<-done
+	b.mu.Lock()
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	b.avail += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// readAhead starts reading the given files in advance. The content of each file
+// is sent in order on its channel, which is nil for the files that are not read
+// in advance. The consumer must release the size of each received file from the
+// returned budget once it is done with its content, and close done when it
+// stops receiving them, so that no more files are read.
+func (r *Repo) readAhead(files []File, done <-chan struct{}) ([]chan readAheadFile, *byteBudget) {
+	budget := newByteBudget(r.readAheadLimit)
+	go budget.wakeOn(done)
+	fetched := make([]chan readAheadFile, len(files))
+	for i, f := range files {
+		if f.isRegular() && f.Size <= r.readAheadLimit {
+			fetched[i] = make(chan readAheadFile, 1)
+		}
+	}
+	jobs := make(chan int)
+	for w := 0; w < r.readWorkers; w++ {
+		go func() {
+			for i := range jobs {
+				fetched[i] <- readFileAhead(files[i].Path)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i, f := range files {
+			if fetched[i] == nil {
+				continue
+			}
+			if !budget.acquire(f.Size, done) {
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return fetched, budget
+}
+
+func readFileAhead(path string) (ret readAheadFile) {
+	file, err := os.Open(path)
+	if err != nil {
+		ret.openErr = err
+		return
+	}
+	defer file.Close()
+	ret.data, ret.err = io.ReadAll(file)
+	return
+}
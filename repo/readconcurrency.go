@@ -0,0 +1,44 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+// SetChunkReadConcurrency sets the maximum number of chunks read at the same
+// time by Verify and by the prefetching of Restore, which matters on storage
+// with a high latency. 0 (the default) makes Verify read the chunks one by one
+// and lets the prefetching read all the chunks of its window at once.
+func (r *Repo) SetChunkReadConcurrency(n int) {
+	r.readConcurrency = n
+}
+
+// chunkReaders returns the number of goroutines with which Verify reads the
+// chunks.
+func (r *Repo) chunkReaders() int {
+	if r.readConcurrency < 1 {
+		return 1
+	}
+	return r.readConcurrency
+}
+
+// readSlots returns a channel bounding the number of chunks loaded at the same
+// time by the prefetching, or nil if it is not bounded.
+func (r *Repo) readSlots() chan struct{} {
+	if r.readConcurrency < 1 {
+		return nil
+	}
+	return make(chan struct{}, r.readConcurrency)
+}
@@ -0,0 +1,127 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+// recipeRunsFormat is the format of the recipes stored as a list of recipeRun.
+const recipeRunsFormat = 1
+
+// recipeRun is an entry of a recipe in which the stored chunks that follow
+// each other in their version are collapsed. If Chunk is a StoredChunk, it is
+// followed by Run other stored chunks with the next ids.
+type recipeRun struct {
+	Chunk Chunk
+	Run   uint64
+}
+
+func collapseRecipeRuns(recipe []Chunk) (runs []recipeRun) {
+	for _, c := range recipe {
+		if last := len(runs) - 1; last >= 0 {
+			prev, prevStored := runs[last].Chunk.(*StoredChunk)
+			curr, currStored := c.(*StoredChunk)
+			if prevStored && currStored && curr.Id.Ver == prev.Id.Ver &&
+				curr.Id.Idx == prev.Id.Idx+runs[last].Run+1 {
+				runs[last].Run++
+				continue
+			}
+		}
+		runs = append(runs, recipeRun{Chunk: c})
+	}
+	return
+}
+
+func expandRecipeRuns(runs []recipeRun) (recipe []Chunk) {
+	for _, r := range runs {
+		recipe = append(recipe, r.Chunk)
+		if stored, isStored := r.Chunk.(*StoredChunk); isStored {
+			for i := uint64(1); i <= r.Run; i++ {
+				id := &ChunkId{Ver: stored.Id.Ver, Idx: stored.Id.Idx + i}
+				recipe = append(recipe, &StoredChunk{Id: id})
+			}
+		}
+	}
+	return
+}
+
+// recipeLen returns the number of chunks of the expanded runs.
+func recipeLen(runs []recipeRun) (n int) {
+	for _, r := range runs {
+		n++
+		if _, isStored := r.Chunk.(*StoredChunk); isStored {
+			n += int(r.Run)
+		}
+	}
+	return
+}
+
+// recipeStream yields the chunks of a recipe one at a time, expanding each run
+// only when it is reached. Only the runs are held in memory, so a recipe made
+// of long runs of stored chunks is much lighter than its expanded slice, but a
+// recipe that does not collapse into runs costs as much. The repo of the
+// yielded chunks is set.
+type recipeStream struct {
+	repo *Repo
+	runs []recipeRun
+	run  int
+	next uint64
+}
+
+// newRecipeStream returns a stream over the given runs, after setting the repo
+// of their first chunks. These chunks are shared by all the streams over the
+// runs: use rewind to get another stream that can be read concurrently.
+func (r *Repo) newRecipeStream(runs []recipeRun) *recipeStream {
+	for _, run := range runs {
+		if rc, isRepo := run.Chunk.(RepoChunk); isRepo {
+			rc.SetRepo(r)
+		}
+	}
+	return &recipeStream{repo: r, runs: runs}
+}
+
+// rewind returns a new stream over the same runs, starting from the first one.
+func (s *recipeStream) rewind() *recipeStream {
+	return &recipeStream{repo: s.repo, runs: s.runs}
+}
+
+// Next returns the next chunk of the recipe, or false if there is none left.
+func (s *recipeStream) Next() (Chunk, bool) {
+	if s.run >= len(s.runs) {
+		return nil, false
+	}
+	run := s.runs[s.run]
+	c := run.Chunk
+	stored, isStored := c.(*StoredChunk)
+	if isStored && s.next > 0 {
+		c = NewStoredChunk(s.repo, &ChunkId{Ver: stored.Id.Ver, Idx: stored.Id.Idx + s.next})
+	}
+	if isStored && s.next < run.Run {
+		s.next++
+	} else {
+		s.run++
+		s.next = 0
+	}
+	return c, true
+}
+
+// loadRecipeRuns loads the recipe of the last of the given versions without
+// expanding its runs. As each recipe is stored as a delta of the encoded
+// previous one, the whole patched list is still decoded at once; the recipes
+// stored before the runs format are even decoded as a full slice first.
+func (r *Repo) loadRecipeRuns(versions []string) (runs []recipeRun, err error) {
+	_, err = loadDeltas(&runs, versions, r.meta(), r.patcher, r.chunkReadWrapper, recipeName)
+	return
+}
@@ -0,0 +1,150 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// Recompress rewrites every chunk of every version, pruned or not, along with
+// their file lists, recipes and file maps, with the given compression codec,
+// and records it in the repo config. The content of each chunk is checked to
+// be unchanged before replacing it. The chunks stored raw are left as is.
+//
+// Each file is replaced atomically, but the repo must not be used if the
+// recompression is interrupted, as its files would use both codecs.
+func (r *Repo) Recompress(compression string) error {
+	codec, ok := compressionCodecs[compression]
+	if !ok {
+		return fmt.Errorf("unknown compression: %s", compression)
+	}
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// the pruned versions can still hold chunks used by the kept ones
+	for _, v := range r.versionDirs() {
+		number := versionNumber(v)
+		logger.Infof("recompress version %d", number)
+		entries, err := os.ReadDir(filepath.Join(v, chunksName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, e := range entries {
+			idx, err := strconv.ParseUint(e.Name(), 10, 64)
+			if err != nil {
+				continue
+			}
+			if err := r.recompressChunk(&ChunkId{number, idx}, codec); err != nil {
+				return err
+			}
+		}
+		names := []string{filesName, recipeName, fileMapName}
+		parts, _ := os.ReadDir(filepath.Join(v, filesDirName))
+		for _, p := range parts {
+			names = append(names, filepath.Join(filesDirName, p.Name()))
+		}
+		for _, name := range names {
+			if err := r.recompressFile(filepath.Join(v, name), codec); err != nil {
+				return fmt.Errorf("%s of %s: %w", name, v, err)
+			}
+		}
+	}
+	r.chunkReadWrapper, r.chunkWriteWrapper = codec.reader, codec.writer
+	hadDict := r.dictionary != nil
+	r.dictionary = nil
+	if err := r.writeConfig(); err != nil {
+		return err
+	}
+	if hadDict {
+		return os.Remove(filepath.Join(r.path, dictName))
+	}
+	return nil
+}
+
+func (r *Repo) recompressChunk(id *ChunkId, codec compressionCodec) error {
+	r.loadRawFlags(id.Ver)
+	if _, raw := r.rawChunks.Load(*id); raw {
+		return nil
+	}
+	content, err := r.readChunkContent(id)
+	if err != nil {
+		return err
+	}
+	if err := r.replaceWrapped(id.Path(r.path), content, codec); err != nil {
+		return &ChunkError{id, err}
+	}
+	return nil
+}
+
+// recompressFile rewrites the file at path, if it exists, from the current
+// codec of the repo to the given one.
+func (r *Repo) recompressFile(path string, codec compressionCodec) error {
+	stored, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	in, err := r.chunkReadWrapper(bytes.NewReader(stored))
+	if err != nil {
+		return err
+	}
+	content, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	return r.replaceWrapped(path, content, codec)
+}
+
+// replaceWrapped replaces the file at path by content wrapped with the given
+// codec, after having checked that it can be read back.
+func (r *Repo) replaceWrapped(path string, content []byte, codec compressionCodec) error {
+	var wrapped bytes.Buffer
+	out := codec.writer(&wrapped)
+	if _, err := out.Write(content); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in, err := codec.reader(bytes.NewReader(wrapped.Bytes()))
+	if err != nil {
+		return err
+	}
+	check, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(check, content) {
+		return fmt.Errorf("content changed by recompression")
+	}
+	if err := os.WriteFile(path+".tmp", wrapped.Bytes(), r.fileMode); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
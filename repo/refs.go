@@ -0,0 +1,111 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ChunkRef is an entry of the recipe of a version that needs a chunk, either
+// stored as is or as the source of a delta. Version is the index of the version
+// in the repo, as accepted by restore.
+type ChunkRef struct {
+	Version  int
+	Position int
+	Delta    bool
+}
+
+// ParseChunkRef parses a chunk written as <version>/<index>, where version is
+// the index of the version that stored it, as given to ChunkRefs.
+func ParseChunkRef(s string) (version int, index uint64, err error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid chunk %q, expected <version>/<index>", s)
+	}
+	version, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid version in chunk %q", s)
+	}
+	index, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid index in chunk %q", s)
+	}
+	return
+}
+
+// VersionChunks returns the recipe of the given version, with the repo of its
+// chunks set. Negative numbers count backwards from the latest version.
+func (r *Repo) VersionChunks(version int) ([]Chunk, error) {
+	r.loadVersions()
+	idx, err := r.versionIndex(version)
+	if err != nil {
+		return nil, err
+	}
+	var recipe []Chunk
+	if _, err := loadDeltas(&recipe, r.versions[:idx+1], r.meta(), r.patcher, r.chunkReadWrapper, recipeName); err != nil {
+		return nil, err
+	}
+	r.setRecipeRepo(recipe)
+	return recipe, nil
+}
+
+// ChunkRefs scans the recipes of all the versions and returns every entry that
+// needs the chunk of the given index stored by the given version. Like in the
+// returned refs, the version is its index in the repo, as accepted by restore,
+// so negative numbers count backwards from the latest version and the chunks
+// kept by pruned versions cannot be designated. The recipes are patched once,
+// one after the other, and those of the versions older than the one of the
+// chunk are not decoded as they cannot reference it.
+func (r *Repo) ChunkRefs(version int, index uint64) (refs []ChunkRef, err error) {
+	r.loadVersions()
+	first, err := r.versionIndex(version)
+	if err != nil {
+		return nil, err
+	}
+	id := ChunkId{Ver: versionNumber(r.versions[first]), Idx: index}
+	err = walkDeltas(r.versions, r.meta(), r.patcher, r.chunkReadWrapper, recipeName, func(v int, raw []byte) error {
+		if v < first || len(raw) == 0 {
+			return nil
+		}
+		var recipe []Chunk
+		if err := decodeList(raw, &recipe); err != nil {
+			path := filepath.Join(r.versions[v], recipeName)
+			return corruptListError(r.versions[v], recipeName, fmt.Errorf("%s: %w", path, err))
+		}
+		for i, c := range recipe {
+			switch c := c.(type) {
+			case *StoredChunk:
+				if *c.Id == id {
+					refs = append(refs, ChunkRef{Version: v, Position: i})
+				}
+			case *DeltaChunk:
+				if *c.Source == id {
+					refs = append(refs, ChunkRef{Version: v, Position: i, Delta: true})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,100 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// RepairRecipe rebuilds the recipe of the latest version from the chunks it
+// stores, for when its recipe is corrupt but its file list is not. The rebuilt
+// recipe only references stored chunks, so this is only possible if the
+// version neither reuses chunks of the previous ones nor stores some of its
+// content inline, which is checked by comparing the size of its chunks with
+// the size of its files.
+func (r *Repo) RepairRecipe() error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	r.loadVersions()
+	if len(r.versions) == 0 {
+		return fmt.Errorf("repo is empty")
+	}
+	idx := len(r.versions) - 1
+	if err := r.checkContent(idx); err != nil {
+		return err
+	}
+	var files []File
+	if _, err := loadDeltas(&files, r.versions, r.meta(), r.patcher, r.chunkReadWrapper, filesName); err != nil {
+		return err
+	}
+	// the recipe is stored as a delta of the previous ones
+	var prevRaw []byte
+	if idx > 0 {
+		var prev []Chunk
+		if prevRaw, err = loadDeltas(&prev, r.versions[:idx], r.meta(), r.patcher, r.chunkReadWrapper, recipeName); err != nil {
+			return err
+		}
+	}
+	var size, stored int64
+	for _, f := range files {
+		if f.isRegular() {
+			size += f.Size
+		}
+	}
+	chunks, err := os.ReadDir(filepath.Join(r.versions[idx], chunksName))
+	if err != nil {
+		return err
+	}
+	recipe := make([]Chunk, 0, len(chunks))
+	for _, c := range chunks {
+		// skip the leftovers of an interrupted recompression
+		i, err := strconv.ParseUint(c.Name(), 10, 64)
+		if err != nil {
+			logger.Debug("skip non chunk file ", c.Name())
+			continue
+		}
+		id := &ChunkId{Ver: versionNumber(r.versions[idx]), Idx: i}
+		content, err := r.readChunkContent(id)
+		if err != nil {
+			return err
+		}
+		stored += int64(len(content))
+		recipe = append(recipe, NewStoredChunk(r, id))
+	}
+	if stored != size {
+		return fmt.Errorf("chunks of version %d hold %d bytes but its files %d, its recipe cannot be rebuilt", idx, stored, size)
+	}
+	r.recipeRaw = prevRaw
+	r.storeRecipe(versionNumber(r.versions[idx]), recipe)
+	// the file map points into the previous recipe
+	if err := os.Remove(filepath.Join(r.versions[idx], fileMapName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	logger.Infof("rebuilt recipe of version %d from %d chunks", idx, len(recipe))
+	return nil
+}
@@ -46,15 +46,22 @@ package repo
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/chmduquesne/rollinghash/rabinkarp64"
 	"github.com/n-peugnet/dna-backup/cache"
@@ -87,11 +94,14 @@ func (m SketchMap) Set(key []uint64, value *ChunkId) {
 
 type Repo struct {
 	path              string
+	readOnly          bool
 	versions          []string
 	chunkSize         int
 	sketchWSize       int
+	sketchFSize       int
 	sketchSfCount     int
 	sketchFCount      int
+	seed              int64
 	pol               rabinkarp64.Pol
 	differ            delta.Differ
 	patcher           delta.Patcher
@@ -102,13 +112,74 @@ type Repo struct {
 	files             []File
 	filesRaw          []byte
 	chunkCache        cache.Cacher
+	pendingChunks     sync.Map
+	rawChunks         sync.Map
+	rawLoaded         sync.Map
+	rawThreshold      float64
 	chunkReadWrapper  utils.ReadWrapper
 	chunkWriteWrapper utils.WriteWrapper
+	metaStore         MetaStore
+	dictionary        []byte
+	trainDict         bool
+	restoreVerify     bool
+	resume            bool
+	progress          ProgressFunc
+	prefetch          int
+	coalesceSize      int
+	readWorkers       int
+	readAheadLimit    int64
+	checksumAlgo      string
+	hashesFormat      string
+	hashesCompression string
+	caseCheck         string
+	minFreeSpace      int64
+	storeConcurrency  int
+	fileMap           bool
+	noSketch          bool
+	dirMode           fs.FileMode
+	fileMode          fs.FileMode
+	noModes           bool
+	base              int
+	hasBase           bool
+	restoreVersion    int
+	hasRestoreVersion bool
+	hashSources       map[int]bool
+	retryAttempts     int
+	retryDelay        time.Duration
+	xattrs            bool
+	specials          bool
+	indexOnly         bool
+	versionLabel      string
+	versionMessage    string
+	ctx               context.Context
+	verifyOnWrite     bool
+	storeQueueSize    int
+	plainTail         bool
+	splitFiles        bool
+	sample            float64
+	sampleSeed        int64
+	sourceFiles       []string
+	fileBoundaries    bool
+	merkleRoots       bool
+	maxVersions       int
+	readConcurrency   int
+	fsync             bool
+	stageDir          string
+	stageNumber       int
+	writeErr          error
+	writeErrMutex     sync.Mutex
+	matchErr          error
+	matchErrMutex     sync.Mutex
+	manifest          io.Writer
+	strict            bool
+	warnings          int64
 }
 
 type chunkHashes struct {
-	Fp uint64
-	Sk []uint64
+	Fp  uint64
+	Sk  []uint64
+	Sum []byte
+	Raw bool // content is stored without the chunk wrapper
 }
 
 type chunkData struct {
@@ -118,32 +189,139 @@ type chunkData struct {
 }
 
 type File struct {
-	Path string
-	Size int64
-	Link string
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Link    string      `json:"link,omitempty"`
+	Sum     []byte      `json:"sum,omitempty"`
+	Xattrs  []Xattr     `json:"xattrs,omitempty"`
+	Special string      `json:"special,omitempty"` // type of a special file
+	Rdev    uint64      `json:"rdev,omitempty"`    // device number of a device node
+	Merkle  []byte      `json:"merkle,omitempty"`  // Merkle root of the content
+	Mode    fs.FileMode `json:"mode,omitempty"`    // permissions of a regular file
+	ModTime *time.Time  `json:"mtime,omitempty"`   // modification time of a regular file
 }
 
+// Xattr is an extended attribute of a file.
+type Xattr struct {
+	Name  string `json:"name"`
+	Value []byte `json:"value"`
+}
+
+// NewRepo opens the repo at the given path for reading and writing. Its
+// directory is created if needed by the first operation writing into it.
+// It panics if the repo cannot be initialized, see OpenRepo.
 func NewRepo(path string, chunkSize int) *Repo {
-	var err error
-	path, err = filepath.Abs(path)
+	r, err := newRepo(path, RepoOptions{ChunkSize: chunkSize})
 	if err != nil {
-		logger.Fatal(err)
+		logger.Panic(err)
 	}
-	err = os.MkdirAll(path, 0775)
+	return r
+}
+
+// NewReadOnlyRepo opens the existing repo at the given path without ever
+// writing into it, so that it can be read from a read-only filesystem.
+// Operations creating versions return ErrReadOnly.
+// It panics if the repo cannot be initialized, see OpenReadOnlyRepo.
+func NewReadOnlyRepo(path string, chunkSize int) *Repo {
+	r, err := newRepo(path, RepoOptions{ChunkSize: chunkSize, ReadOnly: true})
 	if err != nil {
 		logger.Panic(err)
 	}
+	return r
+}
+
+// CreateRepo returns a new repo for the given path, which is written by its
+// first commit. It fails with ErrRepoExists if the path already holds a repo,
+// unless force is set, in which case the existing repo is opened.
+func CreateRepo(path string, chunkSize int, force bool) (*Repo, error) {
+	exists, err := isRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	if exists && !force {
+		return nil, fmt.Errorf("%w: %s", ErrRepoExists, path)
+	}
+	return newRepo(path, RepoOptions{ChunkSize: chunkSize})
+}
+
+// OpenRepo is like NewRepo, but returns an error if the repo cannot be
+// initialized, for instance because of an invalid config, and ErrNotRepo if
+// the path does not hold a repo.
+func OpenRepo(path string, chunkSize int) (*Repo, error) {
+	if err := checkRepo(path); err != nil {
+		return nil, err
+	}
+	return newRepo(path, RepoOptions{ChunkSize: chunkSize})
+}
+
+// OpenReadOnlyRepo is like NewReadOnlyRepo, but returns an error if the repo
+// cannot be initialized, and ErrNotRepo if the path does not hold a repo.
+func OpenReadOnlyRepo(path string, chunkSize int) (*Repo, error) {
+	if err := checkRepo(path); err != nil {
+		return nil, err
+	}
+	return newRepo(path, RepoOptions{ChunkSize: chunkSize, ReadOnly: true})
+}
+
+// isRepo tells if the directory at path holds a repo, that is a config or a
+// version, as the oldest repos do not have a config.
+func isRepo(path string) (bool, error) {
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Name() == configName {
+			return true, nil
+		}
+		var v int
+		if _, err := fmt.Sscanf(e.Name(), versionFmt, &v); e.IsDir() && err == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkRepo returns ErrNotRepo if the path does not hold a repo.
+func checkRepo(path string) error {
+	exists, err := isRepo(path)
+	if err == nil && !exists {
+		err = fmt.Errorf("%w: %s", ErrNotRepo, path)
+	}
+	return err
+}
+
+func newRepo(path string, opts RepoOptions) (*Repo, error) {
+	var err error
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ReadOnly {
+		var info fs.FileInfo
+		info, err = os.Stat(path)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s: not a directory", path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 	var seed int64 = 1
 	p, err := rabinkarp64.RandomPolynomial(seed)
 	if err != nil {
-		logger.Panic(err)
+		return nil, fmt.Errorf("polynomial of seed %d: %w", seed, err)
 	}
-	return &Repo{
+	r := &Repo{
 		path:              path,
-		chunkSize:         chunkSize,
+		readOnly:          opts.ReadOnly,
 		sketchWSize:       32,
 		sketchSfCount:     3,
 		sketchFCount:      4,
+		seed:              seed,
 		pol:               p,
 		differ:            delta.Fdelta{},
 		patcher:           delta.Fdelta{},
@@ -152,7 +330,21 @@ func NewRepo(path string, chunkSize int) *Repo {
 		chunkCache:        cache.NewFifoCache(10000),
 		chunkReadWrapper:  utils.ZlibReader,
 		chunkWriteWrapper: utils.ZlibWriter,
+		checksumAlgo:      "sha256",
+		hashesFormat:      "gob",
+		hashesCompression: "none",
+		caseCheck:         "ignore",
+		dirMode:           0775,
+		fileMode:          0666,
+		retryAttempts:     1,
+	}
+	if err := r.applyOptions(opts); err != nil {
+		return nil, err
 	}
+	if err := r.loadConfig(); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 func (r *Repo) Differ() delta.Differ {
@@ -163,79 +355,670 @@ func (r *Repo) Patcher() delta.Patcher {
 	return r.patcher
 }
 
-func (r *Repo) Commit(source string) {
+// SetCacheSize replaces the chunk cache by a new one able to hold the given
+// number of chunks. A size of 0 disables the cache.
+func (r *Repo) SetCacheSize(size int) {
+	r.chunkCache = cache.New(size)
+}
+
+// SetPrefetch sets the number of recipe entries for which the chunks are loaded
+// in advance into the cache during a restore. It should stay well below the
+// cache size, or else prefetched chunks would be evicted before being used.
+// A depth of 0 (the default) disables prefetching.
+func (r *Repo) SetPrefetch(depth int) {
+	r.prefetch = depth
+}
+
+// SetRawThreshold makes chunks be stored raw, without going through the chunk
+// write wrapper, if the wrapped output is not smaller than threshold times the
+// raw content. This avoids storing already compressed data recompressed.
+// A threshold of 0 (the default) always uses the wrapper.
+func (r *Repo) SetRawThreshold(threshold float64) {
+	r.rawThreshold = threshold
+}
+
+// SetRestoreVerify enables or disables the verification of the restored files.
+// When enabled, each file is read again after being written and its checksum
+// is compared against the one recorded at commit time.
+func (r *Repo) SetRestoreVerify(verify bool) {
+	r.restoreVerify = verify
+}
+
+// SetCoalesceSize makes adjacent temporary chunks of the recipe be merged
+// together as long as the merged chunk is smaller than size bytes. This reduces
+// the number of small inline chunks fragmenting the recipe.
+// A size of 0 (the default) disables coalescing.
+func (r *Repo) SetCoalesceSize(size int) {
+	r.coalesceSize = size
+}
+
+// SetXattrs enables or disables storing the extended attributes of the files
+// on commit and restoring them. It does nothing on platforms that do not
+// support them.
+func (r *Repo) SetXattrs(enabled bool) {
+	r.xattrs = enabled
+}
+
+// SetDirMode sets the permissions of the directories created in the repo and
+// by Restore, before the umask is applied. It defaults to 0775.
+func (r *Repo) SetDirMode(mode fs.FileMode) {
+	r.dirMode = mode
+}
+
+// SetFileMode sets the permissions of the files created in the repo and by
+// Restore, before the umask is applied. It defaults to 0666. The small
+// metadata files of the repo are never made world writable. The restored files
+// committed with their permissions get them back, unless disabled with
+// SetRestoreModes.
+func (r *Repo) SetFileMode(mode fs.FileMode) {
+	r.fileMode = mode
+}
+
+// SetRestoreModes enables or disables giving back to the restored files the
+// permissions they were committed with, 0644 for the files committed before
+// permissions were stored. It is enabled by default.
+func (r *Repo) SetRestoreModes(enabled bool) {
+	r.noModes = !enabled
+}
+
+// createFile creates or truncates the file at path with the file mode.
+func (r *Repo) createFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, r.fileMode)
+}
+
+// metaFileMode returns the mode of the repo metadata files, such as markers.
+func (r *Repo) metaFileMode() fs.FileMode {
+	return r.fileMode & 0664
+}
+
+// Commit stores the content of source as a new version of the repo, or appends
+// it to the latest version if it has not been finalized yet, and finalizes it.
+func (r *Repo) Commit(source string) error {
+	return r.commit(source, true)
+}
+
+// Append adds the content of source to the latest version of the repo if it
+// has not been finalized yet, or else to a new version. The version is left
+// open, so that more sources can be appended to it, until Finalize is called.
+func (r *Repo) Append(source string) error {
+	return r.commit(source, false)
+}
+
+// Finalize closes the version opened by Append, so that the next commits will
+// create a new version.
+func (r *Repo) Finalize() error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	r.loadVersions()
+	partial := r.partialVersion()
+	if partial == len(r.versions) {
+		logger.Info("no version to finalize")
+		return nil
+	}
+	logger.Infof("finalize version %d", partial)
+	return os.Remove(filepath.Join(r.versions[partial], partialName))
+}
+
+func (r *Repo) commit(source string, finalize bool) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	source, files, err := r.prepareCommit(source)
+	if err != nil {
+		return err
+	}
+	partial := r.partialVersion()
+	if r.indexOnly && (!finalize || partial < len(r.versions)) {
+		return fmt.Errorf("index-only commits cannot be appended")
+	}
+	parent, err := r.resolveBase(partial)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	var filesErr, recipeErr error
+	wg.Add(3)
+	go r.loadHashes(r.versions, &wg)
+	go func() {
+		defer wg.Done()
+		filesErr = r.loadFileLists(r.versions[:partial])
+	}()
+	go func() {
+		defer wg.Done()
+		recipeErr = r.loadRecipes(r.versions[:partial])
+	}()
+	wg.Wait()
+	if filesErr != nil {
+		return filesErr
+	}
+	if recipeErr != nil {
+		return recipeErr
+	}
+	if err := r.checkFreeSpace(files); err != nil {
+		return err
+	}
+	var prevFiles []File
+	var prevRecipe []Chunk
+	var first uint64
+	if partial < len(r.versions) {
+		logger.Infof("append to version %d", partial)
+		if _, err := loadDeltas(&prevFiles, r.versions[:partial+1], r.meta(), r.patcher, r.chunkReadWrapper, filesName); err != nil {
+			return err
+		}
+		if _, err := loadDeltas(&prevRecipe, r.versions[:partial+1], r.meta(), r.patcher, r.chunkReadWrapper, recipeName); err != nil {
+			return err
+		}
+		r.setRecipeRepo(prevRecipe)
+		readHashes(r.meta(), r.versions[partial], func(uint64, chunkHashes) { first++ })
+	}
+	if r.trainDict && len(r.versions) == 0 {
+		r.trainDictionary(files)
+	}
+	newVersion, recipe := r.commitFiles(r.versionNumberAt(partial), first, &files)
+	if r.indexOnly {
+		if err := r.markIndexOnly(newVersion); err != nil {
+			return err
+		}
+	}
+	if err := r.commitError(); err != nil {
+		if partial == len(r.versions) {
+			os.RemoveAll(r.versionDir(newVersion))
+		}
+		return err
+	}
+	// files can only have been removed by concatFiles, so this cannot fail
+	newFiles, _ := unprefixFiles(files, source)
+	allFiles := append(prevFiles, newFiles...)
+	allRecipe := append(prevRecipe, recipe...)
+	r.storeFileList(newVersion, allFiles)
+	r.storeRecipe(newVersion, allRecipe)
+	if err := r.storeDigest(newVersion, allFiles); err != nil {
+		logger.Warning("digest ", err)
+	}
+	if err := r.storeNote(newVersion); err != nil {
+		return err
+	}
+	if err := r.storeVersionEntry(newVersion, allFiles, time.Now()); err != nil {
+		logger.Warning("versions index ", err)
+	}
+	if r.fileMap {
+		r.storeFileMap(newVersion, fileLocations(allFiles, allRecipe))
+	}
+	if parent >= 0 {
+		// the maps only hold the hashes of the base, they cannot be indexed
+		if err := r.storeParent(newVersion, parent); err != nil {
+			return err
+		}
+	} else if !r.indexOnly {
+		versions := append(r.versions[:partial:partial], r.versionDir(newVersion))
+		if err := r.storeHashIndex(versions); err != nil {
+			logger.Warning("hash index ", err)
+		}
+	}
+	marker := filepath.Join(r.versionDir(newVersion), partialName)
+	if finalize {
+		if partial < len(r.versions) {
+			if err := os.Remove(marker); err != nil {
+				logger.Error(err)
+			}
+		}
+	} else if err := os.WriteFile(marker, nil, r.metaFileMode()); err != nil {
+		return err
+	}
+	if err := r.syncVersion(newVersion); err != nil {
+		return err
+	}
+	if finalize && r.maxVersions > 0 {
+		r.loadVersions()
+		return r.prune(r.maxVersions)
+	}
+	return nil
+}
+
+// prepareCommit lists the files of source to commit, along with their extended
+// attributes if enabled, and loads the versions of the repo. It returns the
+// absolute path of source and its files.
+func (r *Repo) prepareCommit(source string) (string, []File, error) {
 	source, err := filepath.Abs(source)
 	if err != nil {
-		logger.Fatal(err)
+		return "", nil, err
+	}
+	atomic.StoreInt64(&r.warnings, 0)
+	files, err := r.listSource(source)
+	if err != nil {
+		return "", nil, err
+	}
+	unprefixed, err := unprefixFiles(files, source)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := r.checkCaseCollisions(unprefixed); err != nil {
+		return "", nil, err
+	}
+	if r.xattrs {
+		r.readFilesXattrs(files)
+	}
+	if err := r.checkWarnings(); err != nil {
+		return "", nil, err
+	}
+	r.loadVersions()
+	if err := r.checkChecksumAlgo(); err != nil {
+		return "", nil, err
+	}
+	return source, files, nil
+}
+
+// commitFiles stores the content of the files into the given version, starting
+// at chunk first, and returns its number along with the recipe of the files.
+// The files that could not be read are removed from the list.
+func (r *Repo) commitFiles(version int, first uint64, files *[]File) (int, []Chunk) {
+	return r.commitStream(version, first, func(stream io.WriteCloser) {
+		if r.progress != nil {
+			stream = newProgressWriter(stream, "commit", *files, r.progress)
+		}
+		r.concatFiles(files, stream)
+	})
+}
+
+// commitError returns the error that made the last commitFiles fail, if any.
+func (r *Repo) commitError() error {
+	if err := r.canceled(); err != nil {
+		return err
+	}
+	if err := r.matchError(); err != nil {
+		return err
+	}
+	if err := r.writeError(); err != nil {
+		return err
+	}
+	return r.checkWarnings()
+}
+
+// listSource lists the files of source that a commit stores.
+func (r *Repo) listSource(source string) ([]File, error) {
+	// the repo itself must not be stored if it is inside the source
+	repoInfo, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if r.sourceFiles != nil {
+		files = listSourceFiles(source, r.sourceFiles, r.warn)
+	} else {
+		files = walkFiles(source, repoInfo, r.warn)
+	}
+	if !r.specials {
+		files = r.skipSpecials(files)
 	}
-	r.Init()
-	newVersion := len(r.versions) // TODO: add newVersion functino
-	newPath := filepath.Join(r.path, fmt.Sprintf(versionFmt, newVersion))
+	return files, nil
+}
+
+// createVersionDir creates the directory of the given version along with its
+// chunks directory, if they do not exist yet.
+func (r *Repo) createVersionDir(version int) {
+	newPath := r.versionDir(version)
 	newChunkPath := filepath.Join(newPath, chunksName)
-	os.Mkdir(newPath, 0775)      // TODO: handle errors
-	os.Mkdir(newChunkPath, 0775) // TODO: handle errors
-	files := listFiles(source)
-	storeQueue := make(chan chunkData, 32)
+	os.Mkdir(newPath, r.dirMode)      // TODO: handle errors
+	os.Mkdir(newChunkPath, r.dirMode) // TODO: handle errors
+}
+
+// partialVersion returns the index of the latest version if it has not been
+// finalized yet, or else the number of versions.
+func (r *Repo) partialVersion() int {
+	last := len(r.versions) - 1
+	if last >= 0 {
+		if _, err := os.Stat(filepath.Join(r.versions[last], partialName)); err == nil {
+			return last
+		}
+	}
+	return len(r.versions)
+}
+
+// commitStream stores the chunks of the stream produced by streamFunc into the
+// given version, creating it if needed. first is the index of its first new
+// chunk. As the matcher makes multiple passes until no more chunks are added,
+// streamFunc can be called multiple times, it must write the same content each
+// time and close the stream once done.
+//
+// It returns the index of the version and the recipe of the stream.
+func (r *Repo) commitStream(newVersion int, first uint64, streamFunc func(io.WriteCloser)) (int, []Chunk) {
+	if newVersion == 0 {
+		r.storeConfig()
+	}
+	r.createVersionDir(newVersion)
+	// the raw flags of the new chunks are set as they are stored
+	r.setRawLoaded(newVersion)
+	storeQueue := make(chan chunkData, r.storeQueueDepth())
 	storeEnd := make(chan bool)
 	go r.storageWorker(newVersion, storeQueue, storeEnd)
-	var last, nlast, pass uint64
+	recipe := r.matchPasses(newVersion, first, storeQueue, streamFunc)
+	close(storeQueue)
+	<-storeEnd
+	if r.coalesceSize > 0 {
+		recipe = coalesceTempChunks(recipe, r.coalesceSize)
+	}
+	return newVersion, recipe
+}
+
+// matchPasses matches the stream written by streamFunc against the chunks of
+// the repo, sending the new chunks of version to storeQueue. It starts again
+// as long as the previous pass found new chunks, the first new chunk of the
+// version having the index first.
+func (r *Repo) matchPasses(version int, first uint64, storeQueue chan<- chunkData, streamFunc func(io.WriteCloser)) []Chunk {
+	var last, pass uint64
+	var nlast = first
 	var recipe []Chunk
 	for ; nlast > last || pass == 0; pass++ {
 		logger.Infof("matcher pass number %d", pass+1)
 		last = nlast
+		if r.fileBoundaries {
+			// each file is matched on its own
+			stream := newFileStream()
+			go streamFunc(stream)
+			recipe, nlast = nil, last
+			for reader := range stream.files {
+				var chunks []Chunk
+				chunks, nlast = r.matchStream(reader, storeQueue, version, nlast)
+				recipe = append(recipe, chunks...)
+			}
+			continue
+		}
 		reader, writer := io.Pipe()
-		go concatFiles(&files, writer)
-		recipe, nlast = r.matchStream(reader, storeQueue, newVersion, last)
+		go streamFunc(writer)
+		recipe, nlast = r.matchStream(reader, storeQueue, version, last)
 	}
-	close(storeQueue)
-	<-storeEnd
-	r.storeFileList(newVersion, unprefixFiles(files, source))
-	r.storeRecipe(newVersion, recipe)
+	return recipe
 }
 
-func (r *Repo) Restore(destination string) {
-	r.Init()
+// Restore writes the version of the repo set by SetRestoreVersion, the latest
+// one by default, into the destination directory.
+// If restore verification is enabled, an error is returned when at least one of
+// the restored files does not match its recorded checksum.
+func (r *Repo) Restore(destination string) error {
+	return r.RestoreVersion(destination, r.selectedVersion())
+}
+
+// RestoreVersion is like Restore, but writes the given version, negative
+// numbers counting from the latest one. An error is returned if the version
+// does not exist.
+func (r *Repo) RestoreVersion(destination string, version int) error {
+	r.loadVersions()
+	idx, err := r.versionIndex(version)
+	if err != nil {
+		return err
+	}
+	if err := r.checkContent(idx); err != nil {
+		return err
+	}
+	runs, err := r.loadRestoreLists(r.versions[:idx+1])
+	if err != nil {
+		return err
+	}
+	if err := r.checkCaseCollisions(r.files); err != nil {
+		return err
+	}
+	if err := r.checkDestination(destination, r.files); err != nil {
+		return err
+	}
 	reader, writer := io.Pipe()
-	logger.Info("restore latest version")
-	go r.restoreStream(writer, r.recipe)
+	logger.Infof("restore version %d", idx)
+	go r.restoreStream(writer, runs)
 	bufReader := bufio.NewReaderSize(reader, r.chunkSize*2)
+	var mismatch, failed int
+	var firstMismatch, firstFailure error
+	var manifest []ManifestEntry
+	progress := newProgress("restore", r.files)
 	for _, file := range r.files {
+		if err := r.canceled(); err != nil {
+			reader.CloseWithError(err)
+			return err
+		}
 		filePath := filepath.Join(destination, file.Path)
 		dir := filepath.Dir(filePath)
-		os.MkdirAll(dir, 0775) // TODO: handle errors
+		os.MkdirAll(dir, r.dirMode) // TODO: handle errors
 		if file.Link != "" {
 			link := file.Link
 			if filepath.IsAbs(link) {
 				filepath.Join(destination, file.Link)
 			}
-			err := os.Symlink(link, filePath)
+			var err error
+			if target, lerr := os.Readlink(filePath); r.resume && lerr == nil && target == link {
+				logger.Debug("already restored ", file.Path)
+			} else {
+				err = os.Symlink(link, filePath)
+			}
 			if err != nil {
 				logger.Errorf("restored symlink ", err)
+			} else if r.manifest != nil {
+				manifest = append(manifest, newManifestEntry(file, 0, nil))
+			}
+		} else if file.Special != "" {
+			if !r.specials {
+				logger.Warning("skipping special file ", file.Path)
+			} else if err := r.restoreSpecial(filePath, file); err != nil {
+				logger.Warning("skipping special file ", err)
+			} else if r.manifest != nil {
+				manifest = append(manifest, newManifestEntry(file, 0, nil))
 			}
 		} else {
-			f, _ := os.Create(filePath) // TODO: handle errors
-			n, err := io.CopyN(f, bufReader, file.Size)
+			skip := r.resume && r.alreadyRestored(filePath, file)
+			var f *os.File
+			var dest io.Writer = io.Discard
+			if skip {
+				logger.Debug("already restored ", file.Path)
+			} else if cf, err := r.createFile(filePath); err != nil {
+				// its content still has to be read from the stream
+				logger.Error("restored file ", err)
+				if failed == 0 {
+					firstFailure = err
+				}
+				failed++
+			} else {
+				f = cf
+				dest = f
+			}
+			hasher := r.newChecksum()
+			if r.manifest != nil {
+				dest = io.MultiWriter(dest, hasher)
+			}
+			n, err := io.CopyN(dest, bufReader, file.Size)
+			if r.manifest != nil {
+				manifest = append(manifest, newManifestEntry(file, n, hasher.Sum(nil)))
+			}
+			if f != nil {
+				if err := f.Close(); err != nil {
+					logger.Errorf("restored file ", err)
+				}
+			}
 			if err != nil {
-				logger.Errorf("restored file, written %d/%d bytes: %s", filePath, n, file.Size, err)
+				logger.Errorf("restored file %s, written %d/%d bytes: %s", filePath, n, file.Size, err)
+				// the next files cannot be read from the stream anymore
+				reader.CloseWithError(err)
+				return fmt.Errorf("restored file %s: %w", file.Path, err)
+			}
+			if r.xattrs {
+				if err := writeXattrs(filePath, file.Xattrs); err != nil {
+					logger.Warning("restored file ", err)
+				}
 			}
-			if err := f.Close(); err != nil {
-				logger.Errorf("restored file ", err)
+			if r.restoreVerify && f != nil {
+				if err := r.verifyFile(filePath, file); err != nil {
+					logger.Errorf("restored file %s: %s", file.Path, err)
+					if mismatch == 0 {
+						firstMismatch = err
+					}
+					mismatch++
+				}
+			}
+			if !r.noModes && (f != nil || skip) {
+				if err := os.Chmod(filePath, file.Mode); err != nil {
+					logger.Warning("restored file ", err)
+				}
+			}
+			// the files committed without their time are left as written
+			if file.ModTime != nil && (f != nil || skip) {
+				if err := os.Chtimes(filePath, *file.ModTime, *file.ModTime); err != nil {
+					logger.Warning("restored file ", err)
+				}
 			}
 		}
+		if r.progress != nil {
+			progress.FilesDone++
+			progress.BytesDone += file.Size
+			r.progress(progress)
+		}
+	}
+	if r.manifest != nil {
+		if err := writeManifest(r.manifest, manifest); err != nil {
+			return err
+		}
 	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be created, first: %w", failed, firstFailure)
+	}
+	if mismatch > 0 {
+		return fmt.Errorf("%d restored files do not match their checksum, first: %w", mismatch, firstMismatch)
+	}
+	return nil
 }
 
-func (r *Repo) Init() {
-	var wg sync.WaitGroup
+// checkDestination makes sure that restoring the given files into destination
+// does not write anything into the repo.
+func (r *Repo) checkDestination(destination string, files []File) error {
+	dest, err := filepath.Abs(destination)
+	if err != nil {
+		return err
+	}
+	repoPath := r.path
+	// the paths may go through symlinks
+	if real, err := filepath.EvalSymlinks(dest); err == nil {
+		dest = real
+	}
+	if real, err := filepath.EvalSymlinks(repoPath); err == nil {
+		repoPath = real
+	}
+	if isWithin(repoPath, dest) {
+		return fmt.Errorf("destination %s is inside the repo %s", destination, r.path)
+	}
+	if !isWithin(dest, repoPath) {
+		return nil
+	}
+	for _, f := range files {
+		if isWithin(repoPath, filepath.Join(dest, f.Path)) {
+			return fmt.Errorf("restoring %s into %s would write into the repo %s", f.Path, destination, r.path)
+		}
+	}
+	return nil
+}
+
+// isWithin tells if path is parent or one of its descendants.
+func isWithin(parent string, path string) bool {
+	rel, err := filepath.Rel(parent, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// SetRestoreResume makes a restore skip writing the files that already exist in
+// the destination with the right size and, if it has been recorded, the right
+// checksum. Their content is still read from the restore stream.
+func (r *Repo) SetRestoreResume(resume bool) {
+	r.resume = resume
+}
+
+// alreadyRestored tells if the file at the given path matches the given file
+// entry, so that it does not need to be restored again.
+func (r *Repo) alreadyRestored(path string, file File) bool {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != file.Size {
+		return false
+	}
+	return r.verifyFile(path, file) == nil
+}
+
+// verifyFile reads the file at the given path and compares its checksum
+// against the one recorded in the given file entry. Files committed without a
+// checksum are not verified.
+func (r *Repo) verifyFile(path string, file File) error {
+	if len(file.Sum) == 0 {
+		logger.Debug("no checksum recorded for ", file.Path)
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hasher := r.newChecksum()
+	if _, err = io.Copy(hasher, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(hasher.Sum(nil), file.Sum) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+// Init loads the versions of the repo along with the hashes, file list and
+// recipe of the latest one.
+// The fingerprints and sketches maps are only used to commit, so they are not
+// loaded by read-only repos.
+func (r *Repo) Init() error {
 	r.loadVersions()
-	wg.Add(3)
-	go r.loadHashes(r.versions, &wg)
-	go r.loadFileLists(r.versions, &wg)
-	go r.loadRecipes(r.versions, &wg)
-	wg.Wait()
+	return r.loadLists(r.versions, !r.readOnly)
+}
+
+// Versions returns the number of versions stored in the repo.
+func (r *Repo) Versions() int {
+	r.loadVersions()
+	return len(r.versions)
+}
+
+// VersionFiles returns the list of the files stored in the given version.
+// Negative versions count from the latest one.
+func (r *Repo) VersionFiles(version int) ([]File, error) {
+	r.loadVersions()
+	idx, err := r.versionIndex(version)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if _, err := loadDeltas(&files, r.versions[:idx+1], r.meta(), r.patcher, r.chunkReadWrapper, filesName); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// versionIndex resolves the given version number into an index of the loaded
+// versions. Negative numbers count backwards from the latest version, so that
+// -1 is the latest one, -2 the one before, etc.
+func (r *Repo) versionIndex(version int) (int, error) {
+	idx := version
+	if idx < 0 {
+		idx += len(r.versions)
+	}
+	if idx < 0 || idx >= len(r.versions) {
+		return 0, fmt.Errorf("version %d does not exist, repo has %d versions", version, len(r.versions))
+	}
+	return idx, nil
 }
 
 func (r *Repo) loadVersions() {
+	r.versions = nil
+	for _, version := range r.versionDirs() {
+		if isPruned(version) {
+			continue
+		}
+		r.versions = append(r.versions, version)
+	}
+}
+
+// versionDirs returns the paths of all the version directories of the repo,
+// including the pruned ones.
+func (r *Repo) versionDirs() (dirs []string) {
 	files, err := os.ReadDir(r.path)
 	if err != nil {
 		logger.Fatal(err)
@@ -244,30 +1027,61 @@ func (r *Repo) loadVersions() {
 		if !f.IsDir() {
 			continue
 		}
-		r.versions = append(r.versions, filepath.Join(r.path, f.Name()))
+		if _, err := strconv.Atoi(f.Name()); err != nil {
+			logger.Debug("skip non version dir ", f.Name())
+			continue
+		}
+		dirs = append(dirs, filepath.Join(r.path, f.Name()))
 	}
+	return
+}
+
+// versionNumber returns the number of the given version directory, which can be
+// greater than its index if older versions have been removed.
+func versionNumber(version string) int {
+	n, err := strconv.Atoi(filepath.Base(version))
+	if err != nil {
+		logger.Panicf("version dir %s: %s", version, err)
+	}
+	return n
+}
+
+// versionNumberAt returns the number of the version at the given index, or the
+// number of a new version if the index is past the last loaded version.
+func (r *Repo) versionNumberAt(idx int) int {
+	if idx < len(r.versions) {
+		return versionNumber(r.versions[idx])
+	}
+	if len(r.versions) == 0 {
+		return 0
+	}
+	return versionNumber(r.versions[len(r.versions)-1]) + 1
 }
 
 func listFiles(path string) []File {
+	return walkFiles(path, nil, logger.Warning)
+}
+
+// walkFiles lists the files under path, skipping the skip directory if it is
+// not nil and reporting with warn the ones that cannot be listed.
+func walkFiles(path string, skip fs.FileInfo, warn func(v ...interface{})) []File {
 	logger.Infof("list files from %s", path)
 	var files []File
 	err := filepath.Walk(path, func(p string, i fs.FileInfo, err error) error {
 		if err != nil {
-			logger.Warning(err)
+			warn(err)
 			return nil
 		}
 		if i.IsDir() {
+			if skip != nil && os.SameFile(i, skip) {
+				logger.Infof("skip repo directory %s", p)
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		var file = File{Path: p, Size: i.Size()}
-		if i.Mode()&fs.ModeSymlink != 0 {
-			file, err = cleanSymlink(path, p, i)
-			if err != nil {
-				logger.Warning("skipping symlink ", err)
-				return nil
-			}
+		if file, ok := newFile(path, p, i, warn); ok {
+			files = append(files, file)
 		}
-		files = append(files, file)
 		return nil
 	})
 	if err != nil {
@@ -276,6 +1090,66 @@ func listFiles(path string) []File {
 	return files
 }
 
+// permBits are the bits of the mode of a regular file that are restored.
+const permBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// fileModesFormat is the format of the file lists whose regular files hold
+// their mode, even when it is 0.
+const fileModesFormat = 2
+
+// legacyFileMode is the mode given to the regular files of the lists stored
+// before their mode was.
+const legacyFileMode fs.FileMode = 0644
+
+// setLegacyModes gives the legacy file mode to the regular files of a list
+// stored before their mode was.
+func setLegacyModes(files []File) {
+	for i := range files {
+		if files[i].isRegular() {
+			files[i].Mode = legacyFileMode
+		}
+	}
+}
+
+// newFile returns the entry of the file at p under root, of the given info.
+// It returns false if the file cannot be stored, after reporting it with warn.
+func newFile(root string, p string, i fs.FileInfo, warn func(v ...interface{})) (File, bool) {
+	var file = File{Path: p, Size: i.Size()}
+	var err error
+	if i.Mode()&fs.ModeSymlink != 0 {
+		file, err = cleanSymlink(root, p, i)
+		if err != nil {
+			warn("skipping symlink ", err)
+			return file, false
+		}
+	} else if !i.Mode().IsRegular() {
+		file, err = specialFile(p, i)
+		if err != nil {
+			warn("skipping special file ", err)
+			return file, false
+		}
+	} else {
+		file.Mode = i.Mode() & permBits
+		mtime := i.ModTime()
+		file.ModTime = &mtime
+	}
+	return file, true
+}
+
+// readFilesXattrs reads the extended attributes of the given regular files.
+func (r *Repo) readFilesXattrs(files []File) {
+	for i := range files {
+		if files[i].Link != "" {
+			continue
+		}
+		xattrs, err := readXattrs(files[i].Path)
+		if err != nil {
+			r.warn(err)
+		}
+		files[i].Xattrs = xattrs
+	}
+}
+
 func cleanSymlink(root string, p string, i fs.FileInfo) (f File, err error) {
 	dir := filepath.Dir(p)
 	target, err := os.Readlink(p)
@@ -309,17 +1183,28 @@ func cleanSymlink(root string, p string, i fs.FileInfo) (f File, err error) {
 	return f, nil
 }
 
-func unprefixFiles(files []File, prefix string) (ret []File) {
-	var err error
-	ret = make([]File, len(files))
+// unprefixFiles returns a copy of files with their paths made relative to
+// prefix. The paths keep a leading separator, so that they can be joined to any
+// destination. If prefix is the path of a file, its base name is used.
+//
+// An error is returned if any of the paths is not inside prefix.
+func unprefixFiles(files []File, prefix string) ([]File, error) {
+	ret := make([]File, len(files))
 	for i, f := range files {
-		if f.Path, err = utils.Unprefix(f.Path, prefix); err != nil {
-			logger.Warning(err)
-		} else {
-			ret[i] = f
+		rel, err := filepath.Rel(prefix, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%q is not inside %q", f.Path, prefix)
+		}
+		if rel == "." {
+			rel = filepath.Base(f.Path)
 		}
+		f.Path = string(filepath.Separator) + rel
+		ret[i] = f
 	}
-	return
+	return ret, nil
 }
 
 // concatFiles reads the content of all the listed files into a continuous stream.
@@ -327,49 +1212,86 @@ func unprefixFiles(files []File, prefix string) (ret []File) {
 // list.
 //
 // If read is incomplete, then the actual read size is used.
-func concatFiles(files *[]File, stream io.WriteCloser) {
+// The checksum of each file is computed on the fly from the streamed content.
+func (r *Repo) concatFiles(files *[]File, stream io.WriteCloser) {
+	var fetched []chan readAheadFile
+	var budget *byteBudget
+	if r.readWorkers > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		fetched, budget = r.readAhead(*files, done)
+	}
 	actual := make([]File, 0, len(*files))
-	for _, f := range *files {
-		if f.Link != "" {
-			actual = append(actual, f)
-			continue
+	for i, f := range *files {
+		if r.canceled() != nil {
+			// the commit is aborted, nothing more needs to be read
+			break
 		}
-		file, err := os.Open(f.Path)
-		if err != nil {
-			logger.Warning(err)
+		if !f.isRegular() {
+			actual = append(actual, f)
 			continue
 		}
 		af := f
-		if n, err := io.Copy(stream, file); err != nil {
-			logger.Error("read ", n, " bytes, ", err)
-			af.Size = n
+		hasher := r.newChecksum()
+		out := io.MultiWriter(stream, hasher)
+		var merkle *merkleHasher
+		if r.merkleRoots {
+			merkle = newMerkleHasher(r.newChecksum, r.chunkSize)
+			out = io.MultiWriter(out, merkle)
 		}
-		actual = append(actual, af)
-		if err = file.Close(); err != nil {
-			logger.Panic(err)
+		if fetched != nil && fetched[i] != nil {
+			content := <-fetched[i]
+			if content.openErr != nil {
+				budget.release(f.Size)
+				r.warn(content.openErr)
+				continue
+			}
+			n, err := out.Write(content.data)
+			budget.release(f.Size)
+			if err == nil {
+				err = content.err
+			}
+			if err != nil {
+				logger.Error("read ", n, " bytes, ", err)
+				atomic.AddInt64(&r.warnings, 1)
+				af.Size = int64(n)
+			}
+		} else {
+			file, err := os.Open(f.Path)
+			if err != nil {
+				r.warn(err)
+				continue
+			}
+			if n, err := io.Copy(out, file); err != nil {
+				logger.Error("read ", n, " bytes, ", err)
+				atomic.AddInt64(&r.warnings, 1)
+				af.Size = n
+			}
+			if err = file.Close(); err != nil {
+				logger.Panic(err)
+			}
+		}
+		endFile(stream)
+		af.Sum = hasher.Sum(nil)
+		if merkle != nil {
+			af.Merkle = merkle.Sum()
 		}
+		actual = append(actual, af)
 	}
-	stream.Close()
 	*files = actual
+	stream.Close()
 }
 
-func storeDelta(prevRaw []byte, curr interface{}, dest string, differ delta.Differ, wrapper utils.WriteWrapper) {
-	var prevBuff, currBuff bytes.Buffer
-	var encoder *gob.Encoder
-	var err error
-
-	prevBuff = *bytes.NewBuffer(prevRaw)
-	encoder = gob.NewEncoder(&currBuff)
-	if err = encoder.Encode(curr); err != nil {
-		logger.Panic(err)
-	}
+func storeDelta(prevRaw []byte, header listHeader, curr interface{}, store MetaStore, version string, name string, differ delta.Differ, wrapper utils.WriteWrapper) {
+	prevBuff := bytes.NewBuffer(prevRaw)
+	currBuff := encodeList(header, curr)
 	logger.Infof("store before delta: %d", currBuff.Len())
-	file, err := os.Create(dest)
+	file, err := store.WriteMeta(version, name)
 	if err != nil {
 		logger.Panic(err)
 	}
 	out := wrapper(file)
-	if err = differ.Diff(&prevBuff, &currBuff, out); err != nil {
+	if err = differ.Diff(prevBuff, currBuff, out); err != nil {
 		logger.Panic(err)
 	}
 	if err = out.Close(); err != nil {
@@ -380,138 +1302,423 @@ func storeDelta(prevRaw []byte, curr interface{}, dest string, differ delta.Diff
 	}
 }
 
-func readDelta(version string, name string, wrapper utils.ReadWrapper, callback func(io.ReadCloser)) {
+// encodeList encodes the given header, completed with the current listVersion,
+// followed by the list.
+func encodeList(header listHeader, list interface{}) *bytes.Buffer {
+	var buff bytes.Buffer
+	encoder := gob.NewEncoder(&buff)
+	header.Version = listVersion
+	if err := encoder.Encode(header); err != nil {
+		logger.Panic(err)
+	}
+	if err := encoder.Encode(list); err != nil {
+		logger.Panic(err)
+	}
+	return &buff
+}
+
+// readDelta opens the delta of the given version's list and hands it to the
+// callback. The returned errors have the path of the delta as context.
+func readDelta(store MetaStore, version string, name string, wrapper utils.ReadWrapper, callback func(io.ReadCloser)) error {
 	path := filepath.Join(version, name)
-	file, err := os.Open(path)
+	file, err := store.ReadMeta(version, name)
 	if err != nil {
-		logger.Panic(err)
+		return err
 	}
+	defer file.Close()
 	in, err := wrapper(file)
 	if err != nil {
-		logger.Panic(err)
+		return fmt.Errorf("%s: %w", path, err)
 	}
 	callback(in)
 	if err = in.Close(); err != nil {
-		logger.Panic(err)
+		return fmt.Errorf("%s: %w", path, err)
 	}
-	if err = file.Close(); err != nil {
-		logger.Panic(err)
+	return nil
+}
+
+// listNames gives a human readable name for each list stored as deltas.
+var listNames = map[string]string{
+	filesName:  "file list",
+	recipeName: "recipe",
+}
+
+// loadDeltas patches incrementally the deltas of the given versions' list and
+// decodes the result into target. The returned error tells which version of
+// the list is corrupt.
+func loadDeltas(target interface{}, versions []string, store MetaStore, patcher delta.Patcher, wrapper utils.ReadWrapper, name string) (ret []byte, err error) {
+	err = walkDeltas(versions, store, patcher, wrapper, name, func(_ int, raw []byte) error {
+		ret = raw
+		return nil
+	})
+	if err != nil || len(ret) == 0 {
+		return
+	}
+	last := versions[len(versions)-1]
+	if err = decodeList(ret, target); err != nil {
+		return nil, corruptListError(last, name, fmt.Errorf("%s: %w", filepath.Join(last, name), err))
 	}
+	return
 }
 
-func loadDeltas(target interface{}, versions []string, patcher delta.Patcher, wrapper utils.ReadWrapper, name string) (ret []byte) {
+// walkDeltas patches incrementally the deltas of the given versions' list and
+// calls callback with the index and the encoded list of each version, starting
+// from the last one that does not depend on the previous ones. It stops at the
+// first error returned by callback.
+func walkDeltas(versions []string, store MetaStore, patcher delta.Patcher, wrapper utils.ReadWrapper, name string, callback func(i int, raw []byte) error) error {
 	var prev bytes.Buffer
-	var err error
-	for _, v := range versions {
-		readDelta(v, name, wrapper, func(in io.ReadCloser) {
-			var curr bytes.Buffer
-			if err = patcher.Patch(&prev, &curr, in); err != nil {
-				logger.Panic(err)
+	start := 0
+	if name == filesName {
+		// a split file list does not depend on the previous ones
+		for i, v := range versions {
+			if hasSplitFiles(v) {
+				start = i
 			}
-			prev = curr
-		})
+		}
 	}
-	ret = prev.Bytes()
-	if len(ret) == 0 {
-		return
+	for i, v := range versions[start:] {
+		if name == filesName && hasSplitFiles(v) {
+			raw, err := loadSplitFiles(store, v, patcher, wrapper)
+			if err != nil {
+				return corruptListError(v, name, err)
+			}
+			prev = *bytes.NewBuffer(raw)
+		} else {
+			var perr error
+			err := readDelta(store, v, name, wrapper, func(in io.ReadCloser) {
+				var curr bytes.Buffer
+				perr = patcher.Patch(&prev, &curr, in)
+				prev = curr
+			})
+			if err == nil && perr != nil {
+				err = fmt.Errorf("%s: %w", filepath.Join(v, name), perr)
+			}
+			if err != nil {
+				return corruptListError(v, name, err)
+			}
+		}
+		if err := callback(start+i, prev.Bytes()); err != nil {
+			return err
+		}
 	}
-	decoder := gob.NewDecoder(&prev)
-	if err = decoder.Decode(target); err != nil {
-		logger.Panic(err)
+	return nil
+}
+
+func corruptListError(version string, name string, err error) error {
+	return &ListError{filepath.Base(version), listNames[name], err}
+}
+
+// listHeader is encoded before each list stored by storeDelta, so that a list
+// that cannot be entirely decoded is reported as such. Format tells how the
+// elements of the list are encoded, 0 being a plain gob encoding of the slice.
+// Version is the listVersion of the program that stored the list.
+type listHeader struct {
+	Count   int
+	Format  int
+	Version int
+}
+
+// listVersion must be incremented each time the stored types (File, Chunk
+// implementations...) change in a way that older lists cannot be decoded into.
+const listVersion = 1
+
+// decodeList decodes the list encoded in raw into target, which must be a
+// pointer to a slice. Lists stored without header are also supported.
+func decodeList(raw []byte, target interface{}) error {
+	decoder := gob.NewDecoder(bytes.NewReader(raw))
+	var header listHeader
+	if err := decoder.Decode(&header); err != nil {
+		if runs, isRuns := target.(*[]recipeRun); isRuns {
+			var recipe []Chunk
+			err = gob.NewDecoder(bytes.NewReader(raw)).Decode(&recipe)
+			*runs = collapseRecipeRuns(recipe)
+			return err
+		}
+		err = gob.NewDecoder(bytes.NewReader(raw)).Decode(target)
+		if files, isFiles := target.(*[]File); isFiles {
+			setLegacyModes(*files)
+		}
+		return err
 	}
-	return
+	// lists stored before the version was written are compatible with the first one
+	if header.Version == 0 {
+		header.Version = 1
+	}
+	if header.Version != listVersion {
+		return fmt.Errorf("%w: list version %d, supported %d", ErrIncompatibleFormat, header.Version, listVersion)
+	}
+	var err error
+	recipe, isRecipe := target.(*[]Chunk)
+	runs, isRuns := target.(*[]recipeRun)
+	files, isFiles := target.(*[]File)
+	switch {
+	case header.Format == fileModesFormat && isFiles:
+		err = decoder.Decode(files)
+	case header.Format == 0 && isFiles:
+		err = decoder.Decode(files)
+		setLegacyModes(*files)
+	case header.Format == recipeRunsFormat && isRecipe:
+		var runs []recipeRun
+		err = decoder.Decode(&runs)
+		*recipe = expandRecipeRuns(runs)
+	case header.Format == recipeRunsFormat && isRuns:
+		err = decoder.Decode(runs)
+	case header.Format == 0 && isRuns:
+		var recipe []Chunk
+		err = decoder.Decode(&recipe)
+		*runs = collapseRecipeRuns(recipe)
+	case header.Format == 0:
+		err = decoder.Decode(target)
+	default:
+		return fmt.Errorf("%w: unknown list format %d", ErrIncompatibleFormat, header.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("list of %d elements: %w", header.Count, err)
+	}
+	n := reflect.ValueOf(target).Elem().Len()
+	if isRuns {
+		n = recipeLen(*runs)
+	}
+	if n != header.Count {
+		return fmt.Errorf("list of %d elements, %d decoded", header.Count, n)
+	}
+	return nil
 }
 
 // storeFileList stores the given list in the repo dir as a delta against the
 // previous version's one.
 func (r *Repo) storeFileList(version int, list []File) {
 	logger.Info("store files")
-	dest := filepath.Join(r.path, fmt.Sprintf(versionFmt, version), filesName)
-	storeDelta(r.filesRaw, list, dest, r.differ, r.chunkWriteWrapper)
+	dir := r.versionDir(version)
+	if r.splitFiles && r.storeSplitFiles(dir, list) {
+		// in case the version has been appended to
+		os.Remove(filepath.Join(dir, filesName))
+		return
+	}
+	os.RemoveAll(filepath.Join(dir, filesDirName))
+	storeDelta(r.filesRaw, listHeader{Count: len(list), Format: fileModesFormat}, list, r.meta(), dir, filesName, r.differ, r.chunkWriteWrapper)
 }
 
 // loadFileLists loads incrementally the file lists' delta of each given version.
-func (r *Repo) loadFileLists(versions []string, wg *sync.WaitGroup) {
+func (r *Repo) loadFileLists(versions []string) (err error) {
 	logger.Info("load previous file lists")
 	var files []File
-	r.filesRaw = loadDeltas(&files, versions, r.patcher, r.chunkReadWrapper, filesName)
+	r.filesRaw, err = loadDeltas(&files, versions, r.meta(), r.patcher, r.chunkReadWrapper, filesName)
 	r.files = files
-	wg.Done()
+	return
 }
 
 // storageWorker is meant to be started in a goroutine and stores each new chunk's
 // data in the repo directory until the store queue channel is closed.
 //
 // it will put true in the end channel once everything is stored.
+//
+// If the version already has hashes, they are kept before the new ones.
 func (r *Repo) storageWorker(version int, storeQueue <-chan chunkData, end chan<- bool) {
-	hashesFile := filepath.Join(r.path, fmt.Sprintf(versionFmt, version), hashesName)
-	file, err := os.Create(hashesFile)
+	versionPath := r.versionDir(version)
+	var prev []chunkHashes
+	if hasMeta(r.meta(), versionPath, hashesName) {
+		readHashes(r.meta(), versionPath, func(_ uint64, h chunkHashes) { prev = append(prev, h) })
+	}
+	file, err := r.meta().WriteMeta(versionPath, hashesName)
+	if err != nil {
+		logger.Panic(err)
+	}
+	out, err := r.hashesWriter(file)
 	if err != nil {
 		logger.Panic(err)
 	}
-	encoder := gob.NewEncoder(file)
-	for data := range storeQueue {
-		err = encoder.Encode(data.hashes)
-		r.StoreChunkContent(data.id, bytes.NewReader(data.content))
+	encode, err := hashesFormats[r.hashesFormat](out)
+	if err != nil {
+		logger.Panic(err)
+	}
+	for _, h := range prev {
+		if err = encode(h); err != nil {
+			logger.Panic(err)
+		}
+	}
+	for stored := range r.storeChunks(storeQueue) {
+		data := stored.data
+		data.hashes.Raw = <-stored.raw
+		if err = encode(data.hashes); err != nil {
+			logger.Panic(err)
+		}
 		// logger.Debug("stored ", data.id)
 	}
+	if err = out.Close(); err != nil {
+		logger.Panic(err)
+	}
 	if err = file.Close(); err != nil {
 		logger.Panic(err)
 	}
 	end <- true
 }
 
-func (r *Repo) StoreChunkContent(id *ChunkId, reader io.Reader) {
-	path := id.Path(r.path)
-	file, err := os.Create(path)
-	if err != nil {
-		logger.Panic("chunk store ", err)
+// SetStoreConcurrency sets the number of chunks that can be stored at the same
+// time during a commit. Storing many chunks concurrently helps to hide the
+// latency of slow storages. The default is to store them one by one.
+func (r *Repo) SetStoreConcurrency(n int) {
+	r.storeConcurrency = n
+}
+
+// SetStoreQueueSize sets the number of new chunks that can wait to be stored
+// during a commit. A deeper queue keeps the matcher from stalling on a slow
+// storage, at the cost of holding more chunk contents in memory. The default
+// of 0 queues 32 chunks per store goroutine.
+func (r *Repo) SetStoreQueueSize(size int) {
+	r.storeQueueSize = size
+}
+
+// storeQueueDepth returns the capacity of the store queue.
+func (r *Repo) storeQueueDepth() int {
+	if r.storeQueueSize > 0 {
+		return r.storeQueueSize
+	}
+	if r.storeConcurrency > 1 {
+		return 32 * r.storeConcurrency
+	}
+	return 32
+}
+
+// storingChunk is a chunk whose content is being stored. raw receives whether
+// it has been stored raw once it is done.
+type storingChunk struct {
+	data chunkData
+	raw  chan bool
+}
+
+// storeChunks stores the content of the chunks of the queue using as many
+// goroutines as the store concurrency. The returned channel gives the chunks in
+// the order of the queue, so that their hashes can be written in this order.
+func (r *Repo) storeChunks(storeQueue <-chan chunkData) <-chan storingChunk {
+	workers := r.storeConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	ordered := make(chan storingChunk, workers)
+	jobs := make(chan storingChunk)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for s := range jobs {
+				if r.indexOnly {
+					s.raw <- false
+				} else {
+					raw := r.StoreChunkContent(s.data.id, bytes.NewReader(s.data.content))
+					if r.verifyOnWrite {
+						r.verifyWritten(s.data)
+					}
+					s.raw <- raw
+				}
+				r.pendingChunks.Delete(*s.data.id)
+			}
+		}()
+	}
+	go func() {
+		for data := range storeQueue {
+			s := storingChunk{data, make(chan bool, 1)}
+			ordered <- s
+			jobs <- s
+		}
+		close(jobs)
+		close(ordered)
+	}()
+	return ordered
+}
+
+// StoreChunkContent writes the content of a chunk into the repo directory.
+// If a raw threshold is set, the content is stored without going through the
+// write wrapper when the wrapped output is not small enough.
+//
+// It returns whether the content was stored raw. A failure to store it is
+// recorded as a ChunkError wrapping the cause and reported by the commit.
+func (r *Repo) StoreChunkContent(id *ChunkId, reader io.Reader) (raw bool) {
+	var rawBuff, wrappedBuff bytes.Buffer
+	if r.rawThreshold > 0 {
+		reader = io.TeeReader(reader, &rawBuff)
 	}
-	wrapper := r.chunkWriteWrapper(file)
+	wrapper := r.chunkWriteWrapper(&wrappedBuff)
 	n, err := io.Copy(wrapper, reader)
 	if err != nil {
 		logger.Errorf("chunk store, %d written, %s", n, err)
+		r.recordWriteError(&ChunkError{id, fmt.Errorf("store: %w", err)})
+		return
 	}
 	if err := wrapper.Close(); err != nil {
 		logger.Warning("chunk store wrapper ", err)
 	}
-	if err := file.Close(); err != nil {
-		logger.Warning("chunk store ", err)
+	out := &wrappedBuff
+	if r.rawThreshold > 0 && float64(wrappedBuff.Len()) >= r.rawThreshold*float64(rawBuff.Len()) {
+		logger.Debugf("store chunk %d raw", id)
+		out = &rawBuff
+		raw = true
+		r.rawChunks.Store(*id, true)
+	}
+	path := r.chunkPath(id)
+	err = r.retry("chunk store", func() error {
+		return writeFileAtomic(path, out.Bytes(), r.fileMode, r.fsync)
+	})
+	if err != nil {
+		logger.Error("chunk store ", err)
+		r.recordWriteError(&ChunkError{id, fmt.Errorf("store: %w", err)})
 	}
+	return
 }
 
 // LoadChunkContent loads a chunk from the repo directory.
-// If the chunk is in cache, get it from cache, else read it from drive.
-func (r *Repo) LoadChunkContent(id *ChunkId) *bytes.Reader {
-	value, exists := r.chunkCache.Get(id)
+// If the chunk is in cache, get it from cache, else if it is still waiting in
+// the store queue get it from there, else read it from drive. The returned
+// error is a ChunkError.
+func (r *Repo) LoadChunkContent(id *ChunkId) (*bytes.Reader, error) {
+	value, exists := r.chunkCache.Get(*id)
 	if !exists {
-		path := id.Path(r.path)
-		f, err := os.Open(path)
-		if err != nil {
-			logger.Panic("chunk load ", err)
+		if pending, isPending := r.pendingChunks.Load(*id); isPending {
+			return bytes.NewReader(pending.([]byte)), nil
 		}
-		wrapper, err := r.chunkReadWrapper(f)
+		var err error
+		value, err = r.readChunkContent(id)
 		if err != nil {
-			logger.Error("chunk load wrapper ", err)
-		}
-		value, err = io.ReadAll(wrapper)
-		if err != nil {
-			logger.Error("chunk load ", err)
-		}
-		if err = wrapper.Close(); err != nil {
-			logger.Warning("chunk load wrapper", err)
-		}
-		if err = f.Close(); err != nil {
-			logger.Warning("chunk load ", err)
+			return nil, err
 		}
-		r.chunkCache.Set(id, value)
+		r.chunkCache.Set(*id, value)
 	}
-	return bytes.NewReader(value)
+	return bytes.NewReader(value), nil
+}
+
+// readChunkContent reads the content of a chunk from the drive, bypassing the
+// cache.
+func (r *Repo) readChunkContent(id *ChunkId) ([]byte, error) {
+	path := r.chunkPath(id)
+	var stored []byte
+	err := r.retry("chunk load", func() (err error) {
+		stored, err = os.ReadFile(path)
+		return
+	})
+	if err != nil {
+		return nil, &ChunkError{id, err}
+	}
+	readWrapper := r.chunkReadWrapper
+	r.loadRawFlags(id.Ver)
+	if _, raw := r.rawChunks.Load(*id); raw {
+		readWrapper = utils.NopReadWrapper
+	}
+	wrapper, err := readWrapper(bytes.NewReader(stored))
+	if err != nil {
+		return nil, &ChunkError{id, &corruptError{fmt.Errorf("wrapper: %w", err)}}
+	}
+	value, err := io.ReadAll(wrapper)
+	if err != nil {
+		wrapper.Close()
+		return nil, &ChunkError{id, &corruptError{err}}
+	}
+	if err = wrapper.Close(); err != nil {
+		logger.Warning("chunk load wrapper", err)
+	}
+	return value, nil
 }
 
 // TODO: use atoi for chunkid ?
 func (r *Repo) loadChunks(versions []string) (chunks [][]IdentifiedChunk) {
-	for i, v := range versions {
+	for _, v := range versions {
 		vc := make([]IdentifiedChunk, 0)
 		p := filepath.Join(v, chunksName)
 		entries, err := os.ReadDir(p)
@@ -522,7 +1729,7 @@ func (r *Repo) loadChunks(versions []string) (chunks [][]IdentifiedChunk) {
 			if e.IsDir() {
 				continue
 			}
-			id := &ChunkId{Ver: i, Idx: uint64(j)}
+			id := &ChunkId{Ver: versionNumber(v), Idx: uint64(j)}
 			c := NewStoredChunk(r, id)
 			vc = append(vc, c)
 		}
@@ -532,36 +1739,371 @@ func (r *Repo) loadChunks(versions []string) (chunks [][]IdentifiedChunk) {
 }
 
 // loadHashes loads and aggregates the hashes stored for each given version and
-// stores them in the repo maps.
+// stores them in the repo maps. The hashes of the versions covered by the hash
+// index are loaded from it.
 func (r *Repo) loadHashes(versions []string, wg *sync.WaitGroup) {
 	logger.Info("load previous hashes")
-	for i, v := range versions {
-		path := filepath.Join(v, hashesName)
-		file, err := os.Open(path)
-		if err != nil {
-			logger.Error("hashes ", err)
+	r.fingerprints = make(FingerprintMap)
+	r.sketches = make(SketchMap)
+	start := 0
+	if r.hashSources == nil {
+		start = r.loadHashIndex(versions)
+	}
+	for i := start; i < len(versions); i++ {
+		if !r.isHashSource(i) || isIndexOnly(versions[i]) {
+			continue
 		}
-		decoder := gob.NewDecoder(file)
-		for j := 0; err == nil; j++ {
-			var h chunkHashes
-			if err = decoder.Decode(&h); err == nil {
-				id := &ChunkId{i, uint64(j)}
-				r.fingerprints[h.Fp] = id
-				r.sketches.Set(h.Sk, id)
+		var hashes []chunkHashes
+		readHashes(r.meta(), versions[i], func(_ uint64, h chunkHashes) { hashes = append(hashes, h) })
+		if err := checkChunkCount(versions[i], len(hashes)); err != nil {
+			// its chunks cannot be trusted to be complete
+			logger.Warning(err)
+			continue
+		}
+		ver := versionNumber(versions[i])
+		for j, h := range hashes {
+			id := &ChunkId{ver, uint64(j)}
+			r.fingerprints[h.Fp] = id
+			r.sketches.Set(h.Sk, id)
+			if h.Raw {
+				r.rawChunks.Store(*id, true)
 			}
 		}
-		if err != nil && err != io.EOF {
-			logger.Panic(err)
+	}
+	for _, v := range versions {
+		r.setRawLoaded(versionNumber(v))
+	}
+	wg.Done()
+}
+
+// checkChunkCount returns an ErrIncompleteVersion error if the number of chunk
+// files of the given version dir is not the given number of hashes.
+func checkChunkCount(version string, hashes int) error {
+	chunks, err := countChunks(version)
+	if err != nil {
+		return err
+	}
+	if chunks != hashes {
+		return fmt.Errorf("%w %d: %d chunks for %d hashes", ErrIncompleteVersion, versionNumber(version), chunks, hashes)
+	}
+	return nil
+}
+
+// countChunks returns the number of chunk files of the given version dir.
+func countChunks(version string) (chunks int, err error) {
+	entries, err := os.ReadDir(filepath.Join(version, chunksName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	for _, e := range entries {
+		if _, err := strconv.ParseUint(e.Name(), 10, 64); err == nil {
+			chunks++
 		}
-		if err = file.Close(); err != nil {
-			logger.Warning(err)
+	}
+	return chunks, nil
+}
+
+// loadRawFlags records which chunks of the given version are stored raw, if it
+// has not been done yet, either by this function or by loadHashes.
+func (r *Repo) loadRawFlags(version int) {
+	once, _ := r.rawLoaded.LoadOrStore(version, new(sync.Once))
+	once.(*sync.Once).Do(func() {
+		path := r.versionDir(version)
+		if !hasMeta(r.meta(), path, hashesName) {
+			logger.Debug("no raw flags loaded for version ", version)
+			return
+		}
+		readHashes(r.meta(), path, func(j uint64, h chunkHashes) {
+			if h.Raw {
+				r.rawChunks.Store(ChunkId{version, j}, true)
+			}
+		})
+	})
+}
+
+// setRawLoaded marks the raw flags of the given version as already loaded.
+func (r *Repo) setRawLoaded(version int) {
+	once, _ := r.rawLoaded.LoadOrStore(version, new(sync.Once))
+	once.(*sync.Once).Do(func() {})
+}
+
+// readHashes decodes the hashes file of the given version and calls callback
+// for each of its records, along with the index of the chunk it belongs to.
+func readHashes(store MetaStore, version string, callback func(idx uint64, h chunkHashes)) {
+	file, err := store.ReadMeta(version, hashesName)
+	if err != nil {
+		logger.Error("hashes ", err)
+	}
+	decode := newHashesDecoder(file)
+	for j := 0; err == nil; j++ {
+		var h chunkHashes
+		if err = decode(&h); err == nil {
+			callback(uint64(j), h)
 		}
 	}
-	wg.Done()
+	if err != nil && err != io.EOF {
+		logger.Panic(err)
+	}
+	if err = file.Close(); err != nil {
+		logger.Warning(err)
+	}
+}
+
+// SetVerifySample makes Verify only check a random sample of the given percent
+// of the chunks. The same seed always selects the same chunks, a seed of 0 is
+// replaced by a random one, which is logged. A percent of 0 or 100 checks all
+// the chunks.
+func (r *Repo) SetVerifySample(percent float64, seed int64) {
+	r.sample = percent
+	r.sampleSeed = seed
+}
+
+// ChunkStatus is the result of the verification of a chunk, Version being
+// the number of its version dir. Status is one of ok, corrupt and missing.
+type ChunkStatus struct {
+	Version int    `json:"version"`
+	Idx     uint64 `json:"idx"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// VerifySummary counts the chunks of a verification. Incomplete lists the
+// numbers of the version dirs whose count of chunks does not match their
+// hashes.
+type VerifySummary struct {
+	Chunks     int   `json:"chunks"`
+	Verified   int   `json:"verified"`
+	Passed     int   `json:"passed"`
+	Corrupt    int   `json:"corrupt"`
+	Missing    int   `json:"missing"`
+	Incomplete []int `json:"incomplete,omitempty"`
+}
+
+// VerifyReport holds the status of each verified chunk, ordered by version and
+// index, and the summary of the verification.
+type VerifyReport struct {
+	Chunks  []ChunkStatus `json:"chunks"`
+	Summary VerifySummary `json:"summary"`
+}
+
+// Verify checks the integrity of every chunk of the repo by comparing its
+// content against the hashes recorded when it was committed.
+// An error is returned if at least one chunk is missing or corrupt.
+func (r *Repo) Verify() error {
+	_, err := r.VerifyChunks()
+	return err
+}
+
+// VerifyChunks is like Verify, but also returns the report of the status of
+// each verified chunk.
+func (r *Repo) VerifyChunks() (report VerifyReport, err error) {
+	r.loadVersions()
+	var count, sampled, corrupt int
+	var first error
+	statuses := []ChunkStatus{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	type job struct {
+		id *ChunkId
+		h  chunkHashes
+	}
+	jobs := make(chan job)
+	for w := 0; w < r.chunkReaders(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				err := r.verifyChunk(j.id, j.h)
+				status := ChunkStatus{Version: j.id.Ver, Idx: j.id.Idx, Status: "ok"}
+				if err != nil {
+					logger.Error(err)
+					status.Status, status.Error = "corrupt", err.Error()
+					if errors.Is(err, fs.ErrNotExist) {
+						status.Status = "missing"
+					}
+				}
+				mutex.Lock()
+				statuses = append(statuses, status)
+				if err != nil {
+					if first == nil {
+						first = err
+					}
+					corrupt++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	var rng *rand.Rand
+	if r.sample > 0 && r.sample < 100 {
+		seed := r.sampleSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		logger.Infof("verify %g%% of the chunks sampled with seed %d", r.sample, seed)
+		rng = rand.New(rand.NewSource(seed))
+	}
+	var incomplete int
+	for i, v := range r.versions {
+		if isIndexOnly(v) {
+			logger.Infof("skip index-only version %d", i)
+			continue
+		}
+		var hashes int
+		readHashes(r.meta(), v, func(j uint64, h chunkHashes) {
+			hashes++
+			count++
+			if rng != nil && rng.Float64()*100 >= r.sample {
+				return
+			}
+			sampled++
+			id := &ChunkId{Ver: versionNumber(v), Idx: j}
+			if h.Raw {
+				r.rawChunks.Store(*id, true)
+			}
+			jobs <- job{id, h}
+		})
+		if err := checkChunkCount(v, hashes); err != nil {
+			logger.Error(err)
+			mutex.Lock()
+			if first == nil {
+				first = err
+			}
+			mutex.Unlock()
+			incomplete++
+			report.Summary.Incomplete = append(report.Summary.Incomplete, versionNumber(v))
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Version != statuses[j].Version {
+			return statuses[i].Version < statuses[j].Version
+		}
+		return statuses[i].Idx < statuses[j].Idx
+	})
+	report.Chunks = statuses
+	report.Summary.Chunks = count
+	report.Summary.Verified = sampled
+	report.Summary.Passed = sampled - corrupt
+	for _, s := range statuses {
+		if s.Status == "missing" {
+			report.Summary.Missing++
+		}
+	}
+	report.Summary.Corrupt = corrupt - report.Summary.Missing
+	logger.Infof("verified %d chunks out of %d, %d passed, %d corrupt", sampled, count, sampled-corrupt, corrupt)
+	if corrupt > 0 {
+		return report, fmt.Errorf("%d corrupt chunks out of %d verified, first: %w", corrupt, sampled, first)
+	}
+	if incomplete > 0 {
+		return report, fmt.Errorf("%d incomplete versions, first: %w", incomplete, first)
+	}
+	return report, nil
+}
+
+// verifyChunk reads the content of a chunk directly from the drive and checks
+// that it matches the given hashes. The checksum is only compared if it has
+// been recorded, as older repos did not store it.
+func (r *Repo) verifyChunk(id *ChunkId, h chunkHashes) error {
+	value, err := r.readChunkContent(id)
+	if err != nil {
+		return err
+	}
+	c := NewTempChunk(value)
+	hasher := rabinkarp64.NewFromPol(r.pol)
+	hasher.Write(value)
+	if hasher.Sum64() != h.Fp {
+		return &ChunkError{id, fmt.Errorf("%w: fingerprint mismatch", ErrCorruptChunk)}
+	}
+	if len(h.Sum) > 0 && !bytes.Equal(c.Checksum(r.newChecksum), h.Sum) {
+		return &ChunkError{id, fmt.Errorf("%w: checksum mismatch", ErrCorruptChunk)}
+	}
+	return nil
+}
+
+// SetSketchFeatureSize fixes the size in bytes of the features used to compute
+// the sketches, so that it does not depend on the chunk size anymore.
+// A size of 0 (the default) derives it from the chunk size. The size stored in
+// the config of an existing repo is kept, as sketches computed with another
+// one would never match the stored ones.
+func (r *Repo) SetSketchFeatureSize(size int) error {
+	if err := checkFeatureSize(size, r.sketchWSize, r.sketchFCount, r.chunkSize); err != nil {
+		return err
+	}
+	_, found, err := r.readConfig()
+	if err != nil {
+		return err
+	}
+	if found["sketchFeatureSize"] {
+		if size != 0 && size != r.featureSize() {
+			logger.Warningf("using sketch feature size %d of the repo config instead of %d", r.featureSize(), size)
+		}
+		return nil
+	}
+	r.sketchFSize = size
+	return nil
+}
+
+// checkFeatureSize returns an error if sketches cannot be computed with
+// features of size bytes, 0 meaning that it is derived from the chunk size.
+func checkFeatureSize(size int, wSize int, fCount int, chunkSize int) error {
+	if size == 0 {
+		return nil
+	}
+	if size < wSize {
+		return fmt.Errorf("sketch feature size %d is smaller than the window size %d", size, wSize)
+	}
+	if size*fCount > chunkSize {
+		return fmt.Errorf("sketch feature size %d is too big for %d features in chunks of %d bytes", size, fCount, chunkSize)
+	}
+	return nil
+}
+
+// featureSize returns the size in bytes of the features used to compute the
+// sketches.
+func (r *Repo) featureSize() int {
+	if r.sketchFSize > 0 {
+		return r.sketchFSize
+	}
+	return sketch.FeatureSize(r.chunkSize, r.sketchSfCount, r.sketchFCount)
+}
+
+// SetSketches enables (the default) or disables the computation of the
+// resemblance sketches of the new chunks. Without sketches no similar chunk can
+// be found, so no chunk is delta encoded, but commits use less CPU.
+func (r *Repo) SetSketches(enabled bool) {
+	r.noSketch = !enabled
+}
+
+// sketchChunk returns the sketch of the given chunk, or nil if the sketches
+// are disabled.
+func (r *Repo) sketchChunk(c Chunk) []uint64 {
+	if r.noSketch {
+		return nil
+	}
+	reader, err := c.Reader()
+	if err != nil {
+		logger.Error("sketch chunk ", err)
+		return nil
+	}
+	sk, _ := sketch.SketchChunk(reader, r.pol, r.featureSize(), r.sketchWSize, r.sketchSfCount, r.sketchFCount)
+	return sk
+}
+
+// prefixSketch returns the sketch of the first size bytes of a chunk from the
+// sketch of the whole chunk, as each superfeature only depends on the bytes of
+// its features.
+func (r *Repo) prefixSketch(sk []uint64, size int) []uint64 {
+	n := size / r.featureSize() / r.sketchFCount
+	if n > len(sk) {
+		n = len(sk)
+	}
+	return sk[:n]
 }
 
 func (r *Repo) chunkMinLen() int {
-	return sketch.SuperFeatureSize(r.chunkSize, r.sketchSfCount, r.sketchFCount)
+	return r.featureSize() * r.sketchSfCount
 }
 
 func contains(s []*ChunkId, id *ChunkId) bool {
@@ -604,11 +2146,24 @@ func (r *Repo) findSimilarChunk(sketch []uint64) (*ChunkId, bool) {
 // encodeTempChunk first tries to delta-encode the given chunk before attributing
 // it an Id and saving it into the fingerprints and sketches maps.
 func (r *Repo) encodeTempChunk(temp BufferedChunk, version int, last *uint64, storeQueue chan<- chunkData) (Chunk, bool) {
-	sk, _ := sketch.SketchChunk(temp.Reader(), r.pol, r.chunkSize, r.sketchWSize, r.sketchSfCount, r.sketchFCount)
+	return r.encodeSketchedChunk(temp, r.sketchChunk(temp), version, last, storeQueue)
+}
+
+// encodeSketchedChunk is encodeTempChunk for a chunk whose sketch is known.
+func (r *Repo) encodeSketchedChunk(temp BufferedChunk, sk []uint64, version int, last *uint64, storeQueue chan<- chunkData) (Chunk, bool) {
+	if temp.Len() == r.chunkSize && isUniform(temp.Bytes()) {
+		// stored whole so that the rest of a run of the same byte matches its
+		// fingerprint, instead of each chunk of the run being delta encoded
+		return r.storeNewChunk(temp, sk, version, last, storeQueue), false
+	}
 	id, found := r.findSimilarChunk(sk)
 	if found {
 		var buff bytes.Buffer
-		if err := r.differ.Diff(r.LoadChunkContent(id), temp.Reader(), &buff); err != nil {
+		source, err := r.LoadChunkContent(id)
+		if err == nil {
+			err = r.differ.Diff(source, bytes.NewReader(temp.Bytes()), &buff)
+		}
+		if err != nil {
 			logger.Error("trying delta encode chunk:", temp, "with source:", id, ":", err)
 		} else {
 			logger.Debugf("add new delta chunk of size %d", len(buff.Bytes()))
@@ -621,26 +2176,46 @@ func (r *Repo) encodeTempChunk(temp BufferedChunk, version int, last *uint64, st
 		}
 	}
 	if temp.Len() == r.chunkSize {
-		id := &ChunkId{Ver: version, Idx: *last}
-		*last++
-		hasher := rabinkarp64.NewFromPol(r.pol)
-		io.Copy(hasher, temp.Reader())
-		fp := hasher.Sum64()
-		r.fingerprints[fp] = id
-		r.sketches.Set(sk, id)
-		storeQueue <- chunkData{
-			hashes:  chunkHashes{fp, sk},
-			content: temp.Bytes(),
-			id:      id,
-		}
-		r.chunkCache.Set(id, temp.Bytes())
-		logger.Debug("add new chunk ", id)
-		return NewStoredChunk(r, id), false
+		return r.storeNewChunk(temp, sk, version, last, storeQueue), false
 	}
 	logger.Debug("add new partial chunk of size: ", temp.Len())
 	return temp, false
 }
 
+// isUniform returns true if data is made of a single repeated byte.
+func isUniform(data []byte) bool {
+	for _, b := range data {
+		if b != data[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// storeNewChunk attributes an Id to the given full-sized chunk, saves it into
+// the fingerprints and sketches maps and sends it to the store queue.
+func (r *Repo) storeNewChunk(temp BufferedChunk, sk []uint64, version int, last *uint64, storeQueue chan<- chunkData) *StoredChunk {
+	id := &ChunkId{Ver: version, Idx: *last}
+	*last++
+	hasher := rabinkarp64.NewFromPol(r.pol)
+	hasher.Write(temp.Bytes())
+	fp := hasher.Sum64()
+	r.fingerprints[fp] = id
+	if !r.indexOnly {
+		// the content of index-only chunks cannot be used as delta source
+		r.sketches.Set(sk, id)
+	}
+	r.pendingChunks.Store(*id, temp.Bytes())
+	storeQueue <- chunkData{
+		hashes:  chunkHashes{Fp: fp, Sk: sk, Sum: temp.Checksum(r.newChecksum)},
+		content: temp.Bytes(),
+		id:      id,
+	}
+	r.chunkCache.Set(*id, temp.Bytes())
+	logger.Debug("add new chunk ", id)
+	return NewStoredChunk(r, id)
+}
+
 // encodeTempChunks encodes the current temporary chunks based on the value of the previous one.
 // Temporary chunks can be partial. If the current chunk is smaller than the size of a
 // super-feature and there exists a previous chunk, then both are merged before attempting
@@ -651,16 +2226,72 @@ func (r *Repo) encodeTempChunks(prev BufferedChunk, curr BufferedChunk, version
 		return []Chunk{c}
 	} else if curr.Len() < r.chunkMinLen() {
 		tmp := NewTempChunk(append(prev.Bytes(), curr.Bytes()...))
-		c, success := r.encodeTempChunk(tmp, version, last, storeQueue)
+		sk := r.sketchChunk(tmp)
+		c, success := r.encodeSketchedChunk(tmp, sk, version, last, storeQueue)
 		if success {
 			return []Chunk{c}
 		}
+		// prev does not need to be sketched again
+		prevD, _ := r.encodeSketchedChunk(prev, r.prefixSketch(sk, prev.Len()), version, last, storeQueue)
+		currD, _ := r.encodeTempChunk(curr, version, last, storeQueue)
+		return []Chunk{prevD, currD}
 	}
 	prevD, _ := r.encodeTempChunk(prev, version, last, storeQueue)
 	currD, _ := r.encodeTempChunk(curr, version, last, storeQueue)
 	return []Chunk{prevD, currD}
 }
 
+// SetPlainTail makes the commits store the trailing partial chunk of their
+// stream as is, instead of trying to delta-encode it, which is rarely worth it
+// for such a small chunk.
+func (r *Repo) SetPlainTail(plain bool) {
+	r.plainTail = plain
+}
+
+// coalesceTempChunks merges runs of adjacent temporary chunks of the recipe.
+// Chunks are appended to the current merged chunk until it reaches minSize,
+// after which a new one is started.
+func coalesceTempChunks(recipe []Chunk, minSize int) []Chunk {
+	var coalesced []Chunk
+	var merged *TempChunk
+	for _, c := range recipe {
+		temp, isTemp := c.(*TempChunk)
+		if !isTemp {
+			coalesced = append(coalesced, c)
+			merged = nil
+			continue
+		}
+		if merged == nil || merged.Len() >= minSize {
+			merged = NewTempChunk(append([]byte(nil), temp.Value...))
+			coalesced = append(coalesced, merged)
+			continue
+		}
+		merged.Value = append(merged.Value, temp.Value...)
+	}
+	return coalesced
+}
+
+// recordMatchError records the read error that stopped the matching of a
+// stream, unless one has already been recorded, so that the commit can report
+// it.
+func (r *Repo) recordMatchError(err error) {
+	logger.Error(err)
+	r.matchErrMutex.Lock()
+	defer r.matchErrMutex.Unlock()
+	if r.matchErr == nil {
+		r.matchErr = err
+	}
+}
+
+// matchError returns and clears the error recorded by recordMatchError.
+func (r *Repo) matchError() error {
+	r.matchErrMutex.Lock()
+	defer r.matchErrMutex.Unlock()
+	err := r.matchErr
+	r.matchErr = nil
+	return err
+}
+
 // matchStream is the heart of DNA-backup. Thus, it sounded rude not to add some comment to it.
 //
 // It applies a rolling hash on the content of a given stream to look for matching fingerprints
@@ -680,18 +2311,25 @@ func (r *Repo) matchStream(stream io.Reader, storeQueue chan<- chunkData, versio
 	var err error
 	bufStream := bufio.NewReaderSize(stream, r.chunkSize*2)
 	buff := make([]byte, r.chunkSize, r.chunkSize*2)
-	if n, err := io.ReadFull(stream, buff); n < r.chunkSize {
-		if err == io.ErrUnexpectedEOF {
+	// ReadFull keeps reading until the buffer is full, whatever the size of
+	// the reads of the stream is.
+	if n, err := io.ReadFull(bufStream, buff); n < r.chunkSize {
+		switch err {
+		case io.EOF:
+			return chunks, last
+		case io.ErrUnexpectedEOF:
 			c, _ := r.encodeTempChunk(NewTempChunk(buff[:n]), version, &last, storeQueue)
 			chunks = append(chunks, c)
 			return chunks, last
-		} else {
-			logger.Panicf("matching stream, read only %d bytes with error '%s'", n, err)
+		default:
+			r.recordMatchError(fmt.Errorf("matching stream, read only %d bytes: %w", n, err))
+			io.Copy(io.Discard, bufStream)
+			return chunks, last
 		}
 	}
 	hasher := rabinkarp64.NewFromPol(r.pol)
 	hasher.Write(buff)
-	for err != io.EOF {
+	for err == nil {
 		h := hasher.Sum64()
 		chunkId, exists := r.fingerprints[h]
 		if exists {
@@ -710,7 +2348,7 @@ func (r *Repo) matchStream(stream io.Reader, storeQueue chan<- chunkData, versio
 			buff = make([]byte, 0, r.chunkSize*2)
 			for i := 0; i < r.chunkSize && err == nil; i++ {
 				b, err = bufStream.ReadByte()
-				if err != io.EOF {
+				if err == nil {
 					hasher.Roll(b)
 					buff = append(buff, b)
 				}
@@ -728,11 +2366,16 @@ func (r *Repo) matchStream(stream io.Reader, storeQueue chan<- chunkData, versio
 			copy(buff, tmp)
 		}
 		b, err = bufStream.ReadByte()
-		if err != io.EOF {
+		if err == nil {
 			hasher.Roll(b)
 			buff = append(buff, b)
 		}
 	}
+	if err != io.EOF {
+		r.recordMatchError(fmt.Errorf("matching stream: %w", err))
+		io.Copy(io.Discard, bufStream)
+		return chunks, last
+	}
 	if len(buff) > 0 {
 		var temp *TempChunk
 		if len(buff) > r.chunkSize {
@@ -745,37 +2388,183 @@ func (r *Repo) matchStream(stream io.Reader, storeQueue chan<- chunkData, versio
 		} else {
 			temp = NewTempChunk(buff)
 		}
-		chunks = append(chunks, r.encodeTempChunks(prev, temp, version, &last, storeQueue)...)
+		if r.plainTail && temp.Len() < r.chunkSize {
+			if prev != nil {
+				chunk, _ := r.encodeTempChunk(prev, version, &last, storeQueue)
+				chunks = append(chunks, chunk)
+			}
+			chunks = append(chunks, temp)
+		} else {
+			chunks = append(chunks, r.encodeTempChunks(prev, temp, version, &last, storeQueue)...)
+		}
 	}
 	return chunks, last
 }
 
-func (r *Repo) restoreStream(stream io.WriteCloser, recipe []Chunk) {
-	for _, c := range recipe {
-		if n, err := io.Copy(stream, c.Reader()); err != nil {
+// restoreStream writes the content of each chunk of the recipe into the stream.
+// The runs of the recipe are expanded while it is restored.
+//
+// The source of a delta chunk is always a stored chunk that is loaded by id from
+// the storage of its version, and never from the recipe. Therefore a delta can
+// be restored even if its source comes later in the recipe, which happens when
+// the source has been stored by a previous matcher pass of the same version.
+func (r *Repo) restoreStream(stream io.WriteCloser, runs []recipeRun) {
+	var ahead chan struct{}
+	recipe := r.newRecipeStream(runs)
+	if _, nop := r.chunkCache.(cache.NopCache); r.prefetch > 0 && !nop {
+		ahead = make(chan struct{}, r.prefetch)
+		done := make(chan struct{})
+		// the prefetcher must not wait for a consumer that stopped early
+		defer close(done)
+		go r.prefetchChunks(recipe.rewind(), ahead, done)
+	}
+	for c, ok := recipe.Next(); ok; c, ok = recipe.Next() {
+		if r.canceled() != nil {
+			break
+		}
+		var n int64
+		reader, err := c.Reader()
+		if err == nil {
+			n, err = io.Copy(stream, reader)
+		}
+		if errors.Is(err, io.ErrClosedPipe) {
+			// the reader of the stream stopped reading
+			break
+		} else if err != nil {
 			logger.Errorf("copying to stream, read %d bytes from chunk: %s", n, err)
+			closeWithError(stream, err)
+			return
 		}
+		if ahead != nil {
+			<-ahead
+		}
+	}
+	stream.Close()
+}
+
+// closeWithError closes stream so that its reader fails with err, if it is able
+// to, like a pipe.
+func closeWithError(stream io.WriteCloser, err error) {
+	if pipe, isPipe := stream.(interface{ CloseWithError(error) error }); isPipe {
+		pipe.CloseWithError(err)
+		return
 	}
 	stream.Close()
 }
 
+// prefetchChunks concurrently loads into the cache the chunks needed by each
+// entry of the recipe. It puts a token in the ahead channel before each entry,
+// so that it does not get further than its capacity ahead of the consumer. The
+// number of chunks loaded at the same time is bounded by the read concurrency.
+// It stops once done is closed. The chunks that cannot be loaded are skipped, as
+// their error is reported when they are actually read.
+func (r *Repo) prefetchChunks(recipe *recipeStream, ahead chan<- struct{}, done <-chan struct{}) {
+	slots := r.readSlots()
+	for c, ok := recipe.Next(); ok; c, ok = recipe.Next() {
+		select {
+		case ahead <- struct{}{}:
+		case <-done:
+			return
+		}
+		var id *ChunkId
+		switch c := c.(type) {
+		case *StoredChunk:
+			id = c.Id
+		case *DeltaChunk:
+			id = c.Source
+		default:
+			continue
+		}
+		if _, exists := r.chunkCache.Get(*id); !exists {
+			if slots == nil {
+				go r.prefetchChunk(id)
+				continue
+			}
+			slots <- struct{}{}
+			go func() {
+				defer func() { <-slots }()
+				r.prefetchChunk(id)
+			}()
+		}
+	}
+}
+
+// prefetchChunk loads the content of the given chunk into the cache, unless it
+// cannot be read.
+func (r *Repo) prefetchChunk(id *ChunkId) {
+	value, err := r.readChunkContent(id)
+	if err != nil {
+		logger.Debug("prefetch ", err)
+		return
+	}
+	r.chunkCache.Set(*id, value)
+}
+
 func (r *Repo) storeRecipe(version int, recipe []Chunk) {
 	logger.Info("store recipe")
-	dest := filepath.Join(r.path, fmt.Sprintf(versionFmt, version), recipeName)
-	storeDelta(r.recipeRaw, recipe, dest, r.differ, r.chunkWriteWrapper)
+	header := listHeader{Count: len(recipe), Format: recipeRunsFormat}
+	storeDelta(r.recipeRaw, header, collapseRecipeRuns(recipe), r.meta(), r.versionDir(version), recipeName, r.differ, r.chunkWriteWrapper)
 }
 
-func (r *Repo) loadRecipes(versions []string, wg *sync.WaitGroup) {
+func (r *Repo) loadRecipes(versions []string) (err error) {
 	logger.Info("load previous recipies")
 	var recipe []Chunk
-	r.recipeRaw = loadDeltas(&recipe, versions, r.patcher, r.chunkReadWrapper, recipeName)
+	r.recipeRaw, err = loadDeltas(&recipe, versions, r.meta(), r.patcher, r.chunkReadWrapper, recipeName)
+	r.setRecipeRepo(recipe)
+	r.recipe = recipe
+	return
+}
+
+// loadLists loads the hashes, if needed, the file lists and the recipes of the
+// given versions concurrently.
+func (r *Repo) loadLists(versions []string, hashes bool) error {
+	var wg sync.WaitGroup
+	var filesErr, recipeErr error
+	wg.Add(2)
+	if hashes {
+		wg.Add(1)
+		go r.loadHashes(versions, &wg)
+	}
+	go func() {
+		defer wg.Done()
+		filesErr = r.loadFileLists(versions)
+	}()
+	go func() {
+		defer wg.Done()
+		recipeErr = r.loadRecipes(versions)
+	}()
+	wg.Wait()
+	if filesErr != nil {
+		return filesErr
+	}
+	return recipeErr
+}
+
+// loadRestoreLists concurrently loads the file lists of the given versions and
+// the recipe of the last one as runs, which is all that is needed to restore it.
+func (r *Repo) loadRestoreLists(versions []string) (runs []recipeRun, err error) {
+	var wg sync.WaitGroup
+	var filesErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		filesErr = r.loadFileLists(versions)
+	}()
+	runs, err = r.loadRecipeRuns(versions)
+	wg.Wait()
+	if filesErr != nil {
+		return nil, filesErr
+	}
+	return
+}
+
+// setRecipeRepo sets the repo of every chunk of the recipe that needs one.
+func (r *Repo) setRecipeRepo(recipe []Chunk) {
 	for _, c := range recipe {
 		if rc, isRepo := c.(RepoChunk); isRepo {
 			rc.SetRepo(r)
 		}
 	}
-	r.recipe = recipe
-	wg.Done()
 }
 
 func extractDeltaChunks(chunks []Chunk) (ret []*DeltaChunk) {
@@ -19,17 +19,30 @@ package repo
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/chmduquesne/rollinghash/rabinkarp64"
+	"github.com/n-peugnet/dna-backup/cache"
 	"github.com/n-peugnet/dna-backup/delta"
 	"github.com/n-peugnet/dna-backup/logger"
 	"github.com/n-peugnet/dna-backup/sketch"
@@ -54,7 +67,7 @@ func chunkCompare(t *testing.T, dataDir string, repo *Repo, testFiles []string,
 	reader, writer := io.Pipe()
 	chunks := make(chan []byte)
 	files := listFiles(dataDir)
-	go concatFiles(&files, writer)
+	go repo.concatFiles(&files, writer)
 	go repo.chunkStream(reader, chunks)
 
 	offset := 0
@@ -137,7 +150,11 @@ func storeChunks(dest string, chunks <-chan []byte) {
 // stored in an hashmap.
 func (r *Repo) hashChunks(chunks []IdentifiedChunk) {
 	for _, c := range chunks {
-		r.hashChunk(c.GetId(), c.Reader())
+		reader, err := c.Reader()
+		if err != nil {
+			logger.Panic(err)
+		}
+		r.hashChunk(c.GetId(), reader)
 	}
 }
 
@@ -169,7 +186,7 @@ func (r *Repo) makeFingerprint(id *ChunkId, reader io.Reader, wg *sync.WaitGroup
 
 func (r *Repo) makeSketch(id *ChunkId, reader io.Reader, wg *sync.WaitGroup, ret *[]uint64) {
 	defer wg.Done()
-	*ret, _ = sketch.SketchChunk(reader, r.pol, r.chunkSize, r.sketchWSize, r.sketchSfCount, r.sketchFCount)
+	*ret, _ = sketch.SketchChunk(reader, r.pol, r.featureSize(), r.sketchWSize, r.sketchSfCount, r.sketchFCount)
 }
 
 func TestReadFiles1(t *testing.T) {
@@ -261,8 +278,8 @@ func TestLoadChunks(t *testing.T) {
 	chunks1 := make(chan []byte, 16)
 	chunks2 := make(chan []byte, 16)
 	files := listFiles(dataDir)
-	go concatFiles(&files, writer1)
-	go concatFiles(&files, writer2)
+	go repo.concatFiles(&files, writer1)
+	go repo.concatFiles(&files, writer2)
 	go repo.chunkStream(reader1, chunks1)
 	go repo.chunkStream(reader2, chunks2)
 	storeChunks(resultChunks, chunks1)
@@ -272,7 +289,7 @@ func TestLoadChunks(t *testing.T) {
 	i := 0
 	for c2 := range chunks2 {
 		c3 := chunks3[0][i]
-		buff, err := io.ReadAll(c3.Reader())
+		buff, err := io.ReadAll(mustReader(t, c3))
 		if err != nil {
 			t.Errorf("Error reading from chunk %d: %s\n", c3, err)
 		}
@@ -310,7 +327,7 @@ func TestBsdiff(t *testing.T) {
 	addedFile1 := filepath.Join(dataDir, "2", "slogTest.log")
 	addedFile2 := filepath.Join(dataDir, "3", "slogTest.log")
 	// Store initial chunks
-	prepareChunks(dataDir, repo, concatFiles)
+	prepareChunks(dataDir, repo, repo.concatFiles)
 
 	// Modify data
 	ioutil.WriteFile(addedFile1, []byte("hello"), 0664)
@@ -332,7 +349,7 @@ func TestBsdiff(t *testing.T) {
 	newVersion := len(repo.versions)
 	newPath := filepath.Join(repo.path, fmt.Sprintf(versionFmt, newVersion))
 	os.MkdirAll(newPath, 0775)
-	reader := getDataStream(dataDir, concatFiles)
+	reader := getDataStream(dataDir, repo.concatFiles)
 	storeQueue := make(chan chunkData, 10)
 	storeEnd := make(chan bool)
 	go repo.storageWorker(newVersion, storeQueue, storeEnd)
@@ -410,13 +427,13 @@ func TestHashes(t *testing.T) {
 	repo1.versions = []string{filepath.Join(source, "00000")}
 	chunks := repo1.loadChunks(repo1.versions)
 	for _, c := range chunks[0] {
-		fp, sk := repo1.hashChunk(c.GetId(), c.Reader())
-		content, err := io.ReadAll(c.Reader())
+		fp, sk := repo1.hashChunk(c.GetId(), mustReader(t, c))
+		content, err := io.ReadAll(mustReader(t, c))
 		if err != nil {
 			t.Error(err)
 		}
 		storeQueue <- chunkData{
-			hashes:  chunkHashes{fp, sk},
+			hashes:  chunkHashes{Fp: fp, Sk: sk, Sum: c.Checksum(repo1.newChecksum)},
 			content: content,
 			id:      c.GetId(),
 		}
@@ -479,16 +496,3851 @@ func assertCompatibleRepoFile(t *testing.T, expected string, actual string, pref
 		// testutils.AssertSame(t, eRecipe, aRecipe, prefix+"recipe")
 	} else if filepath.Base(expected) == hashesName {
 		// Hashes file is checked in TestHashes
+	} else if filepath.Base(expected) == indexName {
+		// Hash index is checked in TestHashIndex
+	} else if filepath.Base(expected) == versionsName {
+		// Versions index entries are compared without their commit time
+		assertSameVersionsIndex(t, filepath.Dir(expected), filepath.Dir(actual), prefix)
+	} else if filepath.Base(expected) == digestName {
+		// Digest of the file list, it does not depend on the chunking
+		testutils.AssertSameFile(t, expected, actual, prefix)
 	} else {
 		// Chunk content file
 		testutils.AssertSameFile(t, expected, actual, prefix)
 	}
 }
 
+func assertSameVersionsIndex(t *testing.T, expected string, actual string, prefix string) {
+	eEntries, err := (&Repo{path: expected}).readVersionsIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aEntries, err := (&Repo{path: actual}).readVersionsIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entries := range []map[int]VersionEntry{eEntries, aEntries} {
+		for v, e := range entries {
+			e.Time = time.Time{}
+			entries[v] = e
+		}
+	}
+	testutils.AssertSame(t, eEntries, aEntries, prefix+" versions index")
+}
+
+// mustReader returns the reader of the content of c, failing the test if it
+// cannot be read.
+func mustReader(t testing.TB, c Chunk) io.ReadSeeker {
+	reader, err := c.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
 func assertChunkContent(t *testing.T, expected []byte, c Chunk, prefix string) {
-	buf, err := io.ReadAll(c.Reader())
+	buf, err := io.ReadAll(mustReader(t, c))
 	if err != nil {
 		t.Fatal(err)
 	}
 	testutils.AssertSame(t, expected, buf, prefix+" Chunk content")
 }
+
+func TestVerify(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	repo1 := NewRepo(dest, 8<<10)
+	repo1.Commit(source)
+
+	if err := NewRepo(dest, 8<<10).Verify(); err != nil {
+		t.Fatal("verify of a fresh repo should succeed, actual:", err)
+	}
+	id := &ChunkId{Ver: 0, Idx: 1}
+	f, err := os.Create(id.Path(dest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := utils.ZlibWriter(f)
+	w.Write([]byte("corrupted"))
+	w.Close()
+	f.Close()
+	if err := NewRepo(dest, 8<<10).Verify(); !errors.Is(err, ErrCorruptChunk) {
+		t.Error("verify of a corrupted repo should fail, actual:", err)
+	}
+	repo2 := NewRepo(dest, 8<<10)
+	repo2.SetChunkReadConcurrency(4)
+	if err := repo2.Verify(); !errors.Is(err, ErrCorruptChunk) {
+		t.Error("concurrent verify of a corrupted repo should fail, actual:", err)
+	}
+}
+
+func TestReadTruncatedChunk(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	dest := t.TempDir()
+	NewRepo(dest, 8<<10).Commit(filepath.Join("testdata", "logs"))
+	id := &ChunkId{Ver: 0, Idx: 1}
+	stored, err := os.ReadFile(id.Path(dest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(id.Path(dest), stored[:len(stored)/2], 0664)
+
+	content, err := NewReadOnlyRepo(dest, 8<<10).readChunkContent(id)
+	if !errors.Is(err, ErrCorruptChunk) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("reading a truncated chunk should fail, actual:", err)
+	}
+	testutils.AssertLen(t, 0, content, "Content of a truncated chunk")
+	var chunkErr *ChunkError
+	if errors.As(err, &chunkErr) {
+		testutils.AssertSame(t, *id, *chunkErr.Id, "Id of the truncated chunk")
+	}
+	if err := NewReadOnlyRepo(dest, 8<<10).Verify(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("verify of a truncated chunk should report its read error, actual:", err)
+	}
+}
+
+func TestVerifyChunks(t *testing.T) {
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	dest := t.TempDir()
+	NewRepo(dest, 8<<10).Commit(filepath.Join("testdata", "logs"))
+	os.WriteFile((&ChunkId{Ver: 0, Idx: 1}).Path(dest), []byte("corrupted"), 0664)
+	os.Remove((&ChunkId{Ver: 0, Idx: 2}).Path(dest))
+
+	report, err := NewRepo(dest, 8<<10).VerifyChunks()
+	if !errors.Is(err, ErrCorruptChunk) {
+		t.Error("verify of a corrupted repo should fail, actual:", err)
+	}
+	summary := report.Summary
+	testutils.AssertLen(t, summary.Verified, report.Chunks, "Chunk statuses")
+	testutils.AssertSame(t, summary.Chunks, summary.Verified, "Verified chunks")
+	testutils.AssertSame(t, summary.Verified-2, summary.Passed, "Passed chunks")
+	testutils.AssertSame(t, 1, summary.Corrupt, "Corrupt chunks")
+	testutils.AssertSame(t, 1, summary.Missing, "Missing chunks")
+	testutils.AssertSame(t, []int{0}, summary.Incomplete, "Incomplete versions")
+	for i, expected := range []string{"ok", "corrupt", "missing", "ok"} {
+		status := report.Chunks[i]
+		testutils.AssertSame(t, uint64(i), status.Idx, "Index of status")
+		testutils.AssertSame(t, expected, status.Status, fmt.Sprint("Status of chunk ", i))
+		if (status.Error == "") != (expected == "ok") {
+			t.Errorf("chunk %d with status %s has error %q", i, expected, status.Error)
+		}
+	}
+}
+
+func TestChunkChecksum(t *testing.T) {
+	dest := t.TempDir()
+	repo := NewRepo(dest, 8<<10)
+	content := []byte("some chunk content")
+	temp := NewTempChunk(content)
+	id := &ChunkId{Ver: 0, Idx: 0}
+	os.MkdirAll(filepath.Join(dest, "00000", chunksName), 0775)
+	repo.StoreChunkContent(id, bytes.NewReader(content))
+	stored := NewStoredChunk(repo, id)
+	testutils.AssertSame(t, temp.Checksum(repo.newChecksum), stored.Checksum(repo.newChecksum), "Checksums")
+	testutils.AssertSame(t, temp.Checksum(repo.newChecksum), temp.Checksum(repo.newChecksum), "Checksums")
+}
+
+func TestRestoreVerify(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	repo1 := NewRepo(temp, 8<<10)
+	repo1.Commit(source)
+	repo2 := NewRepo(temp, 8<<10)
+	repo2.SetRestoreVerify(true)
+	if err := repo2.Restore(dest); err != nil {
+		t.Fatal("restore verification should succeed, actual:", err)
+	}
+	for _, f := range repo2.files {
+		if len(f.Sum) == 0 {
+			t.Error("file should have a recorded checksum:", f.Path)
+		}
+	}
+	file := repo2.files[0]
+	path := filepath.Join(dest, file.Path)
+	if err := repo2.verifyFile(path, file); err != nil {
+		t.Error("restored file should be valid, actual:", err)
+	}
+	os.WriteFile(path, []byte("altered"), 0664)
+	if err := repo2.verifyFile(path, file); err == nil {
+		t.Error("altered file should not be valid")
+	}
+}
+
+func TestExportRepo(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	exported := t.TempDir()
+	dest := t.TempDir()
+	source1 := filepath.Join("testdata", "logs")
+	source2 := filepath.Join("testdata", "logs", "2")
+	NewRepo(temp, 8<<10).Commit(source1)
+	NewRepo(temp, 8<<10).Commit(source2)
+
+	if err := NewRepo(temp, 8<<10).ExportRepo(0, exported); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRepo(temp, 8<<10).ExportRepo(0, exported); err == nil {
+		t.Error("export into a non empty repo should fail")
+	}
+	if err := NewRepo(temp, 8<<10).ExportRepo(2, t.TempDir()); err == nil {
+		t.Error("export of a non existing version should fail")
+	}
+	out := NewRepo(exported, 8<<10)
+	out.Init()
+	testutils.AssertLen(t, 1, out.versions, "Exported versions")
+	out.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source1, dest, "Export")
+}
+
+func TestExportRepoInvalidDestination(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	NewRepo(temp, 8<<10).Commit(filepath.Join("testdata", "logs", "1"))
+
+	locked := t.TempDir()
+	unlock, err := NewRepo(locked, 8<<10).lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if err := NewRepo(temp, 8<<10).ExportRepo(0, locked); !errors.Is(err, ErrRepoLocked) {
+		t.Error("export into a locked repo should fail, actual:", err)
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRepo(temp, 8<<10).ExportRepo(0, file); err == nil {
+		t.Error("export into a file should fail")
+	}
+}
+
+func TestSketchFeatureSize(t *testing.T) {
+	repo4k := NewRepo(t.TempDir(), 4<<10)
+	repo8k := NewRepo(t.TempDir(), 8<<10)
+	if repo4k.featureSize() == repo8k.featureSize() {
+		t.Error("default feature size should depend on the chunk size")
+	}
+	if err := repo4k.SetSketchFeatureSize(512); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo8k.SetSketchFeatureSize(512); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 512, repo4k.featureSize(), "Feature size")
+	testutils.AssertSame(t, 512*repo8k.sketchSfCount, repo8k.chunkMinLen(), "Chunk min len")
+	content, err := os.ReadFile(filepath.Join("testdata", "logs", "3", "indexingTreeTest.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sk4k := repo4k.hashChunk(&ChunkId{}, bytes.NewReader(content[:4<<10]))
+	_, sk8k := repo8k.hashChunk(&ChunkId{}, bytes.NewReader(content[:4<<10]))
+	testutils.AssertLen(t, 2, sk4k, "Sketch")
+	testutils.AssertSame(t, sk4k, sk8k, "Sketches")
+
+	for _, size := range []int{16, 2 << 10} {
+		if err := repo4k.SetSketchFeatureSize(size); err == nil {
+			t.Errorf("feature size %d should be rejected for 4k chunks", size)
+		}
+	}
+	small := NewRepo(t.TempDir(), 8<<10)
+	small.SetSketchFeatureSize(64)
+	_, sk := small.hashChunk(&ChunkId{}, bytes.NewReader(content[:8<<10]))
+	testutils.AssertLen(t, small.sketchSfCount, sk, "Sketch of small features")
+
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	if err := repo8k.Commit(filepath.Join("testdata", "logs", "1")); err != nil {
+		t.Fatal(err)
+	}
+	existing := NewRepo(repo8k.path, 8<<10)
+	if err := existing.SetSketchFeatureSize(256); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 512, existing.featureSize(), "Feature size of the config")
+}
+
+func TestRoundtripNoCache(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	repo1 := NewRepo(temp, 8<<10)
+	repo1.SetCacheSize(0)
+	repo1.Commit(source)
+	repo2 := NewRepo(temp, 8<<10)
+	repo2.SetCacheSize(0)
+	repo2.Restore(dest)
+	testutils.AssertSame(t, 0, repo2.chunkCache.Len(), "Cache len")
+
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestAppend(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source1 := filepath.Join("testdata", "logs", "1")
+	source2 := filepath.Join("testdata", "logs", "2")
+	NewRepo(temp, 8<<10).Append(source1)
+	NewRepo(temp, 8<<10).Append(source2)
+	repo := NewRepo(temp, 8<<10)
+	repo.loadVersions()
+	testutils.AssertLen(t, 1, repo.versions, "Versions")
+	testutils.AssertSame(t, 0, repo.partialVersion(), "Partial version")
+	repo.Finalize()
+	repo.loadVersions()
+	testutils.AssertSame(t, 1, repo.partialVersion(), "Partial version")
+
+	NewRepo(temp, 8<<10).Restore(dest)
+	testutils.AssertSameFile(t, filepath.Join(source1, "logTest.log"), filepath.Join(dest, "logTest.log"), "Append")
+	testutils.AssertSameFile(t, filepath.Join(source2, "slipdb.log"), filepath.Join(dest, "slipdb.log"), "Append")
+	testutils.AssertSameFile(t, filepath.Join(source2, "csvParserTest.log"), filepath.Join(dest, "csvParserTest.log"), "Append")
+	if err := NewRepo(temp, 8<<10).Verify(); err != nil {
+		t.Error(err)
+	}
+
+	NewRepo(temp, 8<<10).Commit(source1)
+	repo.loadVersions()
+	testutils.AssertLen(t, 2, repo.versions, "Versions")
+}
+
+func TestUnprefixFiles(t *testing.T) {
+	sep := string(filepath.Separator)
+	root := filepath.Join(sep+"tmp", "source")
+	files := []File{
+		{Path: filepath.Join(root, "a")},
+		{Path: filepath.Join(root, "dir", "b")},
+	}
+	expected := []File{
+		{Path: sep + "a"},
+		{Path: sep + filepath.Join("dir", "b")},
+	}
+	for _, prefix := range []string{root, root + sep, root + sep + sep} {
+		actual, err := unprefixFiles(files, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertSame(t, expected, actual, "Unprefixed files with prefix "+prefix)
+	}
+	actual, err := unprefixFiles(files[:1], files[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, expected[:1], actual, "Unprefixed single file")
+	for _, prefix := range []string{filepath.Join(root, "dir"), root + "2"} {
+		if _, err := unprefixFiles(files, prefix); err == nil {
+			t.Error("unprefix should fail with prefix", prefix)
+		}
+	}
+}
+
+func TestCommitSymlinkedSource(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source, err := filepath.Abs(filepath.Join("testdata", "logs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(filepath.Dir(source), link); err != nil {
+		t.Skip("symlinks not supported: ", err)
+	}
+	linked := filepath.Join(link, "logs") + string(filepath.Separator)
+	if err := NewRepo(temp, 8<<10).Commit(linked); err != nil {
+		t.Fatal(err)
+	}
+	NewRepo(temp, 8<<10).Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestProgress(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	var events []Progress
+	repo1 := NewRepo(temp, 8<<10)
+	repo1.SetProgress(func(p Progress) { events = append(events, p) })
+	repo1.Commit(source)
+	if len(events)%4 != 0 {
+		t.Fatal("Each matcher pass should report 4 events, actual:", events)
+	}
+	testutils.AssertSame(t, Progress{"commit", 4, 4, 119398, 119398}, events[3], "Last commit event")
+
+	var buff bytes.Buffer
+	repo2 := NewRepo(temp, 8<<10)
+	repo2.SetProgress(JsonProgress(&buff))
+	repo2.Restore(dest)
+	lines := strings.Split(strings.TrimSpace(buff.String()), "\n")
+	testutils.AssertLen(t, 4, lines, "Restore events")
+	expected := `{"phase":"restore","filesDone":4,"filesTotal":4,"bytesDone":119398,"bytesTotal":119398}`
+	testutils.AssertSame(t, expected, lines[3], "Last restore event")
+}
+
+func TestRoundtripPrefetch(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	NewRepo(temp, 8<<10).Commit(source)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetPrefetch(4)
+	repo.Restore(dest)
+
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestPrefetchStopped(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	NewRepo(temp, 8<<10).Commit(filepath.Join("testdata", "logs"))
+	repo := NewRepo(temp, 8<<10)
+	repo.loadVersions()
+	runs, err := repo.loadRecipeRuns(repo.versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// with nobody consuming the tokens, no chunk load is ever started
+	ahead, done := make(chan struct{}), make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		repo.prefetchChunks(repo.newRecipeStream(runs), ahead, done)
+		close(stopped)
+	}()
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prefetcher should stop once done is closed")
+	}
+}
+
+// slowReadWrapper simulates a high-latency storage.
+func slowReadWrapper(r io.Reader) (io.ReadCloser, error) {
+	time.Sleep(time.Millisecond)
+	return utils.ZlibReader(r)
+}
+
+// prepareDeltaRecipe commits the test logs and returns a recipe in which each
+// stored chunk is followed by a delta chunk against it.
+func prepareDeltaRecipe(b *testing.B) *Repo {
+	logger.SetLevel(1)
+	temp := b.TempDir()
+	NewRepo(temp, 8<<10).Commit(filepath.Join("testdata", "logs"))
+	repo := NewRepo(temp, 8<<10)
+	repo.Init()
+	var recipe []Chunk
+	for _, c := range repo.loadChunks(repo.versions)[0] {
+		var patch bytes.Buffer
+		content, err := io.ReadAll(mustReader(b, c))
+		if err != nil {
+			b.Fatal(err)
+		}
+		target := append([]byte("delta"), content...)
+		repo.differ.Diff(mustReader(b, c), bytes.NewReader(target), &patch)
+		recipe = append(recipe, c, &DeltaChunk{repo, c.GetId(), patch.Bytes(), len(target)})
+	}
+	repo.recipe = recipe
+	repo.chunkReadWrapper = slowReadWrapper
+	return repo
+}
+
+func benchmarkRestoreStream(b *testing.B, prefetch int) {
+	defer logger.SetLevel(4)
+	repo := prepareDeltaRecipe(b)
+	repo.SetPrefetch(prefetch)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		repo.SetCacheSize(10000)
+		repo.restoreStream(utils.NopCloser(io.Discard), collapseRecipeRuns(repo.recipe))
+	}
+}
+
+func BenchmarkRestoreStreamNoPrefetch(b *testing.B) {
+	benchmarkRestoreStream(b, 0)
+}
+
+func BenchmarkRestoreStreamPrefetch(b *testing.B) {
+	benchmarkRestoreStream(b, 16)
+}
+
+func slowWriteWrapper(w io.Writer) io.WriteCloser {
+	time.Sleep(time.Millisecond)
+	return utils.ZlibWriter(w)
+}
+
+// benchmarkChunkReadConcurrency runs the given read-heavy operation on a repo of
+// random chunks stored on a simulated high-latency storage.
+func benchmarkChunkReadConcurrency(b *testing.B, n int, run func(*Repo)) {
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	temp := b.TempDir()
+	source := b.TempDir()
+	content := make([]byte, 64*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	for i := 0; i < b.N; i++ {
+		// deriving the polynomial of the repo takes longer than the reads
+		b.StopTimer()
+		repo := NewReadOnlyRepo(temp, 8<<10)
+		repo.chunkReadWrapper = slowReadWrapper
+		repo.SetChunkReadConcurrency(n)
+		b.StartTimer()
+		run(repo)
+	}
+}
+
+func verifyRepo(r *Repo) {
+	r.Verify()
+}
+
+func restoreRepo(r *Repo) {
+	dest, _ := os.MkdirTemp("", "restore")
+	defer os.RemoveAll(dest)
+	r.Restore(dest)
+}
+
+func BenchmarkVerifyReadConcurrency1(b *testing.B) {
+	benchmarkChunkReadConcurrency(b, 1, verifyRepo)
+}
+
+func BenchmarkVerifyReadConcurrency8(b *testing.B) {
+	benchmarkChunkReadConcurrency(b, 8, verifyRepo)
+}
+
+func BenchmarkRestoreReadConcurrency1(b *testing.B) {
+	benchmarkChunkReadConcurrency(b, 1, restoreRepo)
+}
+
+func BenchmarkRestoreReadConcurrency8(b *testing.B) {
+	benchmarkChunkReadConcurrency(b, 8, restoreRepo)
+}
+
+func benchmarkCommitStoreQueue(b *testing.B, size int) {
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	source := filepath.Join("testdata", "logs")
+	for i := 0; i < b.N; i++ {
+		repo := NewRepo(b.TempDir(), 8<<10)
+		repo.chunkWriteWrapper = slowWriteWrapper
+		repo.SetStoreQueueSize(size)
+		repo.Commit(source)
+	}
+}
+
+func BenchmarkCommitStoreQueue1(b *testing.B) {
+	benchmarkCommitStoreQueue(b, 1)
+}
+
+func BenchmarkCommitStoreQueue32(b *testing.B) {
+	benchmarkCommitStoreQueue(b, 32)
+}
+
+func BenchmarkCommitStoreQueue256(b *testing.B) {
+	benchmarkCommitStoreQueue(b, 256)
+}
+
+func BenchmarkCommitSimilar(b *testing.B) {
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	source := b.TempDir()
+	base := make([]byte, 8*8<<10)
+	rand.Read(base)
+	for i := 0; i < 32; i++ {
+		// copies of the base with a new chunk followed by a small insertion,
+		// which have to be delta-encoded together before being stored apart
+		content := append([]byte(nil), base...)
+		k := i % 7 * 8 << 10
+		rand.Read(content[k : k+8<<10])
+		content = append(content[:k+8<<10], append([]byte("insert"), content[k+8<<10:]...)...)
+		os.WriteFile(filepath.Join(source, fmt.Sprintf("%02d", i)), content, 0664)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewRepo(b.TempDir(), 8<<10).Commit(source)
+	}
+}
+
+func TestPrefixSketch(t *testing.T) {
+	repo := NewRepo(t.TempDir(), 8<<10)
+	content := make([]byte, 8<<10+500)
+	rand.Read(content)
+	whole := repo.sketchChunk(NewTempChunk(content))
+	for _, size := range []int{8 << 10, 8<<10 - 1, 3000, 10} {
+		expected := repo.sketchChunk(NewTempChunk(content[:size]))
+		testutils.AssertSame(t, expected, repo.prefixSketch(whole, size), fmt.Sprint("Sketch of ", size, " bytes"))
+	}
+}
+
+func TestExportRepoBranch(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	branch := filepath.Join(t.TempDir(), "branch")
+	source1 := filepath.Join("testdata", "logs", "1")
+	source2 := filepath.Join("testdata", "logs", "2")
+	NewRepo(temp, 8<<10).Commit(source1)
+	NewRepo(temp, 8<<10).Commit(source2)
+
+	if err := NewReadOnlyRepo(temp, 8<<10).ExportRepo(0, branch); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(branch, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source1, dest, "Branch restore")
+
+	// the branch continues independently
+	if err := NewRepo(branch, 8<<10).Commit(source2); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 2, NewReadOnlyRepo(branch, 8<<10).Versions(), "Branch versions")
+	testutils.AssertSame(t, 2, NewReadOnlyRepo(temp, 8<<10).Versions(), "Source versions")
+	dest = t.TempDir()
+	if err := NewReadOnlyRepo(branch, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source2, dest, "Branch second restore")
+	if err := NewReadOnlyRepo(branch, 8<<10).Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	NewRepo(temp, 8<<10).Commit(source)
+	before, after, err := NewRepo(temp, 8<<10).Compact(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Deltas == 0 {
+		t.Fatal("test data should produce delta chunks")
+	}
+	testutils.AssertSame(t, 1, before.MaxDepth, "Max depth before")
+	testutils.AssertSame(t, before.Chunks, after.Chunks, "Chunks after")
+	testutils.AssertSame(t, 0, after.Deltas, "Deltas after")
+	testutils.AssertSame(t, 0, after.MaxDepth, "Max depth after")
+	if after.RepoBytes <= before.RepoBytes {
+		t.Errorf("repo should be larger after compaction: %d <= %d", after.RepoBytes, before.RepoBytes)
+	}
+
+	repo := NewRepo(temp, 8<<10)
+	repo.Restore(dest)
+	testutils.AssertLen(t, 2, repo.versions, "Versions")
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	if err := NewRepo(temp, 8<<10).Verify(); err != nil {
+		t.Error(err)
+	}
+
+	if _, _, err := NewRepo(temp, 8<<10).Compact(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	repo.loadVersions()
+	testutils.AssertLen(t, 2, repo.versions, "Versions after useless compaction")
+}
+
+func TestCompactDepth(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 5*8<<10)
+	rand.Read(content)
+	path := filepath.Join(source, "file")
+	for i := 0; i < 3; i++ {
+		content[20000+i] ^= 0xff
+		os.WriteFile(path, content, 0664)
+		NewRepo(temp, 8<<10).Commit(source)
+	}
+	before, after, err := NewRepo(temp, 8<<10).Compact(math.Inf(1), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 3, before.MaxDepth, "Max depth before")
+	testutils.AssertSame(t, before, after, "Stats after useless compaction")
+
+	before, after, err = NewRepo(temp, 8<<10).Compact(math.Inf(1), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 1, before.Deltas, "Deltas before")
+	testutils.AssertSame(t, 0, after.Deltas, "Deltas after")
+	repo := NewRepo(temp, 8<<10)
+	repo.Restore(dest)
+	testutils.AssertLen(t, 4, repo.versions, "Versions")
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	if _, err := os.Stat(filepath.Join(repo.versions[3], digestName)); err != nil {
+		t.Error("compacted version should have a digest: ", err)
+	}
+}
+
+func TestRawThreshold(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := t.TempDir()
+	random := make([]byte, 5*8<<10)
+	rand.Read(random)
+	os.WriteFile(filepath.Join(source, "random"), random, 0664)
+	logs, _ := os.ReadFile(filepath.Join("testdata", "logs", "2", "slipdb.log"))
+	os.WriteFile(filepath.Join(source, "zlogs"), logs, 0664)
+
+	repo1 := NewRepo(temp, 8<<10)
+	repo1.SetRawThreshold(0.95)
+	repo1.Commit(source)
+	var raw, compressed int
+	readHashes(repo1.meta(), filepath.Join(temp, "00000"), func(j uint64, h chunkHashes) {
+		if h.Raw {
+			raw++
+		} else {
+			compressed++
+		}
+	})
+	testutils.AssertSame(t, 5, raw, "Raw chunks")
+	if compressed == 0 {
+		t.Error("compressible chunks should not be stored raw")
+	}
+	NewRepo(temp, 8<<10).Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	if err := NewRepo(temp, 8<<10).Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := filepath.Join("testdata", "logs", "1")
+	repo1 := NewRepo(temp, 4<<10)
+	repo1.differ = delta.Bsdiff{}
+	repo1.patcher = delta.Bsdiff{}
+	repo1.Commit(source)
+	repo2 := NewRepo(temp, 8<<10)
+	testutils.AssertSame(t, 4<<10, repo2.chunkSize, "Chunk size from config")
+	testutils.AssertSame(t, delta.Differ(delta.Bsdiff{}), repo2.differ, "Differ from config")
+
+	if err := os.WriteFile(filepath.Join(temp, configName), []byte(`{"seed": 2}`), 0664); err != nil {
+		t.Fatal(err)
+	}
+	params, err := NewRepo(temp, 8<<10).ConfigParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 13, params, "Params")
+	for _, p := range params {
+		testutils.AssertSame(t, p.Name == "seed", p.FromConfig, "From config "+p.Name)
+	}
+	testutils.AssertSame(t, "chunkSize", params[0].Name, "First param")
+	testutils.AssertSame(t, "8192", params[0].Value, "Default chunk size")
+}
+
+func TestCoalesceTempChunks(t *testing.T) {
+	stored := &StoredChunk{Id: &ChunkId{0, 0}}
+	recipe := []Chunk{
+		NewTempChunk([]byte("ab")),
+		NewTempChunk([]byte("cd")),
+		NewTempChunk([]byte("ef")),
+		stored,
+		NewTempChunk([]byte("gh")),
+	}
+	coalesced := coalesceTempChunks(recipe, 4)
+	testutils.AssertLen(t, 4, coalesced, "Coalesced recipe")
+	testutils.AssertSame(t, []byte("abcd"), coalesced[0].(*TempChunk).Value, "First merged chunk")
+	testutils.AssertSame(t, []byte("ef"), coalesced[1].(*TempChunk).Value, "Second merged chunk")
+	testutils.AssertSame(t, Chunk(stored), coalesced[2], "Stored chunk")
+	testutils.AssertSame(t, []byte("ab"), recipe[0].(*TempChunk).Value, "Original chunk")
+}
+
+func TestRoundtripCoalesce(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	repo1 := NewRepo(temp, 8<<10)
+	repo1.SetCoalesceSize(8 << 10)
+	repo1.Commit(source)
+	repo2 := NewRepo(temp, 8<<10)
+	repo2.Restore(dest)
+	for i := 1; i < len(repo2.recipe); i++ {
+		_, prevTemp := repo2.recipe[i-1].(*TempChunk)
+		_, currTemp := repo2.recipe[i].(*TempChunk)
+		if prevTemp && currTemp && repo2.recipe[i-1].Len() < 8<<10 {
+			t.Errorf("temp chunk %d should have been coalesced", i)
+		}
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestReadOnlyRepo(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	NewRepo(temp, 8<<10).Commit(source)
+	before := listFiles(temp)
+
+	repo := NewReadOnlyRepo(temp, 8<<10)
+	repo.Restore(dest)
+	if err := repo.Verify(); err != nil {
+		t.Error(err)
+	}
+	testutils.AssertSame(t, ErrReadOnly, repo.Commit(source), "Commit error")
+	testutils.AssertSame(t, ErrReadOnly, repo.Finalize(), "Finalize error")
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	testutils.AssertSame(t, before, listFiles(temp), "Repo files")
+
+	missing := filepath.Join(temp, "missing")
+	if _, err := OpenReadOnlyRepo(missing, 8<<10); err == nil {
+		t.Error("read-only open of a missing repo should fail")
+	}
+	if _, err := os.Stat(missing); err == nil {
+		t.Error("read-only open should not create the repo directory")
+	}
+}
+
+func TestOpenRepoErrors(t *testing.T) {
+	for name, config := range map[string]string{
+		"syntax": `{"chunkSize": `,
+		"delta":  `{"delta": "xdelta"}`,
+		"codec":  `{"compression": "lzma"}`,
+	} {
+		temp := t.TempDir()
+		os.WriteFile(filepath.Join(temp, configName), []byte(config), 0664)
+		if _, err := OpenRepo(temp, 8<<10); err == nil {
+			t.Errorf("open with wrong %s config should fail", name)
+		}
+	}
+	if _, err := OpenRepo(t.TempDir(), 8<<10); !errors.Is(err, ErrNotRepo) {
+		t.Error("open of an empty directory should fail, actual:", err)
+	}
+}
+
+func TestCreateRepo(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	repo, err := CreateRepo(temp, 8<<10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Commit(filepath.Join("testdata", "logs", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateRepo(temp, 8<<10, false); !errors.Is(err, ErrRepoExists) {
+		t.Error("create of an existing repo should fail, actual:", err)
+	}
+	if _, err := CreateRepo(temp, 8<<10, true); err != nil {
+		t.Error("forced create of an existing repo should open it, actual:", err)
+	}
+	if _, err := OpenReadOnlyRepo(temp, 8<<10); err != nil {
+		t.Error(err)
+	}
+	// repos written before the config was introduced only have versions
+	os.Remove(filepath.Join(temp, configName))
+	if _, err := OpenRepo(temp, 8<<10); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChecksumAlgo(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs", "1")
+	repo1 := NewRepo(temp, 8<<10)
+	if err := repo1.SetChecksumAlgo("unknown"); err == nil {
+		t.Error("unknown checksum algorithm should be rejected")
+	}
+	if err := repo1.SetChecksumAlgo("crc64"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo1.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	repo2 := NewRepo(temp, 8<<10)
+	testutils.AssertSame(t, "crc64", repo2.checksumAlgo, "Checksum algorithm from config")
+	repo2.SetRestoreVerify(true)
+	if err := repo2.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 8, repo2.files[0].Sum, "File checksum")
+	if err := repo2.Verify(); err != nil {
+		t.Error(err)
+	}
+	repo2.SetChecksumAlgo("sha256")
+	if err := repo2.Commit(source); err == nil {
+		t.Error("mixing checksum algorithms should be rejected")
+	}
+}
+
+func TestDeltaSourceOrder(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	NewRepo(temp, 8<<10).Commit(source)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetCacheSize(0)
+	repo.Init()
+
+	stored := make(map[ChunkId]int)
+	for i, c := range repo.recipe {
+		if s, isStored := c.(*StoredChunk); isStored {
+			if _, exists := stored[*s.Id]; !exists {
+				stored[*s.Id] = i
+			}
+		}
+	}
+	var deltas int
+	for i, c := range repo.recipe {
+		d, isDelta := c.(*DeltaChunk)
+		if !isDelta {
+			continue
+		}
+		deltas++
+		if d.Source.Ver > 0 {
+			t.Errorf("delta %d references chunk %d of a later version", i, *d.Source)
+		}
+		if _, err := os.Stat(d.Source.Path(temp)); err != nil {
+			t.Errorf("delta %d source: %s", i, err)
+		}
+		if j, exists := stored[*d.Source]; exists && j > i {
+			logger.Debugf("delta %d precedes its source at %d", i, j)
+		}
+	}
+	if deltas == 0 {
+		t.Fatal("test data should produce delta chunks")
+	}
+
+	// restoring must not depend on the order of the recipe
+	contents := make([][]byte, len(repo.recipe))
+	for i, c := range repo.recipe {
+		contents[i], _ = io.ReadAll(mustReader(t, c))
+	}
+	reversedRepo := NewRepo(temp, 8<<10)
+	reversedRepo.SetCacheSize(0)
+	reversedRepo.Init()
+	reversed := make([]Chunk, len(reversedRepo.recipe))
+	var expected bytes.Buffer
+	for i := range reversed {
+		reversed[i] = reversedRepo.recipe[len(reversed)-1-i]
+		expected.Write(contents[len(reversed)-1-i])
+	}
+	var actual bytes.Buffer
+	reversedRepo.restoreStream(utils.NopCloser(&actual), collapseRecipeRuns(reversed))
+	testutils.AssertSame(t, expected.Bytes(), actual.Bytes(), "Reversed restore")
+}
+
+func TestRetry(t *testing.T) {
+	logger.SetLevel(0)
+	defer logger.SetLevel(4)
+	repo := NewRepo(t.TempDir(), 8<<10)
+	repo.SetRetry(3, time.Millisecond)
+	transient := errors.New("transient")
+	var calls int
+	err := repo.retry("test", func() error {
+		calls++
+		if calls < 3 {
+			return transient
+		}
+		return nil
+	})
+	testutils.AssertSame(t, nil, err, "Error after retries")
+	testutils.AssertSame(t, 3, calls, "Calls")
+
+	calls = 0
+	err = repo.retry("test", func() error {
+		calls++
+		return transient
+	})
+	testutils.AssertSame(t, transient, err, "Error after max attempts")
+	testutils.AssertSame(t, 3, calls, "Calls")
+
+	calls = 0
+	_, err = repo.readChunkContent(&ChunkId{0, 0})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Error("missing chunk error should be returned, actual:", err)
+	}
+	err = repo.retry("test", func() error {
+		calls++
+		return &fs.PathError{Op: "open", Path: "chunk", Err: fs.ErrNotExist}
+	})
+	testutils.AssertSame(t, 1, calls, "Calls on permanent error")
+}
+
+func TestDedupReport(t *testing.T) {
+	stored0 := &StoredChunk{Id: &ChunkId{0, 0}}
+	stored1 := &StoredChunk{Id: &ChunkId{1, 0}}
+	recipe := []Chunk{
+		stored0,
+		stored1,
+		&DeltaChunk{Source: &ChunkId{0, 0}, Patch: make([]byte, 10), Size: 100},
+		stored1,
+		stored0,
+		NewTempChunk(make([]byte, 5)),
+	}
+	for _, c := range recipe {
+		if s, isStored := c.(*StoredChunk); isStored {
+			s.repo = &Repo{chunkSize: 100}
+		}
+	}
+	report := dedupReport(recipe, 1, 1)
+	testutils.AssertSame(t, DedupReport{
+		Version:      1,
+		StoredChunks: 1,
+		StoredBytes:  100,
+		DeltaChunks:  1,
+		DeltaBytes:   10,
+		InlineChunks: 1,
+		InlineBytes:  5,
+		ReusedChunks: 3,
+		ReusedBytes:  300,
+		Top:          []ChunkHits{{ChunkId{0, 0}, 3}},
+	}, report, "Report")
+}
+
+func TestHashIndex(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	NewRepo(temp, 8<<10).Commit(filepath.Join("testdata", "logs", "1"))
+	NewRepo(temp, 8<<10).Commit(filepath.Join("testdata", "logs", "2"))
+
+	full := NewRepo(temp, 8<<10)
+	full.loadVersions()
+	for i, v := range full.versions {
+		readHashes(full.meta(), v, func(j uint64, h chunkHashes) {
+			id := &ChunkId{i, j}
+			full.fingerprints[h.Fp] = id
+			full.sketches.Set(h.Sk, id)
+		})
+	}
+	load := func(prefix string, expectedIndexed int) {
+		repo := NewRepo(temp, 8<<10)
+		repo.loadVersions()
+		_, _, err := repo.readHashIndex(repo.versions)
+		testutils.AssertSame(t, expectedIndexed > 0, err == nil, prefix+" index valid")
+		var wg sync.WaitGroup
+		wg.Add(1)
+		repo.loadHashes(repo.versions, &wg)
+		testutils.AssertSame(t, full.fingerprints, repo.fingerprints, prefix+" fingerprints")
+		testutils.AssertSame(t, full.sketches, repo.sketches, prefix+" sketches")
+	}
+	load("Indexed", 2)
+
+	// a version added without updating the index only needs its hashes loaded
+	os.Rename(filepath.Join(temp, indexName), filepath.Join(temp, "index.bak"))
+	NewRepo(temp, 8<<10).Commit(filepath.Join("testdata", "logs", "3"))
+	os.Rename(filepath.Join(temp, "index.bak"), filepath.Join(temp, indexName))
+	full.loadVersions()
+	readHashes(full.meta(), full.versions[2], func(j uint64, h chunkHashes) {
+		id := &ChunkId{2, j}
+		full.fingerprints[h.Fp] = id
+		full.sketches.Set(h.Sk, id)
+	})
+	load("Partially indexed", 2)
+
+	// a corrupt index is ignored
+	index, _ := os.ReadFile(filepath.Join(temp, indexName))
+	index[len(index)-40] ^= 0xff
+	os.WriteFile(filepath.Join(temp, indexName), index, 0664)
+	load("Corrupt index", 0)
+}
+
+func TestLock(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := filepath.Join("testdata", "logs", "1")
+	repo := NewRepo(temp, 8<<10)
+	unlock, err := repo.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRepo(temp, 8<<10).Commit(source); !errors.Is(err, ErrRepoLocked) {
+		t.Error("commit of a locked repo should fail, actual:", err)
+	}
+	unlock()
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, lockName)); err == nil {
+		t.Error("lock should be released after the commit")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "file"), []byte("first"), 0664)
+	repo := NewRepo(temp, 8<<10)
+	defer repo.Close()
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- repo.Watch(source, 20*time.Millisecond, stop) }()
+	waitVersions := func(count int) {
+		r := NewReadOnlyRepo(temp, 8<<10)
+		for i := 0; i < 200; i++ {
+			r.loadVersions()
+			if len(r.versions) >= count {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("watch should have committed %d versions", count)
+	}
+	waitVersions(1)
+	os.WriteFile(filepath.Join(source, "file"), []byte("second one"), 0664)
+	waitVersions(2)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	NewRepo(temp, 8<<10).Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+
+	// nothing changed since the last commit
+	restarted := NewRepo(temp, 8<<10)
+	stop = make(chan struct{})
+	go func() { done <- restarted.Watch(source, 20*time.Millisecond, stop) }()
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	r := NewReadOnlyRepo(temp, 8<<10)
+	r.loadVersions()
+	testutils.AssertLen(t, 2, r.versions, "Versions after restarting watch")
+}
+
+func TestWatchNested(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	temp := filepath.Join(source, "backup")
+	os.Mkdir(temp, 0775)
+	os.WriteFile(filepath.Join(source, "file"), []byte("content"), 0664)
+	repo := NewRepo(temp, 8<<10)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- repo.Watch(source, 20*time.Millisecond, stop) }()
+	r := NewReadOnlyRepo(temp, 8<<10)
+	for i := 0; i < 200 && len(r.versions) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		r.loadVersions()
+	}
+	// the commit must not be seen as a change of the source
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	r.loadVersions()
+	testutils.AssertLen(t, 1, r.versions, "Versions of a repo inside the watched source")
+}
+
+func TestCompareVersions(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 5*8<<10)
+	rand.Read(content)
+	path := filepath.Join(source, "file")
+	os.WriteFile(path, content, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	content[20000] ^= 0xff
+	os.WriteFile(path, append(content, []byte("appended")...), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+
+	ranges, err := NewRepo(temp, 8<<10).CompareVersions("file", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) == 0 {
+		t.Fatal("there should be changed ranges")
+	}
+	var changed int64
+	var edit, tail bool
+	for _, r := range ranges {
+		changed += r.End - r.Start
+		if len(r.Chunks) == 0 {
+			t.Errorf("range %d-%d should have chunks", r.Start, r.End)
+		}
+		edit = edit || (r.Start <= 20000 && 20000 < r.End)
+		tail = tail || r.End == int64(len(content)+8)
+	}
+	if !edit || !tail {
+		t.Errorf("ranges %v should contain the edit and the appended tail", ranges)
+	}
+	if changed >= int64(len(content)) {
+		t.Errorf("only a part of the file should have changed, actual %d bytes", changed)
+	}
+	same, _ := NewRepo(temp, 8<<10).CompareVersions("file", 1, -1)
+	testutils.AssertLen(t, 0, same, "Ranges of the same version")
+	if _, err := NewRepo(temp, 8<<10).CompareVersions("missing", 0, 1); err == nil {
+		t.Error("comparing a missing file should fail")
+	}
+}
+
+func TestDecodeList(t *testing.T) {
+	recipe := []Chunk{NewTempChunk([]byte("a")), &StoredChunk{Id: &ChunkId{0, 1}}}
+	var withHeader, withoutHeader bytes.Buffer
+	encoder := gob.NewEncoder(&withHeader)
+	encoder.Encode(listHeader{Count: len(recipe)})
+	encoder.Encode(recipe)
+	gob.NewEncoder(&withoutHeader).Encode(recipe)
+
+	for name, raw := range map[string][]byte{"with": withHeader.Bytes(), "without": withoutHeader.Bytes()} {
+		var decoded []Chunk
+		if err := decodeList(raw, &decoded); err != nil {
+			t.Fatalf("decode %s header: %s", name, err)
+		}
+		testutils.AssertSame(t, recipe, decoded, "Decoded recipe "+name+" header")
+	}
+
+	var wrongCount bytes.Buffer
+	encoder = gob.NewEncoder(&wrongCount)
+	encoder.Encode(listHeader{Count: 3})
+	encoder.Encode(recipe)
+	var decoded []Chunk
+	if err := decodeList(wrongCount.Bytes(), &decoded); err == nil {
+		t.Error("decoding less elements than expected should fail")
+	}
+	truncated := withHeader.Bytes()[:withHeader.Len()-4]
+	if err := decodeList(truncated, &decoded); err == nil || !strings.Contains(err.Error(), "2 elements") {
+		t.Error("decoding a truncated list should fail with its expected count, actual:", err)
+	}
+}
+
+func TestIncompatibleList(t *testing.T) {
+	recipe := []Chunk{&StoredChunk{Id: &ChunkId{0, 1}}}
+	for name, header := range map[string]listHeader{
+		"version": {Count: len(recipe), Version: listVersion + 1},
+		"format":  {Count: len(recipe), Format: 42},
+	} {
+		var buff bytes.Buffer
+		encoder := gob.NewEncoder(&buff)
+		encoder.Encode(header)
+		encoder.Encode(recipe)
+		var decoded []Chunk
+		if err := decodeList(buff.Bytes(), &decoded); !errors.Is(err, ErrIncompatibleFormat) {
+			t.Errorf("unknown %s should be incompatible, actual: %v", name, err)
+		}
+	}
+}
+
+func TestCorruptFileList(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("first"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	os.WriteFile(filepath.Join(source, "b"), []byte("second"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	files := filepath.Join(temp, "00001", filesName)
+	raw, _ := os.ReadFile(files)
+	os.WriteFile(files, raw[:len(raw)/2], 0664)
+
+	expected := "version 00001 file list is corrupt: "
+	if err := NewRepo(temp, 8<<10).Restore(t.TempDir()); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("restore error should start with %q, actual: %v", expected, err)
+	}
+	repo := NewRepo(temp, 8<<10)
+	if _, err := repo.VersionFiles(0); err != nil {
+		t.Error(err)
+	}
+	_, err := repo.VersionFiles(1)
+	if err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("files error should start with %q, actual: %v", expected, err)
+	}
+	if !errors.Is(err, ErrCorruptList) {
+		t.Error("files error should be a corrupt list error")
+	}
+}
+
+func TestRestoreManifest(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	NewRepo(temp, 8<<10).Commit(source)
+	repo := NewRepo(temp, 8<<10)
+	var buff bytes.Buffer
+	repo.SetRestoreManifest(&buff)
+	if err := repo.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	var manifest []ManifestEntry
+	if err := json.Unmarshal(buff.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, len(repo.files), manifest, "Manifest")
+	for i, e := range manifest {
+		f := repo.files[i]
+		testutils.AssertSame(t, f.Path, e.Path, "Manifest path")
+		testutils.AssertSame(t, f.Size, e.Size, "Manifest size")
+		testutils.AssertSame(t, hex.EncodeToString(f.Sum), e.Checksum, "Manifest checksum")
+	}
+}
+
+func TestReadOnlyRepoSkipsHashes(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := t.TempDir()
+	random := make([]byte, 3*8<<10)
+	rand.Read(random)
+	os.WriteFile(filepath.Join(source, "random"), random, 0664)
+	repo1 := NewRepo(temp, 8<<10)
+	repo1.SetRawThreshold(0.95)
+	repo1.Commit(source)
+
+	repo := NewReadOnlyRepo(temp, 8<<10)
+	repo.Restore(dest)
+	testutils.AssertLen(t, 0, repo.fingerprints, "Fingerprints")
+	testutils.AssertLen(t, 0, repo.sketches, "Sketches")
+	if _, raw := repo.rawChunks.Load(ChunkId{0, 0}); !raw {
+		t.Error("raw flags should have been loaded lazily")
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestRecipeRuns(t *testing.T) {
+	recipe := []Chunk{
+		&StoredChunk{Id: &ChunkId{0, 0}},
+		&StoredChunk{Id: &ChunkId{0, 1}},
+		&StoredChunk{Id: &ChunkId{0, 2}},
+		NewTempChunk([]byte("a")),
+		&StoredChunk{Id: &ChunkId{0, 3}},
+		&StoredChunk{Id: &ChunkId{1, 4}},
+		&StoredChunk{Id: &ChunkId{1, 5}},
+		&DeltaChunk{Source: &ChunkId{0, 1}, Patch: []byte("p"), Size: 8},
+		&StoredChunk{Id: &ChunkId{1, 7}},
+	}
+	runs := collapseRecipeRuns(recipe)
+	testutils.AssertLen(t, 6, runs, "Runs")
+	testutils.AssertSame(t, uint64(2), runs[0].Run, "First run")
+	testutils.AssertSame(t, recipe, expandRecipeRuns(runs), "Expanded recipe")
+
+	var buff bytes.Buffer
+	encoder := gob.NewEncoder(&buff)
+	encoder.Encode(listHeader{Count: len(recipe), Format: recipeRunsFormat})
+	encoder.Encode(runs)
+	var decoded []Chunk
+	if err := decodeList(buff.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, recipe, decoded, "Decoded recipe")
+	var files []File
+	if err := decodeList(buff.Bytes(), &files); err == nil {
+		t.Error("only recipes can be decoded from runs")
+	}
+}
+
+func TestFileModesFormat(t *testing.T) {
+	files := []File{{Path: "/a", Size: 1, Mode: 0755}, {Path: "/b"}, {Path: "/c", Link: "a"}}
+	decode := func(format int) []File {
+		var buff bytes.Buffer
+		encoder := gob.NewEncoder(&buff)
+		encoder.Encode(listHeader{Count: len(files), Format: format})
+		encoder.Encode(files)
+		var decoded []File
+		if err := decodeList(buff.Bytes(), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	testutils.AssertSame(t, files, decode(fileModesFormat), "Files with modes")
+	legacy := decode(0)
+	testutils.AssertSame(t, legacyFileMode, legacy[0].Mode, "Legacy mode of a regular file")
+	testutils.AssertSame(t, legacyFileMode, legacy[1].Mode, "Legacy mode of an empty file")
+	testutils.AssertSame(t, fs.FileMode(0), legacy[2].Mode, "Legacy mode of a symlink")
+}
+
+func TestRecipeStream(t *testing.T) {
+	recipe := []Chunk{
+		&StoredChunk{Id: &ChunkId{0, 0}},
+		&StoredChunk{Id: &ChunkId{0, 1}},
+		&DeltaChunk{Source: &ChunkId{0, 1}, Patch: []byte("p"), Size: 8},
+		&StoredChunk{Id: &ChunkId{1, 2}},
+		&StoredChunk{Id: &ChunkId{1, 3}},
+		&StoredChunk{Id: &ChunkId{1, 4}},
+	}
+	var buff bytes.Buffer
+	encoder := gob.NewEncoder(&buff)
+	encoder.Encode(listHeader{Count: len(recipe), Format: recipeRunsFormat})
+	encoder.Encode(collapseRecipeRuns(recipe))
+	var runs []recipeRun
+	if err := decodeList(buff.Bytes(), &runs); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 3, runs, "Decoded runs")
+	testutils.AssertSame(t, len(recipe), recipeLen(runs), "Recipe length")
+
+	repo := NewRepo(t.TempDir(), 8)
+	stream := repo.newRecipeStream(runs)
+	var streamed []Chunk
+	for c, ok := stream.Next(); ok; c, ok = stream.Next() {
+		switch c := c.(type) {
+		case *StoredChunk:
+			testutils.AssertSame(t, repo, c.repo, "Stored chunk repo")
+			c.repo = nil
+		case *DeltaChunk:
+			testutils.AssertSame(t, repo, c.repo, "Delta chunk repo")
+			c.repo = nil
+		}
+		streamed = append(streamed, c)
+	}
+	testutils.AssertSame(t, recipe, streamed, "Streamed recipe")
+}
+
+func TestVersionFiles(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("first"), 0664)
+	repo := NewRepo(temp, 8<<10)
+	repo.Commit(source)
+	os.WriteFile(filepath.Join(source, "b"), []byte("second"), 0664)
+	repo = NewRepo(temp, 8<<10)
+	repo.Commit(source)
+
+	repo = NewReadOnlyRepo(temp, 8<<10)
+	first, err := repo.VersionFiles(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 1, first, "First version files")
+	last, err := repo.VersionFiles(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 2, last, "Last version files")
+	testutils.AssertSame(t, "/b", last[1].Path, "Second file path")
+	testutils.AssertSame(t, int64(6), last[1].Size, "Second file size")
+	if _, err := repo.VersionFiles(2); err == nil {
+		t.Error("listing a missing version should fail")
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	source := t.TempDir()
+	for i, size := range []int{100, 5000, 0, 300, 2000, 700} {
+		content := make([]byte, size)
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, fmt.Sprintf("%d", i)), content, 0664)
+	}
+	files := listFiles(source)
+	files = append(files, File{Path: filepath.Join(source, "missing"), Size: 10})
+	concat := func(workers int) ([]byte, []File) {
+		repo := NewRepo(t.TempDir(), 8<<10)
+		repo.SetReadAhead(workers, 2500)
+		var buff bytes.Buffer
+		list := append([]File(nil), files...)
+		repo.concatFiles(&list, utils.NopCloser(&buff))
+		return buff.Bytes(), list
+	}
+	expected, expectedFiles := concat(0)
+	actual, actualFiles := concat(3)
+	testutils.AssertLen(t, 6, actualFiles, "Files")
+	testutils.AssertSame(t, expectedFiles, actualFiles, "Files")
+	if !bytes.Equal(expected, actual) {
+		t.Error("content read ahead should be concatenated in order")
+	}
+}
+
+func TestReadAheadCanceled(t *testing.T) {
+	logger.SetLevel(0)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	for i := 0; i < 10; i++ {
+		os.WriteFile(filepath.Join(source, fmt.Sprintf("%d", i)), make([]byte, 2000), 0664)
+	}
+	files := listFiles(source)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	repo := NewRepo(t.TempDir(), 8<<10)
+	repo.SetReadAhead(2, 2500)
+	repo.SetContext(ctx)
+	before := runtime.NumGoroutine()
+	repo.concatFiles(&files, utils.NopCloser(io.Discard))
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("read ahead goroutines should stop with the commit: %d > %d", n, before)
+	}
+}
+
+func TestHashesFormats(t *testing.T) {
+	records := []chunkHashes{
+		{Fp: 1, Sk: []uint64{2, 3}, Sum: []byte("sum"), Raw: true},
+		{Fp: 4, Sk: []uint64{}, Sum: []byte{}},
+	}
+	for format, newEncoder := range hashesFormats {
+		var buff bytes.Buffer
+		encode, err := newEncoder(&buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range records {
+			encode(h)
+		}
+		decode := newHashesDecoder(&buff)
+		var decoded []chunkHashes
+		for {
+			h := chunkHashes{Sk: []uint64{}, Sum: []byte{}}
+			if err := decode(&h); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(format, err)
+			}
+			decoded = append(decoded, h)
+		}
+		testutils.AssertSame(t, records, decoded, format+" records")
+	}
+
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := t.TempDir()
+	random := make([]byte, 3*8<<10)
+	rand.Read(random)
+	os.WriteFile(filepath.Join(source, "random"), random, 0664)
+	repo := NewRepo(temp, 8<<10)
+	if err := repo.SetHashesFormat("binary"); err != nil {
+		t.Fatal(err)
+	}
+	repo.Commit(source)
+	raw, _ := os.ReadFile(filepath.Join(temp, "00000", hashesName))
+	testutils.AssertSame(t, byte(binaryHashesMagic), raw[0], "Magic byte")
+	os.WriteFile(filepath.Join(source, "other"), random[:8<<10], 0664)
+	repo = NewRepo(temp, 8<<10)
+	repo.Commit(source)
+	testutils.AssertLen(t, 3, repo.fingerprints, "Fingerprints")
+	NewRepo(temp, 8<<10).Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestHashesCompression(t *testing.T) {
+	record := chunkHashes{Fp: 1, Sk: []uint64{2, 3}, Sum: []byte("sum")}
+	for format, newEncoder := range hashesFormats {
+		var buff bytes.Buffer
+		out, err := (&Repo{hashesCompression: "zlib"}).hashesWriter(&buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encode, _ := newEncoder(out)
+		encode(record)
+		out.Close()
+		testutils.AssertSame(t, hashesCompressionMagics["zlib"], buff.Bytes()[0], format+" magic byte")
+		var decoded chunkHashes
+		if err := newHashesDecoder(&buff)(&decoded); err != nil {
+			t.Fatal(format, err)
+		}
+		testutils.AssertSame(t, record, decoded, format+" record")
+	}
+
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := t.TempDir()
+	random := make([]byte, 3*8<<10)
+	rand.Read(random)
+	os.WriteFile(filepath.Join(source, "random"), random, 0664)
+	if err := NewRepo(temp, 8<<10).SetHashesCompression("lz4"); err == nil {
+		t.Error("unknown compression should be rejected")
+	}
+	// an uncompressed version followed by a compressed one
+	NewRepo(temp, 8<<10).Commit(source)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetHashesCompression("zlib")
+	os.WriteFile(filepath.Join(source, "other"), random[:8<<10], 0664)
+	repo.Commit(source)
+	raw, _ := os.ReadFile(filepath.Join(temp, "00001", hashesName))
+	testutils.AssertSame(t, hashesCompressionMagics["zlib"], raw[0], "Magic byte")
+	// the hashes must be read from their files
+	os.Remove(filepath.Join(temp, indexName))
+	os.WriteFile(filepath.Join(source, "last"), random[8<<10:], 0664)
+	repo = NewRepo(temp, 8<<10)
+	repo.Commit(source)
+	testutils.AssertLen(t, 3, repo.fingerprints, "Fingerprints")
+	NewRepo(temp, 8<<10).Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestEstimate(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	random := make([]byte, 4*8<<10)
+	rand.Read(random)
+	os.WriteFile(filepath.Join(source, "random"), random, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	os.WriteFile(filepath.Join(source, "other"), make([]byte, 4*8<<10), 0664)
+
+	repo := NewReadOnlyRepo(temp, 8<<10)
+	e, err := repo.Estimate(source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 2, e.Files, "Files")
+	testutils.AssertSame(t, int64(8*8<<10), e.Size, "Size")
+	testutils.AssertSame(t, e.Size, e.SampledSize, "Sampled size")
+	testutils.AssertSame(t, 0.5, e.DedupRatio, "Dedup ratio")
+	if e.NewSize <= 0 || e.NewSize >= e.Size/2 {
+		t.Error("zeros should be compressed below half the source size, actual:", e.NewSize)
+	}
+	if e, _ = repo.Estimate(source, 1); e.SampledFiles != 1 {
+		t.Error("only one file should have been sampled, actual:", e.SampledFiles)
+	}
+	repo.loadVersions()
+	testutils.AssertLen(t, 1, repo.versions, "Versions")
+}
+
+func TestCaseCollisions(t *testing.T) {
+	files := []File{{Path: "/b/File"}, {Path: "/a"}, {Path: "/B/file"}, {Path: "/b/file"}, {Path: "/A"}}
+	testutils.AssertSame(t, [][]string{{"/a", "/A"}, {"/b/File", "/B/file", "/b/file"}}, caseCollisions(files), "Collisions")
+
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "file"), []byte("lower"), 0664)
+	os.WriteFile(filepath.Join(source, "FILE"), []byte("upper"), 0664)
+	temp := t.TempDir()
+	repo := NewRepo(temp, 8<<10)
+	if err := repo.SetCaseCheck("wrong"); err == nil {
+		t.Error("unknown case check should be rejected")
+	}
+	repo.SetCaseCheck("error")
+	if err := repo.Commit(source); !errors.Is(err, ErrCaseCollision) {
+		t.Fatal("commit should fail with a case collision, actual:", err)
+	}
+	repo.SetCaseCheck("warn")
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	repo = NewReadOnlyRepo(temp, 8<<10)
+	repo.SetCaseCheck("error")
+	if err := repo.Restore(t.TempDir()); !errors.Is(err, ErrCaseCollision) {
+		t.Error("restore should fail with a case collision, actual:", err)
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	newSourceRepo := func(source []byte) *Repo {
+		repo := NewRepo(t.TempDir(), 8<<10)
+		repo.createVersionDir(0)
+		repo.StoreChunkContent(&ChunkId{0, 0}, bytes.NewReader(source))
+		return repo
+	}
+	source := make([]byte, 8<<10)
+	rand.Read(source)
+	target := append([]byte("new"), source[3:]...)
+	repo := newSourceRepo(source)
+	var patch bytes.Buffer
+	repo.differ.Diff(bytes.NewReader(source), bytes.NewReader(target), &patch)
+	delta := &DeltaChunk{repo: repo, Source: &ChunkId{0, 0}, Patch: patch.Bytes(), Size: len(target)}
+	chunks := map[string]struct {
+		chunk    Chunk
+		expected []byte
+	}{
+		"temp":   {NewTempChunk(source), source},
+		"stored": {NewStoredChunk(repo, &ChunkId{0, 0}), source},
+		"delta":  {delta, target},
+	}
+	for name, c := range chunks {
+		first := mustReader(t, c.chunk)
+		io.CopyN(io.Discard, first, 3)
+		second := mustReader(t, c.chunk)
+		content, _ := io.ReadAll(second)
+		testutils.AssertSame(t, c.expected, content, name+" second reader")
+		rest, _ := io.ReadAll(first)
+		testutils.AssertSame(t, c.expected[3:], rest, name+" first reader")
+		first.Seek(0, io.SeekStart)
+		content, _ = io.ReadAll(first)
+		testutils.AssertSame(t, c.expected, content, name+" seeked reader")
+	}
+
+	delta.SetRepo(newSourceRepo(source))
+	os.RemoveAll(repo.path)
+	repo.SetCacheSize(0)
+	content, _ := io.ReadAll(mustReader(t, delta))
+	testutils.AssertSame(t, target, content, "Delta against the source of the new repo")
+
+	// a patch that does not apply to its source must not give partial content
+	other := make([]byte, 8<<10)
+	rand.Read(other)
+	for name, c := range map[string]*DeltaChunk{
+		"other source":  {repo: newSourceRepo(other), Source: &ChunkId{0, 0}, Patch: patch.Bytes(), Size: len(target)},
+		"corrupt patch": {repo: newSourceRepo(source), Source: &ChunkId{0, 0}, Patch: patch.Bytes()[:patch.Len()/2], Size: len(target)},
+		"wrong size":    {repo: newSourceRepo(source), Source: &ChunkId{0, 0}, Patch: patch.Bytes(), Size: len(target) + 1},
+	} {
+		if _, err := c.Reader(); !errors.Is(err, ErrCorruptChunk) {
+			t.Errorf("%s: reader should fail with ErrCorruptChunk, got: %v", name, err)
+		}
+	}
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	if _, known, _ := freeSpace(temp); !known {
+		t.Skip("free space not supported")
+	}
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "file"), []byte("content"), 0664)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetMinFreeSpace(math.MaxInt64)
+	if err := repo.Commit(source); !errors.Is(err, ErrNoSpace) {
+		t.Fatal("commit should fail without enough space, actual:", err)
+	}
+	repo.loadVersions()
+	testutils.AssertLen(t, 0, repo.versions, "Versions")
+	repo.SetMinFreeSpace(1)
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimilarFiles(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	original := make([]byte, 4*8<<10)
+	rand.Read(original)
+	modified := append([]byte(nil), original...)
+	copy(modified[8<<10+100:], "modified content")
+	other := make([]byte, 4*8<<10)
+	rand.Read(other)
+	os.WriteFile(filepath.Join(source, "a"), original, 0664)
+	os.WriteFile(filepath.Join(source, "b"), modified, 0664)
+	os.WriteFile(filepath.Join(source, "c"), other, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+
+	similar, err := NewReadOnlyRepo(temp, 8<<10).SimilarFiles(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, [][]string{{"/a", "/b"}}, similar, "Similar files")
+}
+
+func TestRestoreResume(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		content := make([]byte, 8<<10+100)
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, name), content, 0664)
+	}
+	NewRepo(temp, 8<<10).Commit(source)
+	NewReadOnlyRepo(temp, 8<<10).Restore(dest)
+
+	// a is intact, b is corrupted with the same size and c is truncated
+	infoA, _ := os.Stat(filepath.Join(dest, "a"))
+	b, _ := os.ReadFile(filepath.Join(dest, "b"))
+	b[0]++
+	os.WriteFile(filepath.Join(dest, "b"), b, 0664)
+	os.Truncate(filepath.Join(dest, "c"), 100)
+
+	repo := NewReadOnlyRepo(temp, 8<<10)
+	repo.SetRestoreResume(true)
+	if err := repo.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Resumed restore")
+	resumedA, _ := os.Stat(filepath.Join(dest, "a"))
+	testutils.AssertSame(t, infoA.ModTime(), resumedA.ModTime(), "Intact file modification time")
+}
+
+func TestStoreConcurrency(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	random := make([]byte, 20*8<<10)
+	rand.Read(random)
+	os.WriteFile(filepath.Join(source, "random"), random, 0664)
+	serial := t.TempDir()
+	concurrent := t.TempDir()
+	NewRepo(serial, 8<<10).Commit(source)
+	repo := NewRepo(concurrent, 8<<10)
+	repo.SetStoreConcurrency(4)
+	repo.Commit(source)
+	expected, _ := os.ReadFile(filepath.Join(serial, "00000", hashesName))
+	actual, _ := os.ReadFile(filepath.Join(concurrent, "00000", hashesName))
+	testutils.AssertSame(t, expected, actual, "Hashes")
+	dest := t.TempDir()
+	NewReadOnlyRepo(concurrent, 8<<10).Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestSelfTest(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	report, err := SelfTest(t.TempDir(), 8<<10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 12, report.Files, "Files")
+	if report.Dedup.ReusedChunks == 0 {
+		t.Error("the copies of the synthetic tree should reuse chunks")
+	}
+	if err := compareTrees(t.TempDir(), "testdata/logs"); err == nil {
+		t.Error("comparing different trees should fail")
+	}
+}
+
+func TestMatchStreamReaders(t *testing.T) {
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	repo := NewRepo(t.TempDir(), 8<<10)
+	repo.createVersionDir(0)
+	match := func(stream io.Reader) []byte {
+		storeQueue := make(chan chunkData, 16)
+		recipe, _ := repo.matchStream(stream, storeQueue, 0, 0)
+		var content bytes.Buffer
+		for _, c := range recipe {
+			io.Copy(&content, mustReader(t, c))
+		}
+		return content.Bytes()
+	}
+	content := make([]byte, 3*8<<10+500)
+	rand.Read(content)
+	testutils.AssertSame(t, content, match(iotest.OneByteReader(bytes.NewReader(content))), "One byte reads")
+	testutils.AssertSame(t, content[:100], match(iotest.HalfReader(bytes.NewReader(content[:100]))), "Short stream")
+	testutils.AssertLen(t, 0, match(bytes.NewReader(nil)), "Empty stream")
+
+	broken := errors.New("broken")
+	for name, stream := range map[string]io.Reader{
+		"initial": iotest.ErrReader(broken),
+		"later":   io.MultiReader(bytes.NewReader(content), iotest.ErrReader(broken)),
+	} {
+		match(stream)
+		if err := repo.matchError(); !errors.Is(err, broken) {
+			t.Errorf("%s read error should be recorded, actual: %v", name, err)
+		}
+	}
+}
+
+func TestFileMap(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	contents := map[string][]byte{"a": make([]byte, 8<<10+300), "b": {}, "c": make([]byte, 2*8<<10), "d": []byte("end")}
+	for name, content := range contents {
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, name), content, 0664)
+	}
+	for _, enabled := range []bool{true, false} {
+		temp := t.TempDir()
+		repo := NewRepo(temp, 8<<10)
+		repo.SetFileMap(enabled)
+		repo.Commit(source)
+		_, err := os.Stat(filepath.Join(temp, "00000", fileMapName))
+		testutils.AssertSame(t, enabled, err == nil, "File map stored")
+		for name, content := range contents {
+			var buff bytes.Buffer
+			if err := NewReadOnlyRepo(temp, 8<<10).RestoreFile(name, &buff); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, buff.Bytes()) {
+				t.Errorf("restored file %s with file map %v does not match", name, enabled)
+			}
+		}
+	}
+	locations := fileLocations([]File{{Path: "/a", Size: 10}, {Path: "/b", Size: 0}, {Path: "/c", Size: 5}},
+		[]Chunk{NewTempChunk(make([]byte, 8)), NewTempChunk(make([]byte, 7))})
+	testutils.AssertSame(t, []fileLocation{
+		{Path: "/a", First: 0, Last: 1, Offset: 0},
+		{Path: "/b", First: 1, Last: 0, Offset: 2},
+		{Path: "/c", First: 1, Last: 1, Offset: 2},
+	}, locations, "Locations")
+}
+
+func TestNoSketch(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	original := make([]byte, 4*8<<10)
+	rand.Read(original)
+	modified := append([]byte(nil), original...)
+	for i := 0; i < len(modified); i += 8 << 10 {
+		modified[i+100]++
+	}
+	os.WriteFile(filepath.Join(source, "original"), original, 0664)
+	os.WriteFile(filepath.Join(source, "modified"), modified, 0664)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetSketches(false)
+	repo.Commit(source)
+	testutils.AssertLen(t, 0, repo.sketches, "Sketches")
+	readHashes(repo.meta(), filepath.Join(temp, "00000"), func(j uint64, h chunkHashes) {
+		testutils.AssertLen(t, 0, h.Sk, fmt.Sprint("Sketch of chunk ", j))
+	})
+
+	reopened := NewRepo(temp, 8<<10)
+	if !reopened.noSketch {
+		t.Error("sketches should stay disabled by the repo config")
+	}
+	dest := t.TempDir()
+	reopened.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	reopened.loadRecipes(reopened.versions)
+	testutils.AssertLen(t, 8, reopened.recipe, "Recipe")
+	testutils.AssertLen(t, 0, extractDeltaChunks(reopened.recipe), "Delta chunks")
+	if err := reopened.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "zeros"), make([]byte, 3*8<<10), 0664)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetFileMap(true)
+	repo.Commit(source)
+	random := make([]byte, 2*8<<10+10)
+	rand.Read(random)
+	os.WriteFile(filepath.Join(source, "random"), random, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+
+	if err := NewRepo(temp, 8<<10).Recompress("wrong"); err == nil {
+		t.Error("unknown compression should be rejected")
+	}
+	if err := NewRepo(temp, 8<<10).Recompress("none"); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := os.ReadFile(filepath.Join(temp, "00000", chunksName, fmt.Sprintf(chunkIdFmt, 0)))
+	testutils.AssertSame(t, make([]byte, 8<<10), stored, "Uncompressed chunk")
+	c, _, _ := NewRepo(temp, 8<<10).readConfig()
+	testutils.AssertSame(t, "none", c.Compression, "Config compression")
+
+	repo = NewReadOnlyRepo(temp, 8<<10)
+	if err := repo.Verify(); err != nil {
+		t.Error(err)
+	}
+	dest := t.TempDir()
+	repo.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	var buff bytes.Buffer
+	NewReadOnlyRepo(temp, 8<<10).RestoreFile("zeros", &buff)
+	testutils.AssertLen(t, 3*8<<10, buff.Bytes(), "Restored file")
+}
+
+func TestRecompressVersionGap(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 2*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	NewRepo(temp, 8<<10).Commit(source)
+	// the second version only references the chunks of the first one
+	os.Rename(filepath.Join(temp, "00001"), filepath.Join(temp, "00003"))
+	other := make([]byte, 2*8<<10)
+	rand.Read(other)
+	os.WriteFile(filepath.Join(source, "b"), other, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+
+	if err := NewRepo(temp, 8<<10).Recompress("none"); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := os.ReadFile(filepath.Join(temp, "00004", chunksName, fmt.Sprintf(chunkIdFmt, 0)))
+	testutils.AssertSame(t, other[:8<<10], stored, "Uncompressed chunk after the gap")
+	repo := NewReadOnlyRepo(temp, 8<<10)
+	if err := repo.Verify(); err != nil {
+		t.Error(err)
+	}
+	dest := t.TempDir()
+	if err := repo.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestRecompressPruned(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	contents := make(map[string][]byte)
+	write := func(name string) {
+		contents[name] = make([]byte, 2*8<<10)
+		rand.Read(contents[name])
+		os.WriteFile(filepath.Join(source, name), contents[name], 0664)
+	}
+	write("a")
+	NewRepo(temp, 8<<10).Commit(source)
+	write("b")
+	NewRepo(temp, 8<<10).Commit(source)
+	os.Remove(filepath.Join(source, "b"))
+	write("c")
+	NewRepo(temp, 8<<10).Commit(source)
+	if err := NewRepo(temp, 8<<10).Prune(1); err != nil {
+		t.Fatal(err)
+	}
+	if !isPruned(filepath.Join(temp, "00000")) {
+		t.Fatal("version 0 should be kept pruned for the chunks of a")
+	}
+
+	if err := NewRepo(temp, 8<<10).Recompress("none"); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := os.ReadFile(filepath.Join(temp, "00000", chunksName, fmt.Sprintf(chunkIdFmt, 0)))
+	testutils.AssertSame(t, contents["a"][:8<<10], stored, "Uncompressed chunk of the pruned version")
+	repo := NewReadOnlyRepo(temp, 8<<10)
+	if err := repo.Verify(); err != nil {
+		t.Error(err)
+	}
+	dest := t.TempDir()
+	if err := repo.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestCommitBase(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	first := make([]byte, 4*8<<10)
+	rand.Read(first)
+	second := make([]byte, 4*8<<10)
+	rand.Read(second)
+	os.WriteFile(filepath.Join(source, "first"), first, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	os.WriteFile(filepath.Join(source, "second"), second, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+
+	repo := NewRepo(temp, 8<<10)
+	repo.SetBase(5)
+	if err := repo.Commit(source); err == nil {
+		t.Error("unknown base should be rejected")
+	}
+	repo = NewRepo(temp, 8<<10)
+	repo.SetBase(0)
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	parent, ok, err := readParent(filepath.Join(temp, "00002"))
+	if err != nil || !ok {
+		t.Fatal("parent should be recorded: ", err)
+	}
+	testutils.AssertSame(t, 0, parent, "Parent")
+	if _, ok, _ := readParent(filepath.Join(temp, "00001")); ok {
+		t.Error("version without base should not have a parent")
+	}
+
+	repo = NewReadOnlyRepo(temp, 8<<10)
+	dest := t.TempDir()
+	repo.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	repo.loadRecipes(repo.versions)
+	for _, c := range repo.recipe {
+		var id *ChunkId
+		switch c := c.(type) {
+		case *StoredChunk:
+			id = c.Id
+		case *DeltaChunk:
+			id = c.Source
+		}
+		if id != nil && id.Ver == 1 {
+			t.Errorf("chunk %v should not come from version 1", id)
+		}
+	}
+	if len(repo.recipe) == 0 {
+		t.Error("recipe should not be empty")
+	}
+}
+
+func TestVersionDigest(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := filepath.Join("testdata", "logs")
+	temp1 := t.TempDir()
+	temp2 := t.TempDir()
+	NewRepo(temp1, 8<<10).Commit(source)
+	NewRepo(temp2, 4<<10).Commit(source)
+	other := t.TempDir()
+	os.WriteFile(filepath.Join(other, "a"), []byte("content"), 0664)
+	NewRepo(temp1, 8<<10).Commit(other)
+
+	d1, err := NewRepo(temp1, 8<<10).VersionDigest(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := NewRepo(temp2, 4<<10).VersionDigest(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, d1, d2, "Digest of the same content in another repo")
+	d3, _ := NewRepo(temp1, 8<<10).VersionDigest(1)
+	if bytes.Equal(d1, d3) {
+		t.Error("different versions should have different digests")
+	}
+	// versions committed without digest compute it from their file list
+	os.Remove(filepath.Join(temp1, "00000", digestName))
+	computed, err := NewRepo(temp1, 8<<10).VersionDigest(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, d1, computed, "Computed digest")
+}
+
+func TestRestoreEmptyFiles(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	for name, content := range map[string][]byte{
+		"only empty": nil,
+		"mixed":      []byte("some content"),
+	} {
+		temp := t.TempDir()
+		source := t.TempDir()
+		os.WriteFile(filepath.Join(source, "a-empty"), nil, 0664)
+		os.Mkdir(filepath.Join(source, "dir"), 0775)
+		os.WriteFile(filepath.Join(source, "dir", "empty"), nil, 0664)
+		if content != nil {
+			os.WriteFile(filepath.Join(source, "b-file"), content, 0664)
+		}
+		NewRepo(temp, 8<<10).Commit(source)
+		dest := t.TempDir()
+		if err := NewRepo(temp, 8<<10).Restore(dest); err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		for _, p := range []string{"a-empty", filepath.Join("dir", "empty")} {
+			info, err := os.Stat(filepath.Join(dest, p))
+			if err != nil {
+				t.Errorf("%s: %s should be restored: %s", name, p, err)
+			} else if info.Size() != 0 {
+				t.Errorf("%s: %s should be empty", name, p)
+			}
+		}
+		assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore "+name)
+	}
+}
+
+func TestRestoreCreateError(t *testing.T) {
+	logger.SetLevel(0)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("first"), 0664)
+	os.WriteFile(filepath.Join(source, "b"), []byte("second"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	dest := t.TempDir()
+	// a directory in place of a file prevents its creation
+	os.Mkdir(filepath.Join(dest, "a"), 0775)
+	if err := NewRepo(temp, 8<<10).Restore(dest); err == nil {
+		t.Error("restore should report the file that could not be created")
+	}
+	testutils.AssertSameFile(t, filepath.Join(source, "b"), filepath.Join(dest, "b"), "Following file")
+}
+
+func TestIndexOnly(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	first := make([]byte, 3*8<<10)
+	rand.Read(first)
+	os.WriteFile(filepath.Join(source, "first"), first, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+
+	second := make([]byte, 3*8<<10)
+	rand.Read(second)
+	os.WriteFile(filepath.Join(source, "second"), second, 0664)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetIndexOnly(true)
+	if err := repo.Append(source); err == nil {
+		t.Error("index-only append should be rejected")
+	}
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	chunks, _ := os.ReadDir(filepath.Join(temp, "00001", chunksName))
+	testutils.AssertLen(t, 0, chunks, "Index-only chunks")
+	files, err := NewReadOnlyRepo(temp, 8<<10).VersionFiles(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 2, files, "Index-only files")
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(t.TempDir()); !errors.Is(err, ErrIndexOnly) {
+		t.Errorf("restore of an index-only version should fail with ErrIndexOnly, actual: %v", err)
+	}
+	if err := NewReadOnlyRepo(temp, 8<<10).Verify(); err != nil {
+		t.Error(err)
+	}
+
+	// the next version must not depend on the index-only one
+	NewRepo(temp, 8<<10).Commit(source)
+	chunks, _ = os.ReadDir(filepath.Join(temp, "00002", chunksName))
+	testutils.AssertLen(t, 3, chunks, "Chunks stored after an index-only version")
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestCanceledContext(t *testing.T) {
+	logger.SetLevel(0)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("first"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	repo := NewRepo(temp, 8<<10)
+	repo.SetContext(ctx)
+	if err := repo.Commit(source); !errors.Is(err, context.Canceled) {
+		t.Error("canceled commit should fail, got:", err)
+	}
+	testutils.AssertSame(t, 1, NewReadOnlyRepo(temp, 8<<10).Versions(), "Versions")
+
+	dest := t.TempDir()
+	repo = NewReadOnlyRepo(temp, 8<<10)
+	repo.SetContext(ctx)
+	if err := repo.Restore(dest); !errors.Is(err, context.Canceled) {
+		t.Error("canceled restore should fail, got:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "a")); err == nil {
+		t.Error("canceled restore should not restore any file")
+	}
+}
+
+func TestCommitNestedRepo(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("first"), 0664)
+	temp := filepath.Join(source, "backup")
+	NewRepo(temp, 8<<10).Commit(source)
+	NewRepo(temp, 8<<10).Commit(source)
+	for v := 0; v < 2; v++ {
+		files, err := NewReadOnlyRepo(temp, 8<<10).VersionFiles(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertLen(t, 1, files, fmt.Sprint("Files of version ", v))
+	}
+}
+
+func TestVerifyOnWrite(t *testing.T) {
+	logger.SetLevel(0)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 3*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+
+	repo := NewRepo(temp, 8<<10)
+	repo.SetVerifyOnWrite(true)
+	// chunks read back from the drive do not match what has been written
+	repo.chunkReadWrapper = func(io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("corrupt")), nil
+	}
+	var chunkErr *ChunkError
+	if err := repo.Commit(source); !errors.As(err, &chunkErr) {
+		t.Fatal("commit should fail with the mismatching chunk, got:", err)
+	}
+	testutils.AssertSame(t, 0, NewReadOnlyRepo(temp, 8<<10).Versions(), "Versions")
+
+	repo = NewRepo(temp, 8<<10)
+	repo.SetVerifyOnWrite(true)
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 1, NewReadOnlyRepo(temp, 8<<10).Versions(), "Versions")
+}
+
+type failingWriteCloser struct{ err error }
+
+func (w failingWriteCloser) Write([]byte) (int, error) { return 0, w.err }
+func (w failingWriteCloser) Close() error              { return nil }
+
+func TestWrappedErrors(t *testing.T) {
+	logger.SetLevel(0)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 2*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+
+	repo := NewRepo(temp, 8<<10)
+	errWrite := errors.New("write failure")
+	repo.chunkWriteWrapper = func(io.Writer) io.WriteCloser {
+		return failingWriteCloser{errWrite}
+	}
+	var chunkErr *ChunkError
+	err := repo.Commit(source)
+	if !errors.As(err, &chunkErr) || !errors.Is(err, errWrite) {
+		t.Fatal("commit should fail with the store error of the chunk, got:", err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, "00000")); err == nil {
+		t.Error("the version of the failed commit should have been removed")
+	}
+
+	temp = t.TempDir()
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	os.Mkdir(filepath.Join(dest, "a"), 0775)
+	var pathErr *fs.PathError
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); !errors.As(err, &pathErr) {
+		t.Error("restore should fail with the path error of the file, got:", err)
+	}
+}
+
+func TestOpenVersion(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	first := make([]byte, 3*8<<10+42)
+	rand.Read(first)
+	os.WriteFile(filepath.Join(source, "a"), first, 0664)
+	os.WriteFile(filepath.Join(source, "b"), []byte("second"), 0664)
+	os.WriteFile(filepath.Join(source, "c"), []byte("third"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	os.WriteFile(filepath.Join(source, "b"), []byte("changed"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+
+	reader, err := NewReadOnlyRepo(temp, 8<<10).OpenVersion(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	expected := map[string][]byte{"/a": first, "/b": []byte("second"), "/c": []byte("third")}
+	for {
+		file, content, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.Path == "/a" {
+			// the rest of its content must be skipped by the next call
+			continue
+		}
+		actual, err := io.ReadAll(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertSame(t, expected[file.Path], actual, "Content of "+file.Path)
+		delete(expected, file.Path)
+	}
+	testutils.AssertLen(t, 1, expected, "Files left")
+	if _, err := NewReadOnlyRepo(temp, 8<<10).OpenVersion(2); err == nil {
+		t.Error("opening a missing version should fail")
+	}
+}
+
+func TestStoreQueueDepth(t *testing.T) {
+	repo := NewRepo(t.TempDir(), 8<<10)
+	testutils.AssertSame(t, 32, repo.storeQueueDepth(), "Default depth")
+	repo.SetStoreConcurrency(4)
+	testutils.AssertSame(t, 128, repo.storeQueueDepth(), "Depth of 4 goroutines")
+	repo.SetStoreQueueSize(10)
+	testutils.AssertSame(t, 10, repo.storeQueueDepth(), "Set depth")
+}
+
+func TestRestoreMissingChunk(t *testing.T) {
+	logger.SetLevel(0)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	NewRepo(temp, 8<<10).Commit(source)
+	os.Remove(filepath.Join(temp, "00000", chunksName, fmt.Sprintf(chunkIdFmt, 1)))
+
+	repo, err := OpenReadOnlyRepo(temp, 8<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Restore(t.TempDir())
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("restore of a missing chunk should fail with fs.ErrNotExist, got: ", err)
+	}
+	var chunkErr *ChunkError
+	if !errors.As(err, &chunkErr) {
+		t.Fatal("restore of a missing chunk should fail with a ChunkError, got: ", err)
+	}
+	testutils.AssertSame(t, ChunkId{Ver: 0, Idx: 1}, *chunkErr.Id, "Missing chunk id")
+
+	// the prefetching must leave the error to the actual read
+	repo.SetPrefetch(8)
+	if err := repo.Restore(t.TempDir()); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("prefetched restore of a missing chunk should fail with fs.ErrNotExist, got: ", err)
+	}
+	repo.SetPrefetch(0)
+
+	reader, err := repo.OpenVersion(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for err == nil {
+		var content io.Reader
+		if _, content, err = reader.Next(); err == nil {
+			_, err = io.Copy(io.Discard, content)
+		}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Error("reading a version with a missing chunk should fail with fs.ErrNotExist, got: ", err)
+	}
+}
+
+func TestRepairRecipe(t *testing.T) {
+	logger.SetLevel(0)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	first := t.TempDir()
+	second := t.TempDir()
+	content := make([]byte, 2*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(first, "a"), content, 0664)
+	NewRepo(temp, 8<<10).Commit(first)
+	content = make([]byte, 3*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(second, "b"), content, 0664)
+	NewRepo(temp, 8<<10).Commit(second)
+	corruptRecipe := func(version string) {
+		recipe := filepath.Join(temp, version, recipeName)
+		raw, _ := os.ReadFile(recipe)
+		os.WriteFile(recipe, raw[:len(raw)/2], 0664)
+	}
+	corruptRecipe("00001")
+	// left by an interrupted recompression
+	leftover := filepath.Join(temp, "00001", chunksName, fmt.Sprintf(chunkIdFmt, 0)+".tmp")
+	os.WriteFile(leftover, []byte("partial"), 0664)
+
+	if err := NewRepo(temp, 8<<10).RepairRecipe(); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := NewRepo(temp, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, second, dest, "Repaired restore")
+
+	// this version only reuses the chunks of the previous one
+	NewRepo(temp, 8<<10).Commit(second)
+	corruptRecipe("00002")
+	if err := NewRepo(temp, 8<<10).RepairRecipe(); err == nil {
+		t.Error("recipe reusing previous chunks should not be rebuilt")
+	}
+}
+
+func TestPlainTail(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	for _, plain := range []bool{false, true} {
+		temp := t.TempDir()
+		source := t.TempDir()
+		content := make([]byte, 2*8<<10)
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, "a"), content, 0664)
+		NewRepo(temp, 8<<10).Commit(source)
+		// the tail is similar to the second stored chunk
+		tail := append([]byte(nil), content[:8<<10+6000]...)
+		tail[8<<10+10]++
+		os.WriteFile(filepath.Join(source, "a"), tail, 0664)
+		repo := NewRepo(temp, 8<<10)
+		repo.SetPlainTail(plain)
+		if err := repo.Commit(source); err != nil {
+			t.Fatal(err)
+		}
+		repo = NewRepo(temp, 8<<10)
+		repo.Init()
+		last := repo.recipe[len(repo.recipe)-1]
+		_, isTemp := last.(*TempChunk)
+		_, isDelta := last.(*DeltaChunk)
+		if plain && !isTemp {
+			t.Errorf("plain tail should be a temp chunk, actual: %T", last)
+		}
+		if !plain && !isDelta {
+			t.Errorf("tail should be delta-encoded, actual: %T", last)
+		}
+		dest := t.TempDir()
+		repo.Restore(dest)
+		assertSameTree(t, testutils.AssertSameFile, source, dest, fmt.Sprint("Restore with plain tail ", plain))
+	}
+}
+
+func TestIncompatibleChunkSize(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	NewRepo(temp, 8<<10).Commit(filepath.Join("testdata", "logs"))
+	// repos written before the config was introduced do not have it
+	os.Remove(filepath.Join(temp, configName))
+	if _, err := OpenRepo(temp, 4<<10); !errors.Is(err, ErrIncompatibleChunkSize) {
+		t.Error("opening with another chunk size should fail, actual:", err)
+	}
+	if _, err := OpenRepo(temp, 8<<10); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSplitFiles(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("first"), 0664)
+	os.Mkdir(filepath.Join(source, "b"), 0775)
+	os.WriteFile(filepath.Join(source, "b", "c"), []byte("second"), 0664)
+	os.WriteFile(filepath.Join(source, "b", "d"), []byte("third"), 0664)
+	os.WriteFile(filepath.Join(source, "e"), []byte("fourth"), 0664)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetSplitFiles(true)
+	repo.SetFileMap(true)
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	parts, _ := os.ReadDir(filepath.Join(temp, "00000", filesDirName))
+	testutils.AssertLen(t, 3, parts, "Parts")
+	if _, err := os.Stat(filepath.Join(temp, "00000", filesName)); err == nil {
+		t.Error("split version should not have a single file list")
+	}
+	var buff bytes.Buffer
+	if err := NewReadOnlyRepo(temp, 8<<10).RestoreFile("b/d", &buff); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, "third", buff.String(), "Restored file")
+
+	// the next version is stored as a delta of the split one
+	os.WriteFile(filepath.Join(source, "b", "d"), []byte("changed"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	dest := t.TempDir()
+	if err := NewRepo(temp, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore after split")
+	files, err := NewReadOnlyRepo(temp, 8<<10).VersionFiles(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 4, files, "Split files")
+}
+
+func TestVerifySample(t *testing.T) {
+	logger.SetLevel(0)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	NewRepo(temp, 8<<10).Commit(filepath.Join("testdata", "logs"))
+	chunks, _ := os.ReadDir(filepath.Join(temp, "00000", chunksName))
+	total := len(chunks)
+	for _, c := range chunks {
+		os.WriteFile(filepath.Join(temp, "00000", chunksName, c.Name()), []byte("corrupted"), 0664)
+	}
+	verified := func(percent float64, seed int64) int {
+		repo := NewReadOnlyRepo(temp, 8<<10)
+		repo.SetVerifySample(percent, seed)
+		var corrupt, count int
+		if _, err := fmt.Sscanf(repo.Verify().Error(), "%d corrupt chunks out of %d", &corrupt, &count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	testutils.AssertSame(t, total, verified(100, 1), "Chunks verified")
+	sampled := verified(50, 1)
+	if sampled == 0 || sampled >= total {
+		t.Errorf("sample of 50%% should verify some of the %d chunks, actual: %d", total, sampled)
+	}
+	testutils.AssertSame(t, sampled, verified(50, 1), "Chunks verified with the same seed")
+}
+
+func TestSourceFiles(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("first"), 0664)
+	os.Mkdir(filepath.Join(source, "b"), 0775)
+	os.WriteFile(filepath.Join(source, "b", "c"), []byte("second"), 0664)
+	os.WriteFile(filepath.Join(source, "d"), []byte("third"), 0664)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetSourceFiles([]string{"d", filepath.Join(source, "b", "c"), "b", "d"})
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	files, err := NewReadOnlyRepo(temp, 8<<10).VersionFiles(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, filepath.ToSlash(f.Path))
+	}
+	testutils.AssertSame(t, []string{"/d", "/b/c"}, paths, "Committed paths")
+
+	repo = NewRepo(temp, 8<<10)
+	outside := filepath.Join(t.TempDir(), "outside")
+	os.WriteFile(outside, []byte("fourth"), 0664)
+	repo.SetSourceFiles([]string{outside})
+	if err := repo.Commit(source); err == nil {
+		t.Error("files outside of the source should be rejected")
+	}
+}
+
+func TestChunkSizes(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 2*8<<10+100)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	h, err := NewReadOnlyRepo(temp, 8<<10).ChunkSizes(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, []int{64, 128, 256, 512, 1024, 2048, 4096, 8192}, h.Bounds, "Bounds")
+	testutils.AssertSame(t, []int{0, 1, 0, 0, 0, 0, 0, 0}, h.Counts, "Partial chunks")
+	testutils.AssertSame(t, 2, h.Full, "Full chunks")
+	h.Merge(h)
+	testutils.AssertSame(t, 4, h.Full, "Merged full chunks")
+	if _, err := NewReadOnlyRepo(temp, 8<<10).ChunkSizes(1); err == nil {
+		t.Error("missing version should fail")
+	}
+}
+
+func TestChunkRefs(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 2*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	os.WriteFile(filepath.Join(source, "b"), content, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+
+	refs, err := NewReadOnlyRepo(temp, 8<<10).ChunkRefs(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ChunkRef{
+		{Version: 0, Position: 1},
+		{Version: 1, Position: 1},
+		{Version: 1, Position: 3},
+	}
+	testutils.AssertSame(t, expected, refs, "Refs")
+
+	// the versions are designated by their index, not by their dir
+	os.Rename(filepath.Join(temp, "00001"), filepath.Join(temp, "00003"))
+	other := make([]byte, 8<<10)
+	rand.Read(other)
+	os.WriteFile(filepath.Join(source, "c"), other, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	refs, err = NewReadOnlyRepo(temp, 8<<10).ChunkRefs(-1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, []ChunkRef{{Version: 2, Position: 4}}, refs, "Refs of the latest version")
+	if _, err := NewReadOnlyRepo(temp, 8<<10).ChunkRefs(3, 0); err == nil {
+		t.Error("chunk of a missing version should fail")
+	}
+
+	version, index, err := ParseChunkRef("-1/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, -1, version, "Parsed version")
+	testutils.AssertSame(t, uint64(2), index, "Parsed index")
+	for _, wrong := range []string{"1", "a/1", "1/-2"} {
+		if _, _, err := ParseChunkRef(wrong); err == nil {
+			t.Errorf("%s should be rejected", wrong)
+		}
+	}
+}
+
+func TestCommitVersionGap(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 2*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	NewRepo(temp, 8<<10).Commit(source)
+	// the second version only references the chunks of the first one
+	os.Rename(filepath.Join(temp, "00001"), filepath.Join(temp, "00003"))
+
+	other := make([]byte, 8<<10)
+	rand.Read(other)
+	os.WriteFile(filepath.Join(source, "b"), other, 0664)
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, "00004", recipeName)); err != nil {
+		t.Error("the new version should follow the highest one:", err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, "00002")); err == nil {
+		t.Error("the new version should not fill the gap")
+	}
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	if err := NewReadOnlyRepo(temp, 8<<10).Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanRestore(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("first"), 0664)
+	os.Mkdir(filepath.Join(source, "d"), 0775)
+	os.WriteFile(filepath.Join(source, "d", "b"), []byte("second"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+
+	dest := t.TempDir()
+	os.WriteFile(filepath.Join(dest, "a"), []byte("existing"), 0664)
+	plan, err := NewReadOnlyRepo(temp, 8<<10).PlanRestore(filepath.Join(dest, "."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 2, plan.Files, "Files")
+	testutils.AssertSame(t, int64(11), plan.Size, "Size")
+	testutils.AssertSame(t, []string{filepath.Join(dest, "a")}, plan.Conflicts, "Conflicts")
+	if !plan.Fits() {
+		t.Error("a few bytes should fit")
+	}
+	entries, _ := os.ReadDir(dest)
+	testutils.AssertLen(t, 1, entries, "Destination entries")
+	content, _ := os.ReadFile(filepath.Join(dest, "a"))
+	testutils.AssertSame(t, "existing", string(content), "Existing file")
+
+	if _, err := NewReadOnlyRepo(temp, 8<<10).PlanRestore(filepath.Join(dest, "missing", "dir")); err != nil {
+		t.Error("a missing destination should be planned, actual:", err)
+	}
+}
+
+func TestMaxVersions(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	write := func(name string, size int) {
+		content := make([]byte, size)
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, name), content, 0664)
+	}
+	commit := func() {
+		repo := NewRepo(temp, 8<<10)
+		repo.SetMaxVersions(2)
+		if err := repo.Commit(source); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", 2*8<<10)
+	commit()
+	write("b", 8<<10)
+	commit()
+	os.Remove(filepath.Join(source, "b"))
+	write("c", 8<<10)
+	commit()
+	testutils.AssertSame(t, 2, NewReadOnlyRepo(temp, 8<<10).Versions(), "Versions after pruning")
+	write("d", 8<<10)
+	commit()
+
+	testutils.AssertSame(t, 2, NewReadOnlyRepo(temp, 8<<10).Versions(), "Versions")
+	if _, err := os.Stat(filepath.Join(temp, "00001")); err == nil {
+		t.Error("version 1 should have been removed")
+	}
+	if _, err := os.Stat(filepath.Join(temp, "00000", prunedName)); err != nil {
+		t.Error("version 0 should be kept for the chunks of a:", err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, "00000", recipeName)); err == nil {
+		t.Error("the recipe of version 0 should have been removed")
+	}
+	files, err := NewReadOnlyRepo(temp, 8<<10).VersionFiles(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 2, files, "Files of the oldest kept version")
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	if err := NewReadOnlyRepo(temp, 8<<10).Verify(); err != nil {
+		t.Error(err)
+	}
+	if err := NewRepo(temp, 8<<10).Prune(0); err == nil {
+		t.Error("pruning all the versions should be refused")
+	}
+}
+
+func TestRestoreIntoRepo(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	dest := t.TempDir()
+	temp := filepath.Join(dest, "backup")
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("first"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(filepath.Join(temp, "restored")); err == nil {
+		t.Error("restore inside the repo should be refused")
+	}
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); err != nil {
+		t.Error("restore next to the repo should succeed, actual:", err)
+	}
+
+	os.Mkdir(filepath.Join(source, "backup"), 0775)
+	os.WriteFile(filepath.Join(source, "backup", "config"), []byte("second"), 0664)
+	NewRepo(temp, 8<<10).Commit(source)
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); err == nil {
+		t.Error("restore overwriting the repo should be refused")
+	}
+	config, _ := os.ReadFile(filepath.Join(temp, configName))
+	if string(config) == "second" {
+		t.Error("repo config should not have been overwritten")
+	}
+}
+
+func TestFileBoundaries(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	for i, size := range []int{8<<10 + 100, 300, 2*8<<10 + 200} {
+		content := make([]byte, size)
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, fmt.Sprint(i)), content, 0664)
+	}
+	repo := NewRepo(temp, 8<<10)
+	repo.SetFileBoundaries(true)
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	repo = NewRepo(temp, 8<<10)
+	repo.Init()
+	locations := fileLocations(repo.files, repo.recipe)
+	testutils.AssertLen(t, 3, locations, "Locations")
+	next := 0
+	for _, loc := range locations {
+		testutils.AssertSame(t, int64(0), loc.Offset, "Offset of "+loc.Path)
+		testutils.AssertSame(t, next, loc.First, "First chunk of "+loc.Path)
+		next = loc.Last + 1
+	}
+	testutils.AssertSame(t, len(repo.recipe), next, "Chunks")
+	dest := t.TempDir()
+	repo.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore with file boundaries")
+}
+
+func TestVersionsIndex(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), make([]byte, 8<<10), 0664)
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(source, "b"), []byte("b"), 0664)
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(filepath.Join(temp, versionsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 2, strings.Count(string(raw), "\n"), "Lines of the versions index")
+	repo := NewReadOnlyRepo(temp, 8<<10)
+	entries, err := repo.VersionEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 2, entries, "Entries")
+	testutils.AssertSame(t, 1, entries[1].Version, "Version of the second entry")
+	testutils.AssertSame(t, 2, entries[1].Files, "Files of the second entry")
+	testutils.AssertSame(t, int64(8<<10+1), entries[1].Size, "Size of the second entry")
+	digest, _ := repo.VersionDigest(1)
+	testutils.AssertSame(t, hex.EncodeToString(digest), entries[1].Digest, "Digest of the second entry")
+
+	os.Remove(filepath.Join(temp, versionsName))
+	computed, err := repo.VersionEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, entries[1].Digest, computed[1].Digest, "Digest computed without index")
+	if err := NewRepo(temp, 8<<10).RebuildVersionsIndex(); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := repo.readVersionsIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 2, rebuilt, "Rebuilt entries")
+	testutils.AssertSame(t, entries[0].Files, rebuilt[0].Files, "Rebuilt files of the first entry")
+}
+
+func TestVersionsIndexNote(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("a"), 0664)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetVersionLabel("v1.0")
+	repo.SetVersionMessage(`first "release", with spaces`)
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(source, "b"), []byte("b"), 0664)
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(filepath.Join(temp, versionsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+	testutils.AssertLen(t, 2, lines, "Lines of the versions index")
+	if !strings.HasSuffix(lines[0], ` "v1.0" "first \"release\", with spaces"`) {
+		t.Error("the note should be quoted at the end of the line, actual:", lines[0])
+	}
+	testutils.AssertLen(t, 5, strings.Fields(lines[1]), "Fields of a line without note")
+
+	check := func(prefix string) {
+		infos, err := NewReadOnlyRepo(temp, 8<<10).ListVersions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertSame(t, "v1.0", infos[0].Label, prefix+" label")
+		testutils.AssertSame(t, `first "release", with spaces`, infos[0].Message, prefix+" message")
+		testutils.AssertSame(t, "", infos[1].Label, prefix+" label of the second version")
+		testutils.AssertSame(t, "", infos[1].Message, prefix+" message of the second version")
+	}
+	check("Indexed")
+	os.Remove(filepath.Join(temp, versionsName))
+	check("Computed")
+	if err := NewRepo(temp, 8<<10).RebuildVersionsIndex(); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := os.ReadFile(filepath.Join(temp, versionsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rebuilt), ` "v1.0" "first \"release\", with spaces"`+"\n") {
+		t.Error("the note should be kept in the rebuilt index, actual:", string(rebuilt))
+	}
+	check("Rebuilt")
+
+	os.WriteFile(filepath.Join(temp, versionsName), []byte(lines[0][:len(lines[0])-1]+"\n"), 0664)
+	indexed, err := NewReadOnlyRepo(temp, 8<<10).readVersionsIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 0, indexed, "Entries with an unterminated note")
+}
+
+func TestEmitBoundaries(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 4*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	edited := append([]byte("inserted"), content...)
+	os.WriteFile(filepath.Join(source, "a"), edited, 0664)
+	var buff bytes.Buffer
+	if err := NewRepo(temp, 8<<10).EmitBoundaries(source, &buff); err != nil {
+		t.Fatal(err)
+	}
+	var offset int64
+	kinds := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(buff.String()), "\n") {
+		var start, size int64
+		var kind string
+		if _, err := fmt.Sscanf(line, "%d %d %s", &start, &size, &kind); err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertSame(t, offset, start, "Offset of the chunk")
+		offset += size
+		kinds[kind]++
+	}
+	testutils.AssertSame(t, int64(len(edited)), offset, "End of the last chunk")
+	testutils.AssertSame(t, 4, kinds["stored"], "Stored chunks")
+	testutils.AssertSame(t, 1, NewReadOnlyRepo(temp, 8<<10).Versions(), "Versions")
+	if _, err := os.Stat(filepath.Join(temp, "00001")); err == nil {
+		t.Error("no version should have been created")
+	}
+}
+
+func TestStagedCommits(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	common := make([]byte, 4*8<<10)
+	rand.Read(common)
+	base := t.TempDir()
+	os.WriteFile(filepath.Join(base, "common"), common, 0664)
+	if err := NewRepo(temp, 8<<10).Commit(base); err != nil {
+		t.Fatal(err)
+	}
+	sources := []string{t.TempDir(), t.TempDir()}
+	names := make([]string, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		content := make([]byte, 3*8<<10+i)
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, "common"), common, 0664)
+		os.WriteFile(filepath.Join(source, "own"), content, 0664)
+		wg.Add(1)
+		go func(i int, source string) {
+			defer wg.Done()
+			var err error
+			if names[i], err = NewRepo(temp, 8<<10).Stage(source); err != nil {
+				t.Error(err)
+			}
+		}(i, source)
+	}
+	wg.Wait()
+	testutils.AssertSame(t, 1, NewReadOnlyRepo(temp, 8<<10).Versions(), "Versions before finalizing")
+	repo := NewRepo(temp, 8<<10)
+	staged, err := repo.StagedCommits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 2, staged, "Staged commits")
+	for i, name := range staged {
+		v, err := repo.FinalizeStaged(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertSame(t, i+1, v, "Index of the finalized version")
+	}
+	if err := NewReadOnlyRepo(temp, 8<<10).Verify(); err != nil {
+		t.Error(err)
+	}
+	for v := 1; v <= 2; v++ {
+		files, err := NewReadOnlyRepo(temp, 8<<10).VersionFiles(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertLen(t, 2, files, "Files of a finalized version")
+	}
+	// the common file must have been deduplicated against the first version
+	chunks, err := NewReadOnlyRepo(temp, 8<<10).VersionChunks(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shared int
+	for _, c := range chunks {
+		if s, ok := c.(*StoredChunk); ok && s.Id.Ver == 0 {
+			shared++
+		}
+	}
+	testutils.AssertSame(t, 4, shared, "Chunks shared with the first version")
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	last := sources[0]
+	if names[1] == staged[1] {
+		last = sources[1]
+	}
+	assertSameTree(t, testutils.AssertSameFile, last, dest, "Restore of the last staged commit")
+}
+
+func TestUniformInput(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	edge := make([]byte, 5000)
+	rand.Read(edge)
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"zeros", make([]byte, 2<<20+123)},
+		{"surrounded", append(append(edge, bytes.Repeat([]byte{7}, 2<<20+123)...), edge...)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			temp := t.TempDir()
+			source := t.TempDir()
+			os.WriteFile(filepath.Join(source, "uniform"), c.data, 0664)
+			if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(filepath.Join(temp, "00000", chunksName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) > 2 {
+				t.Errorf("the run of a single byte should be stored in a single chunk, got %d chunks", len(entries))
+			}
+			chunks, err := NewReadOnlyRepo(temp, 8<<10).VersionChunks(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var deltas int
+			for _, c := range chunks {
+				if _, ok := c.(*DeltaChunk); ok {
+					deltas++
+				}
+			}
+			if deltas > 2 {
+				t.Errorf("the run of a single byte should be made of references, got %d delta chunks", deltas)
+			}
+			dest := t.TempDir()
+			if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); err != nil {
+				t.Fatal(err)
+			}
+			assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+		})
+	}
+}
+
+func TestRepoOptions(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 3*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	if _, err := NewRepoWithOptions(temp, RepoOptions{}); err == nil {
+		t.Error("a repo without chunk size should not be opened")
+	}
+	repo, err := NewRepoWithOptions(temp, RepoOptions{
+		ChunkSize:    8 << 10,
+		Seed:         42,
+		Differ:       delta.Bsdiff{},
+		Patcher:      delta.Bsdiff{},
+		ChunkCache:   cache.New(0),
+		ReadWrapper:  utils.NopReadWrapper,
+		WriteWrapper: utils.NopWriteWrapper,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(filepath.Join(temp, "00000", chunksName, fmt.Sprintf(chunkIdFmt, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, content[:8<<10], stored, "Uncompressed chunk")
+
+	// the config of the repo takes precedence over the options
+	reopened, err := NewRepoWithOptions(temp, RepoOptions{ChunkSize: 4 << 10, Seed: 7, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := reopened.Options()
+	testutils.AssertSame(t, 8<<10, opts.ChunkSize, "Chunk size")
+	testutils.AssertSame(t, int64(42), opts.Seed, "Seed")
+	testutils.AssertSame(t, delta.Bsdiff{}, opts.Differ, "Differ")
+	testutils.AssertSame(t, true, opts.ReadOnly, "Read-only")
+	dest := t.TempDir()
+	if err := reopened.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+type customDiffer struct {
+	delta.Fdelta
+}
+
+func gzipReadWrapper(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func gzipWriteWrapper(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+func TestRepoOptionsCustomCodecs(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 3*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	opts := RepoOptions{
+		ChunkSize:    8 << 10,
+		Differ:       customDiffer{},
+		Patcher:      customDiffer{},
+		ReadWrapper:  gzipReadWrapper,
+		WriteWrapper: gzipWriteWrapper,
+	}
+	repo, err := NewRepoWithOptions(temp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRepoWithOptions(temp, RepoOptions{ReadOnly: true}); err == nil {
+		t.Error("a repo with custom codecs should not be opened without them")
+	}
+	opts.ReadOnly = true
+	reopened, err := NewRepoWithOptions(temp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, customDiffer{}, reopened.Options().Differ, "Differ")
+	dest := t.TempDir()
+	if err := reopened.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestIncompleteVersion(t *testing.T) {
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 3*8<<10)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	chunks := filepath.Join(temp, "00000", chunksName)
+	entries, err := os.ReadDir(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Error("temporary chunk file left: ", e.Name())
+		}
+	}
+	if err := NewReadOnlyRepo(temp, 8<<10).Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a chunk stored without its hashes, as by a crashed commit, which does
+	// not update the hash index either
+	os.WriteFile(filepath.Join(chunks, fmt.Sprintf(chunkIdFmt, 3)), []byte("garbage"), 0664)
+	os.Remove(filepath.Join(temp, indexName))
+	if err := NewReadOnlyRepo(temp, 8<<10).Verify(); !errors.Is(err, ErrIncompleteVersion) {
+		t.Errorf("verify should have flagged the version as incomplete, got: %v", err)
+	}
+	if err := NewRepo(temp, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	recipe, err := NewReadOnlyRepo(temp, 8<<10).VersionChunks(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range recipe {
+		if s, ok := c.(*StoredChunk); ok && s.Id.Ver == 0 {
+			t.Errorf("chunk %d of the incomplete version should not have been used", *s.Id)
+		}
+	}
+}
+
+func TestFsync(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	content := make([]byte, 3*8<<10+100)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(source, "a"), content, 0664)
+	repo := NewRepo(temp, 8<<10)
+	repo.SetFsync(true)
+	if err := repo.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.syncVersion(0); err != nil {
+		t.Error("sync of the committed version: ", err)
+	}
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(temp, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestMergeRepos(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	common := make([]byte, 4*8<<10)
+	rand.Read(common)
+	commit := func(repo string, own int) string {
+		source := t.TempDir()
+		content := make([]byte, own)
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, "common"), common, 0664)
+		os.WriteFile(filepath.Join(source, "own"), content, 0664)
+		if err := NewRepo(repo, 8<<10).Commit(source); err != nil {
+			t.Fatal(err)
+		}
+		return source
+	}
+	// sets the commit times of the versions of the given repo
+	setTimes := func(repo string, times ...int64) {
+		r := NewRepo(repo, 8<<10)
+		entries, err := r.readVersionsIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n, e := range entries {
+			e.Time = time.Unix(times[n], 0)
+			entries[n] = e
+		}
+		if err := r.writeVersionsIndex(entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repoA, repoB := t.TempDir(), t.TempDir()
+	commit(repoA, 8<<10)
+	last := commit(repoA, 2*8<<10)
+	commit(repoB, 3*8<<10)
+	setTimes(repoA, 100, 300)
+	setTimes(repoB, 200)
+
+	dest := filepath.Join(t.TempDir(), "merged")
+	if err := MergeRepos(dest, NewReadOnlyRepo(repoA, 8<<10), NewReadOnlyRepo(repoB, 8<<10)); err != nil {
+		t.Fatal(err)
+	}
+	merged := NewReadOnlyRepo(dest, 8<<10)
+	testutils.AssertSame(t, 3, merged.Versions(), "Merged versions")
+	for i, expected := range []struct {
+		repo    string
+		version int
+	}{{repoA, 0}, {repoB, 0}, {repoA, 1}} {
+		digest, _ := NewReadOnlyRepo(expected.repo, 8<<10).VersionDigest(expected.version)
+		actual, _ := merged.VersionDigest(i)
+		testutils.AssertSame(t, digest, actual, fmt.Sprintf("Digest of merged version %d", i))
+	}
+	entries, err := merged.VersionEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, int64(200), entries[1].Time.Unix(), "Time of the merged version")
+	chunks := func(repo string) (n int) {
+		files, _ := filepath.Glob(filepath.Join(repo, "0*", chunksName, "*"))
+		return len(files)
+	}
+	// the common file is only stored by the first version
+	testutils.AssertSame(t, chunks(repoA)+chunks(repoB)-4, chunks(dest), "Merged chunks")
+	if err := merged.Verify(); err != nil {
+		t.Error(err)
+	}
+	restored := t.TempDir()
+	if err := merged.Restore(restored); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, last, restored, "Restore of the latest merged version")
+}
+
+func TestRestoreAt(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	repo := t.TempDir()
+	var sources []string
+	for i := 0; i < 3; i++ {
+		source := t.TempDir()
+		content := make([]byte, (i+1)*8<<10)
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, "file"), content, 0664)
+		if err := NewRepo(repo, 8<<10).Commit(source); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, source)
+	}
+	r := NewRepo(repo, 8<<10)
+	entries, err := r.readVersionsIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, e := range entries {
+		e.Time = time.Unix(int64(100*(n+1)), 0)
+		entries[n] = e
+	}
+	if err := r.writeVersionsIndex(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	for at, expected := range map[int64]int{100: 0, 250: 1, 300: 2, 1000: 2} {
+		v, err := r.VersionAt(time.Unix(at, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertSame(t, expected, v, fmt.Sprintf("Version at %d", at))
+	}
+	if _, err := r.VersionAt(time.Unix(50, 0)); err == nil {
+		t.Error("No version should predate the first commit")
+	}
+
+	v, _ := r.VersionAt(time.Unix(250, 0))
+	dest := t.TempDir()
+	restorer := NewReadOnlyRepo(repo, 8<<10)
+	restorer.SetRestoreVersion(v)
+	if err := restorer.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, sources[1], dest, "Restore at")
+
+	restorer.SetRestoreVersion(3)
+	if err := restorer.Restore(t.TempDir()); err == nil {
+		t.Error("Restoring a missing version should fail")
+	}
+}
+
+func TestRestoreVersion(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	repo := t.TempDir()
+	sources := []string{
+		filepath.Join("testdata", "logs", "1"),
+		filepath.Join("testdata", "logs", "2"),
+		filepath.Join("testdata", "logs", "3"),
+	}
+	for _, source := range sources {
+		if err := NewRepo(repo, 8<<10).Commit(source); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewReadOnlyRepo(repo, 8<<10)
+	for version, expected := range map[int]string{0: sources[0], 1: sources[1], 2: sources[2], -1: sources[2], -3: sources[0]} {
+		dest := t.TempDir()
+		if err := r.RestoreVersion(dest, version); err != nil {
+			t.Fatal(err)
+		}
+		assertSameTree(t, testutils.AssertSameFile, expected, dest, fmt.Sprint("Restore version ", version))
+	}
+	for _, version := range []int{3, -4} {
+		if err := r.RestoreVersion(t.TempDir(), version); err == nil {
+			t.Errorf("restoring the missing version %d should fail", version)
+		}
+	}
+}
+
+func TestRestoreModTimes(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	times := map[string]time.Time{
+		"old":    time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC),
+		"recent": time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC),
+	}
+	for name, mtime := range times {
+		path := filepath.Join(source, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := t.TempDir()
+	if err := NewRepo(repo, 8<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(repo, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, mtime := range times {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("restored %s should be modified at %s, not %s", name, mtime, info.ModTime())
+		}
+	}
+}
+
+// memMetaStore is a MetaStore keeping the metadata in memory.
+type memMetaStore struct {
+	mutex sync.Mutex
+	metas map[string][]byte
+}
+
+type memMetaWriter struct {
+	bytes.Buffer
+	store *memMetaStore
+	key   string
+}
+
+func (w *memMetaWriter) Close() error {
+	w.store.mutex.Lock()
+	defer w.store.mutex.Unlock()
+	w.store.metas[w.key] = w.Bytes()
+	return nil
+}
+
+func (s *memMetaStore) ReadMeta(version string, name string) (io.ReadCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	meta, ok := s.metas[filepath.Join(version, name)]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(meta)), nil
+}
+
+func (s *memMetaStore) WriteMeta(version string, name string) (io.WriteCloser, error) {
+	return &memMetaWriter{store: s, key: filepath.Join(version, name)}, nil
+}
+
+func TestMetaStore(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	repo := t.TempDir()
+	store := &memMetaStore{metas: make(map[string][]byte)}
+	open := func() *Repo {
+		r, err := NewRepoWithOptions(repo, RepoOptions{ChunkSize: 8 << 10, MetaStore: store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	source := filepath.Join("testdata", "logs", "1")
+	if err := open().Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	if err := open().Commit(filepath.Join("testdata", "logs", "2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filesName, recipeName, hashesName} {
+		if _, err := os.Stat(filepath.Join(repo, "00000", name)); err == nil {
+			t.Errorf("%s should not be stored in the version dir", name)
+		}
+		if _, ok := store.metas[filepath.Join(repo, "00001", name)]; !ok {
+			t.Errorf("%s should be in the meta store", name)
+		}
+	}
+	dest := t.TempDir()
+	r := open()
+	r.SetRestoreVersion(0)
+	if err := r.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+}
+
+func TestMerkleRoots(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	repo := t.TempDir()
+	source := t.TempDir()
+	same := make([]byte, 2*8<<10)
+	changed := make([]byte, 3*8<<10+100)
+	rand.Read(same)
+	rand.Read(changed)
+	os.WriteFile(filepath.Join(source, "same"), same, 0664)
+	os.WriteFile(filepath.Join(source, "changed"), changed, 0664)
+	os.WriteFile(filepath.Join(source, "empty"), nil, 0664)
+	commit := func() {
+		r := NewRepo(repo, 8<<10)
+		r.SetMerkleRoots(true)
+		if err := r.Commit(source); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit()
+	changed[8<<10] ^= 0xff
+	os.WriteFile(filepath.Join(source, "changed"), changed, 0664)
+	commit()
+
+	r := NewReadOnlyRepo(repo, 8<<10)
+	roots := func(version int) map[string][]byte {
+		files, err := r.VersionFiles(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := make(map[string][]byte)
+		for _, f := range files {
+			ret[filepath.Base(f.Path)] = f.Merkle
+		}
+		return ret
+	}
+	first, second := roots(0), roots(1)
+	leaf := func(data []byte) []byte {
+		h := r.newChecksum()
+		h.Write([]byte{0})
+		h.Write(data)
+		return h.Sum(nil)
+	}
+	node := r.newChecksum()
+	node.Write([]byte{1})
+	node.Write(leaf(same[:8<<10]))
+	node.Write(leaf(same[8<<10:]))
+	testutils.AssertSame(t, node.Sum(nil), first["same"], "Merkle root of same")
+	testutils.AssertSame(t, leaf(nil), first["empty"], "Merkle root of empty")
+	testutils.AssertSame(t, first["same"], second["same"], "Merkle root of same in both versions")
+	if bytes.Equal(first["changed"], second["changed"]) {
+		t.Error("Merkle root of changed should differ between versions")
+	}
+
+	NewRepo(repo, 8<<10).Commit(source)
+	if root := roots(2)["same"]; root != nil {
+		t.Errorf("Merkle root should not be stored by default, got %x", root)
+	}
+}
+
+// countingRemote counts the chunks put into the wrapped SyncRemote.
+type countingRemote struct {
+	SyncRemote
+	chunks int
+}
+
+func (c *countingRemote) Put(path string, data []byte) error {
+	if filepath.Base(filepath.Dir(path)) == chunksName {
+		c.chunks++
+	}
+	return c.SyncRemote.Put(path, data)
+}
+
+func TestSync(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	local := t.TempDir()
+	remote := filepath.Join(t.TempDir(), "remote")
+	sync := func() int {
+		reqReader, reqWriter := io.Pipe()
+		respReader, respWriter := io.Pipe()
+		served := make(chan error)
+		go func() {
+			served <- ServeSync(NewRepo(remote, 8<<10), reqReader, respWriter)
+		}()
+		client := &countingRemote{SyncRemote: NewSyncClient(respReader, reqWriter)}
+		if err := NewReadOnlyRepo(local, 8<<10).Sync(client); err != nil {
+			t.Fatal(err)
+		}
+		reqWriter.Close()
+		if err := <-served; err != nil {
+			t.Fatal(err)
+		}
+		return client.chunks
+	}
+	restore := func(version int) string {
+		dest := t.TempDir()
+		r := NewReadOnlyRepo(remote, 8<<10)
+		r.SetRestoreVersion(version)
+		if err := r.Restore(dest); err != nil {
+			t.Fatal(err)
+		}
+		return dest
+	}
+	for _, v := range []string{"1", "2"} {
+		NewRepo(local, 8<<10).Commit(filepath.Join("testdata", "logs", v))
+	}
+	chunks, _ := filepath.Glob(filepath.Join(local, "0*", chunksName, "*"))
+	testutils.AssertSame(t, len(chunks), sync(), "Chunks sent by the first sync")
+	assertSameTree(t, testutils.AssertSameFile, filepath.Join("testdata", "logs", "2"), restore(-1), "Synced restore")
+
+	NewRepo(local, 8<<10).Commit(filepath.Join("testdata", "logs", "3"))
+	added, _ := filepath.Glob(filepath.Join(local, "00002", chunksName, "*"))
+	testutils.AssertSame(t, len(added), sync(), "Chunks sent by the second sync")
+	assertSameTree(t, testutils.AssertSameFile, filepath.Join("testdata", "logs", "3"), restore(-1), "Synced restore")
+	assertSameTree(t, testutils.AssertSameFile, filepath.Join("testdata", "logs", "1"), restore(0), "Synced restore")
+
+	if err := NewRepo(local, 8<<10).Prune(1); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 0, sync(), "Chunks sent after pruning")
+	testutils.AssertSame(t, 1, NewReadOnlyRepo(remote, 8<<10).Versions(), "Synced versions")
+	assertSameTree(t, testutils.AssertSameFile, filepath.Join("testdata", "logs", "3"), restore(-1), "Synced restore after pruning")
+
+	if err := NewRepo(local, 8<<10).Recompress("none"); err != nil {
+		t.Fatal(err)
+	}
+	chunks, _ = filepath.Glob(filepath.Join(local, "0*", chunksName, "*"))
+	testutils.AssertSame(t, len(chunks), sync(), "Chunks sent after recompressing")
+	assertSameTree(t, testutils.AssertSameFile, filepath.Join("testdata", "logs", "3"), restore(-1), "Synced restore after recompressing")
+}
+
+func TestSyncSameSize(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	remote := filepath.Join(t.TempDir(), "remote")
+	commit := func() (string, string) {
+		local := t.TempDir()
+		source := t.TempDir()
+		content := make([]byte, 2*8<<10)
+		rand.Read(content)
+		os.WriteFile(filepath.Join(source, "a"), content, 0664)
+		NewRepo(local, 8<<10).Commit(source)
+		return local, source
+	}
+	first, _ := commit()
+	if err := SyncRepos(NewReadOnlyRepo(first, 8<<10), NewRepo(remote, 8<<10)); err != nil {
+		t.Fatal(err)
+	}
+	// the chunks of the other repo have the same ids and sizes
+	other, source := commit()
+	client := &countingRemote{SyncRemote: newRepoRemote(NewRepo(remote, 8<<10))}
+	if err := NewReadOnlyRepo(other, 8<<10).Sync(client); err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 2, client.chunks, "Chunks sent with other content")
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(remote, 8<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Synced restore")
+}
+
+func TestCompressionDictionary(t *testing.T) {
+	logger.SetLevel(1)
+	defer logger.SetLevel(4)
+	source := t.TempDir()
+	for i := 0; i < 64; i++ {
+		var log bytes.Buffer
+		for j := 0; j < 20; j++ {
+			fmt.Fprintf(&log, "2021-11-08 10:%02d:%02d [INFO] dna-backup.repo: stored chunk %d of version %d\n", i%60, j, rand.Intn(1000), i)
+		}
+		os.WriteFile(filepath.Join(source, fmt.Sprintf("%02d.log", i)), log.Bytes(), 0664)
+	}
+	chunksSize := func(repo string) (size int64) {
+		chunks, _ := filepath.Glob(filepath.Join(repo, "0*", chunksName, "*"))
+		for _, c := range chunks {
+			info, _ := os.Stat(c)
+			size += info.Size()
+		}
+		return
+	}
+	plain, dict := t.TempDir(), t.TempDir()
+	NewRepo(plain, 1<<10).Commit(source)
+	r := NewRepo(dict, 1<<10)
+	r.SetCompressionDictionary(true)
+	if err := r.Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dict, dictName)); err != nil {
+		t.Fatal("dictionary should be stored: ", err)
+	}
+	if chunksSize(dict) >= chunksSize(plain) {
+		t.Errorf("chunks with a dictionary should be smaller: %d >= %d", chunksSize(dict), chunksSize(plain))
+	}
+	for _, repo := range []string{plain, dict} {
+		dest := t.TempDir()
+		r := NewReadOnlyRepo(repo, 1<<10)
+		if err := r.Verify(); err != nil {
+			t.Error(err)
+		}
+		if err := r.Restore(dest); err != nil {
+			t.Fatal(err)
+		}
+		assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore")
+	}
+
+	os.WriteFile(filepath.Join(source, "new.log"), []byte("2021-11-08 11:00:00 [INFO] dna-backup.repo: new file\n"), 0664)
+	if err := NewRepo(dict, 1<<10).Commit(source); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRepo(dict, 1<<10).Recompress("none"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dict, dictName)); err == nil {
+		t.Error("dictionary should be removed by the recompression")
+	}
+	dest := t.TempDir()
+	if err := NewReadOnlyRepo(dict, 1<<10).Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Restore after recompression")
+}
+
+func TestListVersions(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	repo := t.TempDir()
+	for _, v := range []string{"2", "3"} {
+		if err := NewRepo(repo, 8<<10).Commit(filepath.Join("testdata", "logs", v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	infos, err := NewReadOnlyRepo(repo, 8<<10).ListVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 2, infos, "Versions")
+	for i, expected := range []struct {
+		files int
+		size  int64
+	}{{2, 6592 + 16307}, {1, 95909}} {
+		chunks, _ := filepath.Glob(filepath.Join(repo, fmt.Sprintf(versionFmt, i), chunksName, "*"))
+		testutils.AssertSame(t, i, infos[i].Version, "Version")
+		testutils.AssertSame(t, expected.files, infos[i].Files, fmt.Sprint("Files of version ", i))
+		testutils.AssertSame(t, expected.size, infos[i].Size, fmt.Sprint("Size of version ", i))
+		testutils.AssertSame(t, len(chunks), infos[i].Chunks, fmt.Sprint("Chunks of version ", i))
+		if infos[i].Time.IsZero() {
+			t.Errorf("version %d has no time", i)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChunkHits counts the references to a chunk.
+type ChunkHits struct {
+	Id   ChunkId
+	Hits int
+}
+
+// DedupReport describes how the content of a version has been stored.
+type DedupReport struct {
+	Version      int
+	StoredChunks int // new chunks stored by the version
+	StoredBytes  int
+	DeltaChunks  int
+	DeltaBytes   int // size of the patches of the delta chunks
+	InlineChunks int
+	InlineBytes  int
+	ReusedChunks int // references to already stored chunks
+	ReusedBytes  int
+	Top          []ChunkHits // most referenced chunks, in decreasing order
+}
+
+func (d DedupReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "version %d:\n", d.Version)
+	fmt.Fprintf(&b, "  stored: %d chunks, %d bytes\n", d.StoredChunks, d.StoredBytes)
+	fmt.Fprintf(&b, "  delta:  %d chunks, %d bytes\n", d.DeltaChunks, d.DeltaBytes)
+	fmt.Fprintf(&b, "  inline: %d chunks, %d bytes\n", d.InlineChunks, d.InlineBytes)
+	fmt.Fprintf(&b, "  reused: %d chunks, %d bytes\n", d.ReusedChunks, d.ReusedBytes)
+	fmt.Fprintf(&b, "top %d reused chunks:\n", len(d.Top))
+	for _, h := range d.Top {
+		fmt.Fprintf(&b, "  %05d/%015d %d hits\n", h.Id.Ver, h.Id.Idx, h.Hits)
+	}
+	return b.String()
+}
+
+// DedupReport loads the latest version of the repo and reports how its recipe
+// has been stored, with the top most referenced chunks. A chunk is referenced
+// each time it is reused as is or as the source of a delta chunk.
+func (r *Repo) DedupReport(top int) (report DedupReport, err error) {
+	if err := r.Init(); err != nil {
+		return report, err
+	}
+	if len(r.versions) == 0 {
+		return report, fmt.Errorf("repo is empty")
+	}
+	report = dedupReport(r.recipe, len(r.versions)-1, top)
+	return
+}
+
+func dedupReport(recipe []Chunk, version int, top int) (d DedupReport) {
+	d.Version = version
+	hits := make(map[ChunkId]int)
+	for _, c := range recipe {
+		switch c := c.(type) {
+		case *StoredChunk:
+			if _, seen := hits[*c.Id]; !seen && c.Id.Ver == version {
+				hits[*c.Id] = 0
+				d.StoredChunks++
+				d.StoredBytes += c.Len()
+				continue
+			}
+			hits[*c.Id]++
+			d.ReusedChunks++
+			d.ReusedBytes += c.Len()
+		case *DeltaChunk:
+			hits[*c.Source]++
+			d.DeltaChunks++
+			d.DeltaBytes += len(c.Patch)
+		default:
+			d.InlineChunks++
+			d.InlineBytes += c.Len()
+		}
+	}
+	for id, n := range hits {
+		if n > 0 {
+			d.Top = append(d.Top, ChunkHits{id, n})
+		}
+	}
+	sort.Slice(d.Top, func(i, j int) bool {
+		a, b := d.Top[i], d.Top[j]
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		if a.Id.Ver != b.Id.Ver {
+			return a.Id.Ver < b.Id.Ver
+		}
+		return a.Id.Idx < b.Id.Idx
+	})
+	if len(d.Top) > top {
+		d.Top = d.Top[:top]
+	}
+	return
+}
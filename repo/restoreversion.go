@@ -0,0 +1,60 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetRestoreVersion sets the version restored by Restore, negative numbers
+// counting from the latest one. By default the latest version is restored.
+func (r *Repo) SetRestoreVersion(version int) {
+	r.restoreVersion = version
+	r.hasRestoreVersion = true
+}
+
+// selectedVersion returns the version set by SetRestoreVersion, or -1 for the
+// latest one.
+func (r *Repo) selectedVersion() int {
+	if !r.hasRestoreVersion {
+		return -1
+	}
+	return r.restoreVersion
+}
+
+// VersionAt returns the latest version committed at or before t.
+func (r *Repo) VersionAt(t time.Time) (int, error) {
+	entries, err := r.VersionEntries()
+	if err != nil {
+		return 0, err
+	}
+	version := -1
+	for _, e := range entries {
+		if !e.Time.After(t) && (version < 0 || !e.Time.Before(entries[version].Time)) {
+			version = e.Version
+		}
+	}
+	if version < 0 {
+		if len(entries) == 0 {
+			return 0, fmt.Errorf("no version committed at or before %s, repo is empty", t.Format(time.RFC3339))
+		}
+		return 0, fmt.Errorf("no version committed at or before %s, the oldest one is from %s", t.Format(time.RFC3339), entries[0].Time.Format(time.RFC3339))
+	}
+	return version, nil
+}
@@ -0,0 +1,54 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// SetRetry makes chunk IO operations be attempted up to attempts times when
+// they fail with a transient error. The delay between two attempts starts at
+// the given one and doubles each time. The default of 1 attempt never retries.
+func (r *Repo) SetRetry(attempts int, delay time.Duration) {
+	r.retryAttempts = attempts
+	r.retryDelay = delay
+}
+
+// isPermanent tells if an IO error cannot be fixed by trying again.
+func isPermanent(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrReadOnly)
+}
+
+// retry calls op until it succeeds, fails with a permanent error or has been
+// attempted the configured number of times. It returns the last error.
+func (r *Repo) retry(what string, op func() error) (err error) {
+	delay := r.retryDelay
+	for attempt := 1; ; attempt++ {
+		err = op()
+		if err == nil || isPermanent(err) || attempt >= r.retryAttempts {
+			return
+		}
+		logger.Warningf("%s, attempt %d/%d failed, retrying in %s: %s", what, attempt, r.retryAttempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,160 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SelfTestReport holds the results of a self-test.
+type SelfTestReport struct {
+	Files   int
+	Size    int64
+	Commit  time.Duration
+	Restore time.Duration
+	Dedup   DedupReport
+}
+
+func (s SelfTestReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "synthetic tree: %d files, %d bytes\n", s.Files, s.Size)
+	fmt.Fprintf(&b, "commit:  %s\n", s.Commit.Round(time.Millisecond))
+	fmt.Fprintf(&b, "restore: %s\n", s.Restore.Round(time.Millisecond))
+	fmt.Fprint(&b, s.Dedup)
+	return b.String()
+}
+
+// SelfTest generates a synthetic tree from the given seed in dir, commits it
+// into a new repo, restores it and checks that the restored tree is identical
+// to the generated one. The tree holds files of various sizes around the chunk
+// size, along with exact and modified copies of some of them.
+func SelfTest(dir string, chunkSize int, seed int64) (report SelfTestReport, err error) {
+	source := filepath.Join(dir, "source")
+	dest := filepath.Join(dir, "restore")
+	path := filepath.Join(dir, "repo")
+	for _, d := range []string{source, dest, path} {
+		if err = os.MkdirAll(d, 0775); err != nil {
+			return
+		}
+	}
+	if report.Files, report.Size, err = generateTree(source, chunkSize, seed); err != nil {
+		return
+	}
+	start := time.Now()
+	if err = NewRepo(path, chunkSize).Commit(source); err != nil {
+		return
+	}
+	report.Commit = time.Since(start)
+	start = time.Now()
+	restored := NewReadOnlyRepo(path, chunkSize)
+	restored.SetRestoreVerify(true)
+	if err = restored.Restore(dest); err != nil {
+		return
+	}
+	report.Restore = time.Since(start)
+	if err = compareTrees(source, dest); err != nil {
+		return
+	}
+	// the restore streams the recipe without keeping it
+	if err = restored.loadRecipes(restored.versions); err != nil {
+		return
+	}
+	report.Dedup = dedupReport(restored.recipe, 0, 5)
+	return
+}
+
+// generateTree writes the synthetic tree into dir and returns its number of
+// files and total size.
+func generateTree(dir string, chunkSize int, seed int64) (count int, size int64, err error) {
+	random := rand.New(rand.NewSource(seed))
+	sizes := []int{0, 1, 100, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17, 10 * chunkSize}
+	write := func(name string, content []byte) {
+		if err != nil {
+			return
+		}
+		p := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(p), 0775); err != nil {
+			return
+		}
+		err = os.WriteFile(p, content, 0664)
+		count++
+		size += int64(len(content))
+	}
+	var biggest []byte
+	for i, s := range sizes {
+		content := make([]byte, s)
+		random.Read(content)
+		write(fmt.Sprintf("random/%02d", i), content)
+		biggest = content
+	}
+	modified := append([]byte(nil), biggest...)
+	for i := 0; i < 3; i++ {
+		modified[random.Intn(len(modified))]++
+	}
+	write("copies/exact", biggest)
+	write("copies/modified", modified)
+	write("copies/shifted", append([]byte("shifted"), biggest...))
+	write("text/repeated", bytes.Repeat([]byte("dna-backup self-test\n"), 4*chunkSize/21))
+	return
+}
+
+// compareTrees returns an error if the regular files of a and b differ.
+func compareTrees(a string, b string) error {
+	var checked int
+	err := filepath.Walk(a, func(p string, i fs.FileInfo, err error) error {
+		if err != nil || i.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(a, p)
+		if err != nil {
+			return err
+		}
+		expected, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		actual, err := os.ReadFile(filepath.Join(b, rel))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(expected, actual) {
+			return fmt.Errorf("restored %s differs", rel)
+		}
+		checked++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(b, func(p string, i fs.FileInfo, err error) error {
+		if err == nil && !i.IsDir() {
+			checked--
+		}
+		if checked < 0 {
+			return fmt.Errorf("restored unexpected file %s", p)
+		}
+		return err
+	})
+}
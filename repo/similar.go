@@ -0,0 +1,159 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SimilarFiles returns the groups of files of the latest version whose content
+// is made of chunks that share sketch features. Two files are similar if at
+// least minShared of the features of the smallest one are shared with the
+// other. The delta chunks count as their source, and the inline chunks, having
+// no sketch, are not taken into account.
+func (r *Repo) SimilarFiles(minShared float64) ([][]string, error) {
+	if err := r.Init(); err != nil {
+		return nil, err
+	}
+	if len(r.versions) == 0 {
+		return nil, fmt.Errorf("repo is empty")
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	r.loadHashes(r.versions, &wg)
+	chunkFeatures := make(map[ChunkId][]uint64)
+	for sk, ids := range r.sketches {
+		for _, id := range ids {
+			chunkFeatures[*id] = append(chunkFeatures[*id], sk)
+		}
+	}
+	files, features := r.filesFeatures(chunkFeatures)
+
+	owners := make(map[uint64][]int)
+	for i, set := range features {
+		for f := range set {
+			owners[f] = append(owners[f], i)
+		}
+	}
+	shared := make(map[[2]int]int)
+	for _, idx := range owners {
+		for a := 0; a < len(idx); a++ {
+			for b := a + 1; b < len(idx); b++ {
+				shared[[2]int{idx[a], idx[b]}]++
+			}
+		}
+	}
+	groups := newUnionFind(len(files))
+	for pair, n := range shared {
+		smallest := len(features[pair[0]])
+		if l := len(features[pair[1]]); l < smallest {
+			smallest = l
+		}
+		if float64(n) >= minShared*float64(smallest) {
+			groups.union(pair[0], pair[1])
+		}
+	}
+	members := make(map[int][]string)
+	var roots []int
+	for i, f := range files {
+		root := groups.find(i)
+		if _, exists := members[root]; !exists {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], f.Path)
+	}
+	var similar [][]string
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			similar = append(similar, members[root])
+		}
+	}
+	return similar, nil
+}
+
+// filesFeatures returns the regular files of the latest version that have at
+// least one sketch feature, along with the set of features of each of them.
+// Only the chunks entirely inside of a file are taken into account, as the ones
+// that overlap two files would make them look similar.
+func (r *Repo) filesFeatures(chunkFeatures map[ChunkId][]uint64) (files []File, features []map[uint64]bool) {
+	starts := make([]int64, len(r.recipe)+1)
+	for i, c := range r.recipe {
+		starts[i+1] = starts[i] + int64(c.Len())
+	}
+	var offset int64
+	var first int
+	for _, f := range r.files {
+		if !f.isRegular() {
+			continue
+		}
+		start, end := offset, offset+f.Size
+		offset = end
+		for first < len(r.recipe) && starts[first] < start {
+			first++
+		}
+		set := make(map[uint64]bool)
+		for i := first; i < len(r.recipe) && starts[i+1] <= end; i++ {
+			var id *ChunkId
+			switch c := r.recipe[i].(type) {
+			case *StoredChunk:
+				id = c.Id
+			case *DeltaChunk:
+				id = c.Source
+			default:
+				continue
+			}
+			for _, sk := range chunkFeatures[*id] {
+				set[sk] = true
+			}
+		}
+		if len(set) > 0 {
+			files = append(files, f)
+			features = append(features, set)
+		}
+	}
+	return
+}
+
+// unionFind is a disjoint-set of integers.
+type unionFind []int
+
+func newUnionFind(n int) unionFind {
+	u := make(unionFind, n)
+	for i := range u {
+		u[i] = i
+	}
+	return u
+}
+
+func (u unionFind) find(i int) int {
+	for u[i] != i {
+		u[i] = u[u[i]]
+		i = u[i]
+	}
+	return i
+}
+
+func (u unionFind) union(a, b int) {
+	ra, rb := u.find(a), u.find(b)
+	if ra < rb {
+		u[rb] = ra
+	} else {
+		u[ra] = rb
+	}
+}
@@ -0,0 +1,63 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// SetSourceFiles makes the commits store only the given files of their source
+// instead of walking it. The relative paths are relative to the source, the
+// absolute ones must be inside it. A nil list walks the source again.
+func (r *Repo) SetSourceFiles(paths []string) {
+	r.sourceFiles = paths
+}
+
+// listSourceFiles returns the entries of the given files under root, in the
+// given order, reporting with warn the ones that cannot be listed.
+func listSourceFiles(root string, paths []string, warn func(v ...interface{})) []File {
+	logger.Infof("list %d files from %s", len(paths), root)
+	files := make([]File, 0, len(paths))
+	seen := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, p)
+		}
+		p = filepath.Clean(p)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		i, err := os.Lstat(p)
+		if err != nil {
+			warn(err)
+			continue
+		}
+		if i.IsDir() {
+			logger.Warning("skipping directory ", p)
+			continue
+		}
+		if file, ok := newFile(root, p, i, warn); ok {
+			files = append(files, file)
+		}
+	}
+	return files
+}
@@ -0,0 +1,92 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// Types of the special files recorded in the file list.
+const (
+	specialFifo  = "fifo"
+	specialChar  = "char"
+	specialBlock = "block"
+)
+
+// isRegular returns true if the file has a content, being neither a symlink nor
+// a special file.
+func (f File) isRegular() bool {
+	return f.Link == "" && f.Special == ""
+}
+
+// SetSpecials enables or disables recording the named pipes and the device
+// nodes on commit, without content, and recreating them on restore. When
+// disabled (the default), they are skipped with a warning.
+func (r *Repo) SetSpecials(enabled bool) {
+	r.specials = enabled
+}
+
+// specialFile returns the entry of the special file at path. Sockets and
+// irregular files cannot be recorded.
+func specialFile(p string, i fs.FileInfo) (File, error) {
+	f := File{Path: p}
+	mode := i.Mode()
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		f.Special = specialFifo
+	case mode&fs.ModeCharDevice != 0:
+		f.Special = specialChar
+	case mode&fs.ModeDevice != 0:
+		f.Special = specialBlock
+	default:
+		return f, fmt.Errorf("unsupported file type %s: %s", mode.Type(), p)
+	}
+	if f.Special != specialFifo {
+		f.Rdev = fileRdev(i)
+	}
+	return f, nil
+}
+
+// skipSpecials returns the files without the special ones, warning for each.
+func (r *Repo) skipSpecials(files []File) []File {
+	kept := files[:0]
+	for _, f := range files {
+		if f.Special != "" {
+			r.warn("skipping special file ", f.Path)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// restoreSpecial recreates the special file f at path. If resuming, a special
+// file of the same type already there is kept.
+func (r *Repo) restoreSpecial(path string, f File) error {
+	if info, err := os.Lstat(path); r.resume && err == nil {
+		if existing, err := specialFile(path, info); err == nil && existing.Special == f.Special && existing.Rdev == f.Rdev {
+			logger.Debug("already restored ", f.Path)
+			return nil
+		}
+	}
+	return createSpecial(path, f, r.fileMode)
+}
@@ -0,0 +1,51 @@
+// +build linux
+
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileRdev returns the device number of the given device node.
+func fileRdev(i fs.FileInfo) uint64 {
+	if st, ok := i.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Rdev)
+	}
+	return 0
+}
+
+// createSpecial creates the special file f at path with the given permissions.
+// Creating device nodes usually requires privileges.
+func createSpecial(path string, f File, perm fs.FileMode) error {
+	mode := uint32(perm.Perm())
+	switch f.Special {
+	case specialFifo:
+		mode |= syscall.S_IFIFO
+	case specialChar:
+		mode |= syscall.S_IFCHR
+	case specialBlock:
+		mode |= syscall.S_IFBLK
+	}
+	if err := syscall.Mknod(path, mode, int(f.Rdev)); err != nil {
+		return &fs.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// +build linux
+
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/testutils"
+)
+
+func TestSpecials(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	os.WriteFile(filepath.Join(source, "file"), []byte("content"), 0664)
+	if err := syscall.Mkfifo(filepath.Join(source, "fifo"), 0664); err != nil {
+		t.Skip("fifo not supported: ", err)
+	}
+	device := syscall.Mknod(filepath.Join(source, "null"), syscall.S_IFCHR|0664, 1<<8|3) == nil
+
+	NewRepo(temp, 8<<10).Commit(source)
+	files, _ := NewRepo(temp, 8<<10).VersionFiles(-1)
+	testutils.AssertLen(t, 1, files, "Files without specials")
+
+	repo := NewRepo(temp, 8<<10)
+	repo.SetSpecials(true)
+	repo.Commit(source)
+	files, _ = NewRepo(temp, 8<<10).VersionFiles(-1)
+	specials := map[string]File{}
+	for _, f := range files {
+		if f.Special != "" {
+			specials[f.Path] = f
+		}
+	}
+	testutils.AssertSame(t, specialFifo, specials["/fifo"].Special, "Fifo type")
+	if device {
+		testutils.AssertSame(t, specialChar, specials["/null"].Special, "Device type")
+		testutils.AssertSame(t, uint64(1<<8|3), specials["/null"].Rdev, "Device number")
+	}
+
+	dest := t.TempDir()
+	NewRepo(temp, 8<<10).Restore(dest)
+	if _, err := os.Lstat(filepath.Join(dest, "fifo")); err == nil {
+		t.Error("fifo should not be restored without the option")
+	}
+	dest = t.TempDir()
+	repo = NewRepo(temp, 8<<10)
+	repo.SetSpecials(true)
+	if err := repo.Restore(dest); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(dest, "fifo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, os.ModeNamedPipe, info.Mode().Type(), "Restored fifo type")
+	testutils.AssertSameFile(t, filepath.Join(source, "file"), filepath.Join(dest, "file"), "Regular file")
+	if device {
+		info, err := os.Lstat(filepath.Join(dest, "null"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testutils.AssertSame(t, os.ModeDevice|os.ModeCharDevice, info.Mode().Type(), "Restored device type")
+	}
+}
@@ -0,0 +1,131 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/n-peugnet/dna-backup/delta"
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+// SetSplitFiles enables storing the file list of the new versions split by
+// top-level entry of the source, each part in its own file of a files.d
+// directory. A single file can then be restored by only loading its part.
+// Such lists do not depend on the previous ones, so they are larger.
+func (r *Repo) SetSplitFiles(enabled bool) {
+	r.splitFiles = enabled
+}
+
+// hasSplitFiles tells if the file list of the given version is split.
+func hasSplitFiles(version string) bool {
+	info, err := os.Stat(filepath.Join(version, filesDirName))
+	return err == nil && info.IsDir()
+}
+
+// topLevelName returns the name of the top-level entry of the source that
+// contains the file at the given path.
+func topLevelName(path string) string {
+	path = strings.TrimPrefix(filepath.ToSlash(path), "/")
+	return strings.SplitN(path, "/", 2)[0]
+}
+
+// storeSplitFiles stores the list split by top-level entry into the given
+// version directory. The parts are named after their entry, so that reading
+// them in the order of their names gives back the list. It returns false,
+// without storing anything, if the list is not sorted by top-level entry or if
+// the names of the parts would collide on case-insensitive filesystems.
+func (r *Repo) storeSplitFiles(version string, list []File) bool {
+	var names []string
+	var parts [][]File
+	folded := make(map[string]bool)
+	for _, f := range list {
+		name := topLevelName(f.Path)
+		if len(names) > 0 && name == names[len(names)-1] {
+			parts[len(parts)-1] = append(parts[len(parts)-1], f)
+			continue
+		}
+		if len(names) > 0 && name < names[len(names)-1] {
+			logger.Warning("file list not sorted by top-level entry, not splitting it")
+			return false
+		}
+		if folded[strings.ToLower(name)] {
+			logger.Warning("top-level entries collide on case-insensitive filesystems, not splitting the file list")
+			return false
+		}
+		folded[strings.ToLower(name)] = true
+		names = append(names, name)
+		parts = append(parts, []File{f})
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	dir := filepath.Join(version, filesDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Panic(err)
+	}
+	if err := os.MkdirAll(dir, r.dirMode); err != nil {
+		logger.Panic(err)
+	}
+	for i, part := range parts {
+		name := filepath.Join(filesDirName, names[i])
+		storeDelta(nil, listHeader{Count: len(part), Format: fileModesFormat}, part, r.meta(), version, name, r.differ, r.chunkWriteWrapper)
+	}
+	return true
+}
+
+// loadFilesPart loads the part of the split file list of the given version
+// named name.
+func loadFilesPart(store MetaStore, version string, name string, patcher delta.Patcher, wrapper utils.ReadWrapper) (part []File, err error) {
+	var raw bytes.Buffer
+	var perr error
+	err = readDelta(store, version, filepath.Join(filesDirName, name), wrapper, func(in io.ReadCloser) {
+		perr = patcher.Patch(new(bytes.Buffer), &raw, in)
+	})
+	if err == nil {
+		err = perr
+	}
+	if err == nil {
+		err = decodeList(raw.Bytes(), &part)
+	}
+	return
+}
+
+// loadSplitFiles loads all the parts of the split file list of the given
+// version and returns the list encoded as if it had not been split, so that
+// the next versions can be patched against it.
+func loadSplitFiles(store MetaStore, version string, patcher delta.Patcher, wrapper utils.ReadWrapper) ([]byte, error) {
+	entries, err := os.ReadDir(filepath.Join(version, filesDirName))
+	if err != nil {
+		return nil, err
+	}
+	var list []File
+	for _, e := range entries {
+		part, err := loadFilesPart(store, version, e.Name(), patcher, wrapper)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, part...)
+	}
+	return encodeList(listHeader{Count: len(list), Format: fileModesFormat}, list).Bytes(), nil
+}
@@ -0,0 +1,215 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// stagedVersion is the version number of the chunks of a staged commit until
+// it is finalized.
+const stagedVersion = -1
+
+// versionDir returns the path of the dir of the given version number.
+func (r *Repo) versionDir(version int) string {
+	if r.stageDir != "" && version == r.stageNumber {
+		return r.stageDir
+	}
+	return filepath.Join(r.path, fmt.Sprintf(versionFmt, version))
+}
+
+// chunkPath returns the path of the file of the given chunk.
+func (r *Repo) chunkPath(id *ChunkId) string {
+	return filepath.Join(r.versionDir(id.Ver), chunksName, fmt.Sprintf(chunkIdFmt, id.Idx))
+}
+
+// Stage commits source into a new dir of the staging area of the repo instead
+// of a new version, and returns its name. It does not take the lock of the
+// repo, so that several commits can be staged at the same time, each of them
+// deduplicated against the versions finalized when it started. The staged
+// commit becomes a version once FinalizeStaged is called with its name.
+func (r *Repo) Stage(source string) (string, error) {
+	if r.readOnly {
+		return "", ErrReadOnly
+	}
+	if r.indexOnly || r.hasBase {
+		return "", fmt.Errorf("index-only and based commits cannot be staged")
+	}
+	source, files, err := r.prepareCommit(source)
+	if err != nil {
+		return "", err
+	}
+	staging := filepath.Join(r.path, stagingName)
+	if err := os.MkdirAll(staging, r.dirMode); err != nil {
+		return "", err
+	}
+	r.storeConfig()
+	dir, err := os.MkdirTemp(staging, "")
+	if err != nil {
+		return "", err
+	}
+	// the staged commit is not complete as long as it is marked as partial
+	if err := os.WriteFile(filepath.Join(dir, partialName), nil, r.metaFileMode()); err != nil {
+		return "", err
+	}
+	r.stageDir, r.stageNumber = dir, stagedVersion
+	defer func() { r.stageDir = "" }()
+	logger.Infof("stage commit into %s", dir)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	r.loadHashes(r.versions, &wg)
+	if err := r.checkFreeSpace(files); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	_, recipe := r.commitFiles(stagedVersion, 0, &files)
+	if err := r.commitError(); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	newFiles, _ := unprefixFiles(files, source)
+	// the lists are stored whole, their deltas are computed once finalized
+	r.filesRaw, r.recipeRaw = nil, nil
+	r.storeFileList(stagedVersion, newFiles)
+	r.storeRecipe(stagedVersion, recipe)
+	if err := r.storeNote(stagedVersion); err != nil {
+		return "", err
+	}
+	if err := os.Remove(filepath.Join(dir, partialName)); err != nil {
+		return "", err
+	}
+	return filepath.Base(dir), nil
+}
+
+// stagedDirs returns the dirs of the staging area of the repo in the order
+// they were last modified, along with the staged commits they hold, which are
+// those that are complete.
+func (r *Repo) stagedDirs() (dirs []string, staged []string, err error) {
+	entries, err := os.ReadDir(filepath.Join(r.path, stagingName))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	times := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, nil, err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, e.Name())
+			times[e.Name()] = info.ModTime().UnixNano()
+		}
+	}
+	sort.SliceStable(dirs, func(i, j int) bool { return times[dirs[i]] < times[dirs[j]] })
+	for _, d := range dirs {
+		path := filepath.Join(r.path, stagingName, d, partialName)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			staged = append(staged, d)
+		}
+	}
+	return
+}
+
+// StagedCommits returns the names of the complete staged commits of the repo
+// in the order they were completed.
+func (r *Repo) StagedCommits() ([]string, error) {
+	_, staged, err := r.stagedDirs()
+	return staged, err
+}
+
+// FinalizeStaged turns the staged commit of the given name into the new latest
+// version of the repo and returns its index. Only this step holds the lock of
+// the repo: it stores the lists of the staged commit as deltas against the
+// ones of the previous version and moves its dir among the versions.
+func (r *Repo) FinalizeStaged(name string) (int, error) {
+	unlock, err := r.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	dir := filepath.Join(r.path, stagingName, name)
+	if name != filepath.Base(name) {
+		return 0, fmt.Errorf("invalid staged commit name %q", name)
+	}
+	if _, err := os.Stat(filepath.Join(dir, partialName)); err == nil {
+		return 0, fmt.Errorf("staged commit %s is not complete", name)
+	}
+	r.loadVersions()
+	if r.partialVersion() < len(r.versions) {
+		return 0, fmt.Errorf("the latest version must be finalized before a staged commit")
+	}
+	var files []File
+	var recipe []Chunk
+	if _, err := loadDeltas(&files, []string{dir}, r.meta(), r.patcher, r.chunkReadWrapper, filesName); err != nil {
+		return 0, err
+	}
+	if _, err := loadDeltas(&recipe, []string{dir}, r.meta(), r.patcher, r.chunkReadWrapper, recipeName); err != nil {
+		return 0, err
+	}
+	r.setRecipeRepo(recipe)
+	// only the raw lists of the previous version are needed for the deltas
+	if err := r.loadLists(r.versions, false); err != nil {
+		return 0, err
+	}
+	number := r.versionNumberAt(len(r.versions))
+	logger.Infof("finalize staged commit %s as version %d", name, number)
+	for _, c := range recipe {
+		switch c := c.(type) {
+		case *StoredChunk:
+			if c.Id.Ver == stagedVersion {
+				c.Id = &ChunkId{Ver: number, Idx: c.Id.Idx}
+			}
+		case *DeltaChunk:
+			if c.Source.Ver == stagedVersion {
+				c.Source = &ChunkId{Ver: number, Idx: c.Source.Idx}
+			}
+		}
+	}
+	dest := r.versionDir(number)
+	r.stageDir, r.stageNumber = dir, number
+	defer func() { r.stageDir = "" }()
+	r.storeFileList(number, files)
+	r.storeRecipe(number, recipe)
+	if err := r.storeDigest(number, files); err != nil {
+		logger.Warning("digest ", err)
+	}
+	if r.fileMap {
+		r.storeFileMap(number, fileLocations(files, recipe))
+	}
+	if err := os.Rename(dir, dest); err != nil {
+		return 0, err
+	}
+	r.stageDir = ""
+	if err := r.storeVersionEntry(number, files, time.Now()); err != nil {
+		logger.Warning("versions index ", err)
+	}
+	if err := r.syncVersion(number); err != nil {
+		return 0, err
+	}
+	r.loadVersions()
+	return len(r.versions) - 1, nil
+}
@@ -0,0 +1,86 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SizeHistogram counts the chunks of recipes by size. Counts[i] is the number
+// of chunks smaller than Bounds[i] and at least as large as Bounds[i-1]. The
+// chunks of at least the chunk size are counted in Full.
+type SizeHistogram struct {
+	ChunkSize int
+	Bounds    []int
+	Counts    []int
+	Full      int
+}
+
+func newSizeHistogram(chunkSize int) SizeHistogram {
+	h := SizeHistogram{ChunkSize: chunkSize}
+	for b := 64; b < chunkSize; b *= 2 {
+		h.Bounds = append(h.Bounds, b)
+	}
+	h.Bounds = append(h.Bounds, chunkSize)
+	h.Counts = make([]int, len(h.Bounds))
+	return h
+}
+
+func (h *SizeHistogram) add(size int) {
+	for i, b := range h.Bounds {
+		if size < b {
+			h.Counts[i]++
+			return
+		}
+	}
+	h.Full++
+}
+
+// Merge adds the counts of o, which must have the same chunk size, to h.
+func (h *SizeHistogram) Merge(o SizeHistogram) {
+	for i := range h.Counts {
+		h.Counts[i] += o.Counts[i]
+	}
+	h.Full += o.Full
+}
+
+func (h SizeHistogram) String() string {
+	var b strings.Builder
+	width := len(fmt.Sprint(h.ChunkSize))
+	for i, c := range h.Counts {
+		fmt.Fprintf(&b, "  < %*d: %d chunks\n", width, h.Bounds[i], c)
+	}
+	fmt.Fprintf(&b, "  %-*s %d chunks\n", width+3, "full:", h.Full)
+	return b.String()
+}
+
+// ChunkSizes returns the histogram of the sizes of the chunks of the recipe of
+// the given version, whatever the way they are stored. Negative numbers count
+// backwards from the latest version.
+func (r *Repo) ChunkSizes(version int) (h SizeHistogram, err error) {
+	recipe, err := r.VersionChunks(version)
+	if err != nil {
+		return
+	}
+	h = newSizeHistogram(r.chunkSize)
+	for _, c := range recipe {
+		h.add(c.Len())
+	}
+	return
+}
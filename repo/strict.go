@@ -0,0 +1,47 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// SetStrict makes a commit fail if any warning has been reported while reading
+// its source, such as files that could not be read or listed, so that an
+// incomplete version is never stored silently.
+func (r *Repo) SetStrict(strict bool) {
+	r.strict = strict
+}
+
+// warn logs a warning about the source of the current commit and counts it.
+func (r *Repo) warn(v ...interface{}) {
+	atomic.AddInt64(&r.warnings, 1)
+	logger.Warning(v...)
+}
+
+// checkWarnings returns an error if the repo is strict and warnings have been
+// reported since the beginning of the current commit.
+func (r *Repo) checkWarnings() error {
+	if n := atomic.LoadInt64(&r.warnings); r.strict && n > 0 {
+		return fmt.Errorf("%w: %d", ErrStrictWarnings, n)
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// SyncChunk identifies a stored chunk during a sync by the checksum of its
+// content recorded in the hashes of its version. A remote holding a chunk with
+// the same id and checksum, stored raw or not alike and compressed with the
+// same codec, holds the same chunk file.
+type SyncChunk struct {
+	Id    ChunkId
+	Sum   []byte
+	Raw   bool
+	Codec string
+}
+
+// SyncRemote is the end of a sync receiving the copy of a repo. The paths are
+// relative to the root of the repo.
+type SyncRemote interface {
+	// Have tells which of the given chunks the remote already stores.
+	Have(chunks []SyncChunk) ([]bool, error)
+	// Put stores data as the file at the given path, replacing it atomically.
+	Put(path string, data []byte) error
+	// Keep removes the files of the remote that are not listed.
+	Keep(paths []string) error
+}
+
+// syncBatch is the number of chunks the remote is asked about at once.
+const syncBatch = 4096
+
+// Sync copies the repo into the given remote. Only the chunks that the remote
+// does not have are sent, while the other files of the repo are always sent,
+// after the chunks so that the remote never has a version whose chunks are
+// missing. The files of the remote that the repo does not have, such as those
+// of pruned versions, are then removed. The metadata must be stored as files.
+func (r *Repo) Sync(remote SyncRemote) error {
+	chunks, metas, err := r.syncFiles()
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(chunks)+len(metas))
+	var sent int
+	for start := 0; start < len(chunks); start += syncBatch {
+		if err := r.canceled(); err != nil {
+			return err
+		}
+		end := start + syncBatch
+		if end > len(chunks) {
+			end = len(chunks)
+		}
+		have, err := remote.Have(chunks[start:end])
+		if err != nil {
+			return fmt.Errorf("have: %w", err)
+		}
+		if len(have) != end-start {
+			return fmt.Errorf("have: %d answers for %d chunks", len(have), end-start)
+		}
+		for i, c := range chunks[start:end] {
+			path := syncChunkPath(c.Id)
+			paths = append(paths, path)
+			if have[i] {
+				continue
+			}
+			if err := r.syncPut(remote, path); err != nil {
+				return err
+			}
+			sent++
+		}
+	}
+	logger.Infof("sent %d chunks of %d", sent, len(chunks))
+	for _, path := range metas {
+		if err := r.canceled(); err != nil {
+			return err
+		}
+		if err := r.syncPut(remote, path); err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+	if err := remote.Keep(paths); err != nil {
+		return fmt.Errorf("keep: %w", err)
+	}
+	return nil
+}
+
+func (r *Repo) syncPut(remote SyncRemote, path string) error {
+	data, err := os.ReadFile(filepath.Join(r.path, path))
+	if err != nil {
+		return err
+	}
+	if err := remote.Put(path, data); err != nil {
+		return fmt.Errorf("put %s: %w", path, err)
+	}
+	return nil
+}
+
+// syncChunkPath returns the path of the given chunk relative to the repo.
+func syncChunkPath(id ChunkId) string {
+	return filepath.Join(fmt.Sprintf(versionFmt, id.Ver), chunksName, fmt.Sprintf(chunkIdFmt, id.Idx))
+}
+
+// syncFiles lists the chunks of the repo and the paths of its other files,
+// those of the versions first and those of the root last. The lock, the
+// staging area and the temporary files are left out.
+func (r *Repo) syncFiles() (chunks []SyncChunk, metas []string, err error) {
+	var roots []string
+	err = filepath.WalkDir(r.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(r.path, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == stagingName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == lockName || strings.HasSuffix(rel, ".tmp") {
+			return nil
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) == 1 {
+			roots = append(roots, rel)
+			return nil
+		}
+		if len(parts) == 3 && parts[1] == chunksName {
+			ver, verr := strconv.Atoi(parts[0])
+			idx, ierr := strconv.ParseUint(parts[2], 10, 64)
+			if verr == nil && ierr == nil {
+				chunks = append(chunks, SyncChunk{Id: ChunkId{ver, idx}})
+				return nil
+			}
+		}
+		metas = append(metas, rel)
+		return nil
+	})
+	codec := r.syncCodec()
+	hashes := make(map[int]map[uint64]chunkHashes)
+	for i := range chunks {
+		c := &chunks[i]
+		if _, ok := hashes[c.Id.Ver]; !ok {
+			hashes[c.Id.Ver] = r.syncHashes(c.Id.Ver)
+		}
+		h := hashes[c.Id.Ver][c.Id.Idx]
+		c.Sum, c.Raw, c.Codec = h.Sum, h.Raw, codec
+	}
+	return chunks, append(metas, roots...), err
+}
+
+// syncCodec returns the name of the codec of the chunks of the repo, which
+// changes when it is recompressed.
+func (r *Repo) syncCodec() string {
+	c := r.config()
+	return c.Compression + c.Dictionary
+}
+
+// syncHashes returns the hashes of the chunks of the version dir number by
+// index, or nil if it has none.
+func (r *Repo) syncHashes(number int) map[uint64]chunkHashes {
+	version := r.versionDir(number)
+	if !hasMeta(r.meta(), version, hashesName) {
+		return nil
+	}
+	hashes := make(map[uint64]chunkHashes)
+	readHashes(r.meta(), version, func(idx uint64, h chunkHashes) {
+		hashes[idx] = h
+	})
+	return hashes
+}
+
+// repoRemote is the SyncRemote storing the copy into a local repo. The hashes
+// of its versions are read once asked about their chunks.
+type repoRemote struct {
+	r      *Repo
+	hashes map[int]map[uint64]chunkHashes
+}
+
+func newRepoRemote(r *Repo) repoRemote {
+	return repoRemote{r, make(map[int]map[uint64]chunkHashes)}
+}
+
+// localPath returns the path of the file of the repo at the given relative
+// path, which must not escape the repo nor be its lock.
+func (s repoRemote) localPath(path string) (string, error) {
+	clean := filepath.Clean(path)
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %q", path)
+	}
+	if clean == lockName || clean == stagingName || strings.HasPrefix(clean, stagingName+string(filepath.Separator)) {
+		return "", fmt.Errorf("reserved path %q", path)
+	}
+	return filepath.Join(s.r.path, clean), nil
+}
+
+func (s repoRemote) Have(chunks []SyncChunk) ([]bool, error) {
+	have := make([]bool, len(chunks))
+	codec := s.r.syncCodec()
+	for i, c := range chunks {
+		path, err := s.localPath(syncChunkPath(c.Id))
+		if err != nil {
+			return nil, err
+		}
+		if len(c.Sum) == 0 || c.Codec != codec {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		hashes, ok := s.hashes[c.Id.Ver]
+		if !ok {
+			hashes = s.r.syncHashes(c.Id.Ver)
+			s.hashes[c.Id.Ver] = hashes
+		}
+		h, ok := hashes[c.Id.Idx]
+		have[i] = ok && h.Raw == c.Raw && bytes.Equal(h.Sum, c.Sum)
+	}
+	return have, nil
+}
+
+func (s repoRemote) Put(path string, data []byte) error {
+	dest, err := s.localPath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), s.r.dirMode); err != nil {
+		return err
+	}
+	return writeFileAtomic(dest, data, s.r.fileMode, s.r.fsync)
+}
+
+func (s repoRemote) Keep(paths []string) error {
+	kept := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		kept[filepath.Clean(p)] = true
+	}
+	var removed []string
+	err := filepath.WalkDir(s.r.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.r.path, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == stagingName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel != lockName && !kept[rel] {
+			removed = append(removed, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range removed {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	// the dirs of the removed versions are left empty
+	entries, err := os.ReadDir(s.r.path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); e.IsDir() && err == nil && !hasFiles(filepath.Join(s.r.path, e.Name())) {
+			if err := os.RemoveAll(filepath.Join(s.r.path, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if len(removed) > 0 {
+		logger.Infof("removed %d files", len(removed))
+	}
+	return nil
+}
+
+// hasFiles returns true if the dir at path or one of its sub dirs holds a file.
+func hasFiles(path string) bool {
+	found := errors.New("found")
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			return found
+		}
+		return err
+	})
+	return err == found
+}
+
+// SyncRepos copies the repo source into the repo dest, which is locked during
+// the sync. See Sync.
+func SyncRepos(source *Repo, dest *Repo) error {
+	unlock, err := dest.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return source.Sync(newRepoRemote(dest))
+}
+
+// syncRequest is a request of the sync protocol, Op being one of have, put
+// and keep.
+type syncRequest struct {
+	Op     string
+	Chunks []SyncChunk
+	Path   string
+	Data   []byte
+	Paths  []string
+}
+
+// syncResponse is the answer to a syncRequest, Err being empty on success.
+type syncResponse struct {
+	Have []bool
+	Err  string
+}
+
+// syncClient is the SyncRemote sending the copy to a ServeSync server. The
+// requests and responses are gob encoded.
+type syncClient struct {
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+}
+
+// NewSyncClient returns a SyncRemote sending its requests into w and reading
+// the responses of a ServeSync server from r.
+func NewSyncClient(r io.Reader, w io.Writer) SyncRemote {
+	return &syncClient{gob.NewEncoder(w), gob.NewDecoder(r)}
+}
+
+func (c *syncClient) call(req syncRequest) (resp syncResponse, err error) {
+	if err = c.encoder.Encode(req); err != nil {
+		return
+	}
+	if err = c.decoder.Decode(&resp); err != nil {
+		return
+	}
+	if resp.Err != "" {
+		err = errors.New(resp.Err)
+	}
+	return
+}
+
+func (c *syncClient) Have(chunks []SyncChunk) ([]bool, error) {
+	resp, err := c.call(syncRequest{Op: "have", Chunks: chunks})
+	return resp.Have, err
+}
+
+func (c *syncClient) Put(path string, data []byte) error {
+	_, err := c.call(syncRequest{Op: "put", Path: path, Data: data})
+	return err
+}
+
+func (c *syncClient) Keep(paths []string) error {
+	_, err := c.call(syncRequest{Op: "keep", Paths: paths})
+	return err
+}
+
+// ServeSync locks the repo r and serves the requests of a sync client read
+// from in, writing the responses into out, until in is closed.
+func ServeSync(r *Repo, in io.Reader, out io.Writer) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	remote := newRepoRemote(r)
+	decoder := gob.NewDecoder(in)
+	encoder := gob.NewEncoder(out)
+	for {
+		var req syncRequest
+		if err := decoder.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var resp syncResponse
+		switch req.Op {
+		case "have":
+			resp.Have, err = remote.Have(req.Chunks)
+		case "put":
+			err = remote.Put(req.Path, req.Data)
+		case "keep":
+			err = remote.Keep(req.Paths)
+		default:
+			err = fmt.Errorf("unknown sync request: %q", req.Op)
+		}
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import "github.com/n-peugnet/dna-backup/logger"
+
+// SetVerifyOnWrite enables reading back each new chunk from the drive right
+// after it has been stored, to check that it still matches its fingerprint and
+// checksum. A mismatch aborts the commit without creating its version.
+func (r *Repo) SetVerifyOnWrite(enabled bool) {
+	r.verifyOnWrite = enabled
+}
+
+// verifyWritten checks a chunk that has just been stored, recording the first
+// failure so that the commit can report it.
+func (r *Repo) verifyWritten(data chunkData) {
+	err := r.verifyChunk(data.id, data.hashes)
+	if err == nil {
+		return
+	}
+	logger.Error("verify on write ", err)
+	r.recordWriteError(err)
+}
+
+// recordWriteError records the given failure to store a chunk, unless one has
+// already been recorded, so that the commit can report it.
+func (r *Repo) recordWriteError(err error) {
+	r.writeErrMutex.Lock()
+	defer r.writeErrMutex.Unlock()
+	if r.writeErr == nil {
+		r.writeErr = err
+	}
+}
+
+// writeError returns and clears the first failure recorded by recordWriteError.
+func (r *Repo) writeError() error {
+	r.writeErrMutex.Lock()
+	defer r.writeErrMutex.Unlock()
+	err := r.writeErr
+	r.writeErr = nil
+	return err
+}
@@ -0,0 +1,87 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bufio"
+	"io"
+)
+
+// VersionReader reads the files of a version one after the other, in the
+// order of its recipe, without restoring them to the drive.
+type VersionReader struct {
+	files   []File
+	stream  *io.PipeReader
+	buf     *bufio.Reader
+	current io.Reader
+}
+
+// OpenVersion returns a reader of the files of the given version. Negative
+// numbers count backwards from the latest version.
+func (r *Repo) OpenVersion(version int) (*VersionReader, error) {
+	r.loadVersions()
+	idx, err := r.versionIndex(version)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkContent(idx); err != nil {
+		return nil, err
+	}
+	runs, err := r.loadRestoreLists(r.versions[:idx+1])
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go r.restoreStream(writer, runs)
+	return &VersionReader{
+		files:  r.files,
+		stream: reader,
+		buf:    bufio.NewReaderSize(reader, r.chunkSize*2),
+	}, nil
+}
+
+// Next returns the next file of the version along with a reader of its
+// content, bounded to its size. Symlinks and special files have an empty
+// content. The reader is only valid until the next call to Next.
+//
+// It returns io.EOF once all the files have been read.
+func (v *VersionReader) Next() (File, io.Reader, error) {
+	if v.current != nil {
+		// skip what has not been read of the previous file
+		if _, err := io.Copy(io.Discard, v.current); err != nil {
+			return File{}, nil, err
+		}
+	}
+	if len(v.files) == 0 {
+		v.current = nil
+		return File{}, nil, io.EOF
+	}
+	file := v.files[0]
+	v.files = v.files[1:]
+	var size int64
+	if file.isRegular() {
+		size = file.Size
+	}
+	v.current = io.LimitReader(v.buf, size)
+	return file, v.current, nil
+}
+
+// Close stops reading the version.
+func (v *VersionReader) Close() error {
+	return v.stream.Close()
+}
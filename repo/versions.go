@@ -0,0 +1,242 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VersionEntry describes a version of a repo, as recorded in its versions
+// index.
+type VersionEntry struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Files   int       `json:"files"`
+	Size    int64     `json:"size"`
+	Digest  string    `json:"digest"`
+	Label   string    `json:"label,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// newVersionEntry returns the entry of the version dir number from its files
+// and the note recorded in its dir.
+func (r *Repo) newVersionEntry(number int, files []File, t time.Time) VersionEntry {
+	e := VersionEntry{
+		Version: number,
+		Time:    t.UTC().Truncate(time.Second),
+		Files:   len(files),
+		Digest:  hex.EncodeToString(versionDigest(r.checksumAlgo, files)),
+	}
+	e.Label, e.Message = readNote(r.versionDir(number))
+	for _, f := range files {
+		e.Size += f.Size
+	}
+	return e
+}
+
+// readVersionsIndex returns the entries of the versions index by version dir
+// number. Malformed lines are ignored. The label and the message of a version
+// are quoted at the end of its line, which only holds 5 fields without them.
+func (r *Repo) readVersionsIndex() (map[int]VersionEntry, error) {
+	raw, err := os.ReadFile(filepath.Join(r.path, versionsName))
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[int]VersionEntry)
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		var e VersionEntry
+		line, note := scanner.Text(), ""
+		if i := strings.IndexByte(line, '"'); i >= 0 {
+			line, note = line[:i], line[i:]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			continue
+		}
+		if note != "" {
+			var err error
+			if e.Label, e.Message, err = parseNote(note); err != nil {
+				continue
+			}
+		}
+		var err1, err2, err3, err4 error
+		e.Version, err1 = strconv.Atoi(fields[0])
+		e.Time, err2 = time.Parse(time.RFC3339, fields[1])
+		e.Files, err3 = strconv.Atoi(fields[2])
+		e.Size, err4 = strconv.ParseInt(fields[3], 10, 64)
+		e.Digest = fields[4]
+		if err1 == nil && err2 == nil && err3 == nil && err4 == nil {
+			entries[e.Version] = e
+		}
+	}
+	return entries, nil
+}
+
+// parseNote returns the quoted label and message at the end of a line of the
+// versions index.
+func parseNote(note string) (label string, message string, err error) {
+	quoted, err := strconv.QuotedPrefix(note)
+	if err != nil {
+		return "", "", err
+	}
+	label, _ = strconv.Unquote(quoted)
+	rest := strings.TrimLeft(note[len(quoted):], " ")
+	if quoted, err = strconv.QuotedPrefix(rest); err != nil {
+		return "", "", err
+	}
+	message, _ = strconv.Unquote(quoted)
+	return label, message, nil
+}
+
+// writeVersionsIndex replaces the versions index with the given entries,
+// sorted by version dir number.
+func (r *Repo) writeVersionsIndex(entries map[int]VersionEntry) error {
+	numbers := make([]int, 0, len(entries))
+	for n := range entries {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	var buff bytes.Buffer
+	for _, n := range numbers {
+		e := entries[n]
+		fmt.Fprintf(&buff, versionFmt+" %s %d %d %s", e.Version, e.Time.Format(time.RFC3339), e.Files, e.Size, e.Digest)
+		if e.Label != "" || e.Message != "" {
+			fmt.Fprintf(&buff, " %q %q", e.Label, e.Message)
+		}
+		buff.WriteByte('\n')
+	}
+	path := filepath.Join(r.path, versionsName)
+	if err := os.WriteFile(path+".tmp", buff.Bytes(), r.metaFileMode()); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// storeVersionEntry adds the entry of the version dir number committed at time
+// t to the versions index, replacing the previous one if the version has been
+// appended to.
+func (r *Repo) storeVersionEntry(number int, files []File, t time.Time) error {
+	entries, err := r.readVersionsIndex()
+	if os.IsNotExist(err) {
+		entries = make(map[int]VersionEntry)
+	} else if err != nil {
+		return err
+	}
+	entries[number] = r.newVersionEntry(number, files, t)
+	return r.writeVersionsIndex(entries)
+}
+
+// computeVersionEntry returns the entry of the version at the given index from
+// its version dir. The modification time of its file list stands for the time
+// of its commit.
+func (r *Repo) computeVersionEntry(idx int) (VersionEntry, error) {
+	files, err := r.VersionFiles(idx)
+	if err != nil {
+		return VersionEntry{}, err
+	}
+	info, err := os.Stat(filepath.Join(r.versions[idx], filesName))
+	if err != nil {
+		if info, err = os.Stat(r.versions[idx]); err != nil {
+			return VersionEntry{}, err
+		}
+	}
+	return r.newVersionEntry(versionNumber(r.versions[idx]), files, info.ModTime()), nil
+}
+
+// VersionEntries returns the entries of the versions of the repo, indexed by
+// version from the oldest one. They are read from the versions index, except
+// for the versions it is missing, which are computed from their version dirs.
+func (r *Repo) VersionEntries() ([]VersionEntry, error) {
+	r.loadVersions()
+	indexed, err := r.readVersionsIndex()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	entries := make([]VersionEntry, len(r.versions))
+	for i, v := range r.versions {
+		e, ok := indexed[versionNumber(v)]
+		if !ok {
+			if e, err = r.computeVersionEntry(i); err != nil {
+				return nil, err
+			}
+		}
+		e.Version = i
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+// VersionInfo summarizes a version of a repo: its entry in the versions index
+// along with the number of chunks stored by its version dir.
+type VersionInfo struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Files   int       `json:"files"`
+	Size    int64     `json:"size"`
+	Chunks  int       `json:"chunks"`
+	Label   string    `json:"label,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// ListVersions returns the information of each version of the repo, indexed
+// by version from the oldest one.
+func (r *Repo) ListVersions() ([]VersionInfo, error) {
+	entries, err := r.VersionEntries()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]VersionInfo, len(entries))
+	for i, e := range entries {
+		chunks, err := countChunks(r.versions[i])
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = VersionInfo{e.Version, e.Time, e.Files, e.Size, chunks, e.Label, e.Message}
+	}
+	return infos, nil
+}
+
+// RebuildVersionsIndex regenerates the versions index of the repo from its
+// version dirs.
+func (r *Repo) RebuildVersionsIndex() error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	r.loadVersions()
+	entries := make(map[int]VersionEntry, len(r.versions))
+	for i := range r.versions {
+		e, err := r.computeVersionEntry(i)
+		if err != nil {
+			return err
+		}
+		entries[e.Version] = e
+	}
+	return r.writeVersionsIndex(entries)
+}
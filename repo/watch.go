@@ -0,0 +1,123 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/n-peugnet/dna-backup/cache"
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// Watch commits source each time its content has changed and then stayed
+// untouched for the debounce duration, until stop is closed. The source is
+// polled for changes a few times per debounce duration. If the repo is locked
+// by another commit when a change is ready, the commit is tried again at the
+// next poll. If the repo already has versions, the state of source when Watch
+// starts is considered as committed, otherwise it is committed first.
+//
+// Polling only stats the files, which costs a walk of the source at each poll,
+// but it is portable and needs no dependency, whereas filesystem notifications
+// need one watch per directory and may silently miss events when their queue
+// overflows.
+func (r *Repo) Watch(source string, debounce time.Duration, stop <-chan struct{}) error {
+	poll := debounce / 4
+	if poll < 10*time.Millisecond {
+		poll = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	var committed, current []byte
+	var changed time.Time
+	if _, err := os.Stat(r.path); err == nil {
+		r.loadVersions()
+	}
+	if len(r.versions) > 0 {
+		state, err := r.treeState(source)
+		if err != nil {
+			return err
+		}
+		committed, current = state, state
+	}
+	for {
+		state, err := r.treeState(source)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(state, current) {
+			current = state
+			changed = time.Now()
+		}
+		if !bytes.Equal(current, committed) && time.Since(changed) >= debounce {
+			logger.Infof("change detected in %s, commit", source)
+			err := r.Commit(source)
+			if errors.Is(err, ErrRepoLocked) {
+				logger.Warning(err)
+			} else if err != nil {
+				return err
+			} else {
+				committed = current
+			}
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// treeState returns a digest of the path, size, mode and modification time of
+// every file under root. It changes whenever one of the files does. Like for
+// a commit, the repo directory is skipped if it is inside root.
+func (r *Repo) treeState(root string) ([]byte, error) {
+	repoInfo, _ := os.Stat(r.path)
+	hasher := sha256.New()
+	err := filepath.Walk(root, func(p string, i fs.FileInfo, err error) error {
+		if err != nil {
+			logger.Warning(err)
+			return nil
+		}
+		if i.IsDir() && repoInfo != nil && os.SameFile(i, repoInfo) {
+			return filepath.SkipDir
+		}
+		fmt.Fprintf(hasher, "%s %d %s %d\n", p, i.Size(), i.Mode(), i.ModTime().UnixNano())
+		return nil
+	})
+	return hasher.Sum(nil), err
+}
+
+// Close releases the memory held by the repo. It must not be used anymore
+// afterwards.
+func (r *Repo) Close() error {
+	r.fingerprints = nil
+	r.sketches = nil
+	r.recipe = nil
+	r.recipeRaw = nil
+	r.files = nil
+	r.filesRaw = nil
+	r.chunkCache = cache.New(0)
+	return nil
+}
@@ -0,0 +1,88 @@
+// +build linux
+
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"sort"
+	"syscall"
+)
+
+// readXattrs returns the extended attributes of the file at the given path,
+// sorted by name. Filesystems that do not support them have none.
+func readXattrs(path string) ([]Xattr, error) {
+	names, err := xattrBuffer(func(buff []byte) (int, error) {
+		return syscall.Listxattr(path, buff)
+	})
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	var xattrs []Xattr
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := xattrBuffer(func(buff []byte) (int, error) {
+			return syscall.Getxattr(path, string(name), buff)
+		})
+		if err != nil {
+			return nil, &fs.PathError{Op: "getxattr " + string(name), Path: path, Err: err}
+		}
+		xattrs = append(xattrs, Xattr{Name: string(name), Value: value})
+	}
+	sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
+	return xattrs, nil
+}
+
+// xattrBuffer calls get a first time to know the size of the buffer it needs
+// and a second time to fill it.
+func xattrBuffer(get func(buff []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buff := make([]byte, size)
+		size, err = get(buff)
+		if errors.Is(err, syscall.ERANGE) {
+			// the value grew in between
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buff[:size], nil
+	}
+}
+
+// writeXattrs sets the given extended attributes on the file at path.
+func writeXattrs(path string, xattrs []Xattr) error {
+	for _, x := range xattrs {
+		if err := syscall.Setxattr(path, x.Name, x.Value, 0); err != nil {
+			return &fs.PathError{Op: "setxattr " + x.Name, Path: path, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// +build linux
+
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/testutils"
+)
+
+func TestXattrs(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	dest := t.TempDir()
+	path := filepath.Join(source, "file")
+	os.WriteFile(path, []byte("content"), 0664)
+	err := syscall.Setxattr(path, "user.dna-backup", []byte("value"), 0)
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) {
+		t.Skip("xattrs not supported: ", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := readXattrs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, []Xattr{{"user.dna-backup", []byte("value")}}, expected, "Source xattrs")
+
+	repo1 := NewRepo(temp, 8<<10)
+	repo1.SetXattrs(true)
+	repo1.Commit(source)
+	NewRepo(temp, 8<<10).Restore(dest)
+	actual, _ := readXattrs(filepath.Join(dest, "file"))
+	testutils.AssertLen(t, 0, actual, "Xattrs restored without the option")
+
+	dest = t.TempDir()
+	repo2 := NewRepo(temp, 8<<10)
+	repo2.SetXattrs(true)
+	repo2.Restore(dest)
+	actual, err = readXattrs(filepath.Join(dest, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, expected, actual, "Restored xattrs")
+}
@@ -0,0 +1,32 @@
+// +build !linux
+
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+// readXattrs does nothing on platforms where extended attributes are not
+// supported.
+func readXattrs(path string) ([]Xattr, error) {
+	return nil, nil
+}
+
+// writeXattrs does nothing on platforms where extended attributes are not
+// supported.
+func writeXattrs(path string, xattrs []Xattr) error {
+	return nil
+}
@@ -35,11 +35,13 @@ type ReadByteReader interface {
 
 const fBytes = 8
 
-// SketchChunk produces a sketch for a chunk based on wSize: the window size,
-// sfCount: the number of super-features, and fCount: the number of feature
-// per super-feature
-func SketchChunk(r io.Reader, pol rabinkarp64.Pol, chunkSize int, wSize int, sfCount int, fCount int) (Sketch, error) {
-	var fSize = FeatureSize(chunkSize, sfCount, fCount)
+// SketchChunk produces a sketch for a chunk based on fSize: the size of a
+// feature in bytes, wSize: the window size, sfCount: the number of
+// super-features, and fCount: the number of feature per super-feature.
+//
+// fSize is independent of the size of the chunk, FeatureSize can be used to
+// derive it from the chunk size.
+func SketchChunk(r io.Reader, pol rabinkarp64.Pol, fSize int, wSize int, sfCount int, fCount int) (Sketch, error) {
 	var chunk bytes.Buffer
 	superfeatures := make([]uint64, 0, sfCount)
 	features := make([]uint64, 0, fCount*sfCount)
@@ -48,7 +50,12 @@ func SketchChunk(r io.Reader, pol rabinkarp64.Pol, chunkSize int, wSize int, sfC
 	if err != nil {
 		logger.Panic(chunkLen, err)
 	}
-	for f := 0; f < int(chunkLen)/fSize; f++ {
+	// the features that do not make a whole superfeature are not computed
+	fTotal := int(chunkLen) / fSize / fCount * fCount
+	if fTotal > fCount*sfCount {
+		fTotal = fCount * sfCount
+	}
+	for f := 0; f < fTotal; f++ {
 		var fBuff bytes.Buffer
 		n, err := io.CopyN(&fBuff, &chunk, int64(fSize))
 		if err != nil {
@@ -39,7 +39,7 @@ func TestSketchChunk(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	sketch, err = SketchChunk(c0, pol, 8<<10, 32, 3, 4)
+	sketch, err = SketchChunk(c0, pol, FeatureSize(8<<10, 3, 4), 32, 3, 4)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -49,7 +49,7 @@ func TestSketchChunk(t *testing.T) {
 	}
 
 	c14, err := os.Open(filepath.Join(dataDir, "000000000000014"))
-	sketch, err = SketchChunk(c14, pol, 8<<10, 32, 3, 4)
+	sketch, err = SketchChunk(c14, pol, FeatureSize(8<<10, 3, 4), 32, 3, 4)
 	if err != nil {
 		t.Error(err)
 	}
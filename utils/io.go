@@ -47,6 +47,23 @@ func ZlibWriter(w io.Writer) io.WriteCloser {
 	return zlib.NewWriter(w)
 }
 
+// ZlibDictReader returns a ReadWrapper decompressing with the given preset
+// dictionary.
+func ZlibDictReader(dict []byte) ReadWrapper {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReaderDict(r, dict)
+	}
+}
+
+// ZlibDictWriter returns a WriteWrapper compressing with the given preset
+// dictionary.
+func ZlibDictWriter(dict []byte) WriteWrapper {
+	return func(w io.Writer) io.WriteCloser {
+		z, _ := zlib.NewWriterLevelDict(w, zlib.DefaultCompression, dict)
+		return z
+	}
+}
+
 func NopReadWrapper(r io.Reader) (io.ReadCloser, error) {
 	return io.NopCloser(r), nil
 }
@@ -48,6 +48,7 @@ func TestWrappers(t *testing.T) {
 	wrappers := []wrapper{
 		{"Zlib", utils.ZlibReader, utils.ZlibWriter},
 		{"Nop", utils.NopReadWrapper, utils.NopWriteWrapper},
+		{"ZlibDict", utils.ZlibDictReader([]byte("a test dict")), utils.ZlibDictWriter([]byte("a test dict"))},
 	}
 	for _, wrapper := range wrappers {
 		t.Run(wrapper.n, func(t *testing.T) {